@@ -5,7 +5,22 @@
 set -e
 
 PLUGIN_DIR="$(cd "$(dirname "$0")" && pwd)"
-WYZECAM_VERSION="2.10.2"
+WYZECAM_VERSION="${WYZECAM_VERSION:-2.10.2}"
+# Override to install wyzecam from a fork or pre-release branch/commit
+WYZE_BRIDGE_REPO="${WYZE_BRIDGE_REPO:-mrlt8/docker-wyze-bridge}"
+WYZE_BRIDGE_REF="${WYZE_BRIDGE_REF:-v${WYZECAM_VERSION}}"
+# Override to download the wyzecam tarball from an artifact mirror
+WYZECAM_TARBALL_URL="${WYZECAM_TARBALL_URL:-https://github.com/${WYZE_BRIDGE_REPO}/archive/${WYZE_BRIDGE_REF}.tar.gz}"
+# Optional expected SHA-256 of the tarball
+WYZECAM_TARBALL_SHA256="${WYZECAM_TARBALL_SHA256:-}"
+
+sha256_of() {
+    if command -v sha256sum >/dev/null 2>&1; then
+        sha256sum "$1" | cut -d' ' -f1
+    else
+        shasum -a 256 "$1" | cut -d' ' -f1
+    fi
+}
 
 echo "Setting up Wyze plugin..."
 
@@ -28,15 +43,30 @@ if [ ! -d "$PLUGIN_DIR/wyzecam" ]; then
     if [ -d "$PLUGIN_DIR/wyze-bridge/app/wyzecam" ]; then
         echo "Copying wyzecam library from submodule..."
         cp -r "$PLUGIN_DIR/wyze-bridge/app/wyzecam" "$PLUGIN_DIR/"
+        SUBMODULE_COMMIT=$(git -C "$PLUGIN_DIR/wyze-bridge" rev-parse HEAD 2>/dev/null || echo unknown)
+        echo "submodule@${SUBMODULE_COMMIT}" > "$PLUGIN_DIR/wyzecam/.source"
         echo "wyzecam library copied from submodule"
     else
         # Fallback: download via curl
-        echo "Downloading wyzecam library..."
+        echo "Downloading wyzecam library from ${WYZECAM_TARBALL_URL}..."
         TEMP_DIR=$(mktemp -d)
-        curl -sL "https://github.com/mrlt8/docker-wyze-bridge/archive/refs/tags/v${WYZECAM_VERSION}.tar.gz" | tar -xz -C "$TEMP_DIR"
+        curl -sfL "$WYZECAM_TARBALL_URL" -o "$TEMP_DIR/wyzecam.tar.gz"
+
+        if [ -n "$WYZECAM_TARBALL_SHA256" ]; then
+            ACTUAL_SHA256=$(sha256_of "$TEMP_DIR/wyzecam.tar.gz")
+            if [ "$ACTUAL_SHA256" != "$WYZECAM_TARBALL_SHA256" ]; then
+                echo "Checksum mismatch for wyzecam tarball: expected $WYZECAM_TARBALL_SHA256, got $ACTUAL_SHA256"
+                rm -rf "$TEMP_DIR"
+                exit 1
+            fi
+        fi
+
+        mkdir "$TEMP_DIR/src"
+        tar -xzf "$TEMP_DIR/wyzecam.tar.gz" -C "$TEMP_DIR/src"
 
-        # Copy wyzecam module
-        cp -r "$TEMP_DIR/docker-wyze-bridge-${WYZECAM_VERSION}/app/wyzecam" "$PLUGIN_DIR/"
+        # Copy wyzecam module (archive top-level directory name depends on the ref)
+        cp -r "$TEMP_DIR"/src/*/app/wyzecam "$PLUGIN_DIR/"
+        echo "${WYZE_BRIDGE_REPO}@${WYZE_BRIDGE_REF}" > "$PLUGIN_DIR/wyzecam/.source"
 
         # Cleanup
         rm -rf "$TEMP_DIR"
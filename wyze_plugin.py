@@ -10,18 +10,43 @@ from __future__ import annotations
 
 import argparse
 import asyncio
+import base64
+import concurrent.futures
+import datetime
+import fnmatch
+import hashlib
+import hmac
+import http.server
+import ipaddress
 import json
 import os
 import platform
+import queue
+import random
+import re
+import shutil
 import signal
+import socket
+import sqlite3
+import struct
 import subprocess
 import sys
 import threading
 import time
 import traceback
+import urllib.error
+import urllib.parse
 import urllib.request
-from ctypes import c_int
-from typing import Any, Dict, List, Optional
+import uuid
+from collections import deque
+from contextlib import contextmanager
+from ctypes import POINTER, Structure, c_char, c_int, c_ushort
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+try:
+    from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+except ImportError:  # Python 3.8: only UTC and fixed offsets
+    ZoneInfo = None
 
 # Add wyze-bridge wyzecam to path
 PLUGIN_DIR = os.path.dirname(os.path.abspath(__file__))
@@ -29,172 +54,4531 @@ WYZE_BRIDGE_DIR = os.path.join(PLUGIN_DIR, "wyze-bridge", "app")
 if os.path.exists(WYZE_BRIDGE_DIR):
     sys.path.insert(0, WYZE_BRIDGE_DIR)
 
+IS_WINDOWS = os.name == "nt"
+
 # Virtual environment Python path (used for go2rtc exec streams)
-VENV_PYTHON = os.path.join(PLUGIN_DIR, "venv", "bin", "python3")
+if IS_WINDOWS:
+    VENV_PYTHON = os.path.join(PLUGIN_DIR, "venv", "Scripts", "python.exe")
+else:
+    VENV_PYTHON = os.path.join(PLUGIN_DIR, "venv", "bin", "python3")
 
 import wyzecam
+from wyzecam.api import AccessTokenError, post_device
 from wyzecam.iotc import WyzeIOTC, WyzeIOTCSession
+from wyzecam.tutk import tutk_protocol
+
+# Default docker-wyze-bridge repository and ref for downloaded assets
+DEFAULT_BRIDGE_REPO = "mrlt8/docker-wyze-bridge"
+DEFAULT_BRIDGE_REF = "main"
+
+# TUTK library file name expected in lib/ on Windows hosts
+WINDOWS_TUTK_LIB = "tutk.dll"
 
 # TUTK SDK key (from docker-wyze-bridge)
 SDK_KEY = "AQAAAIZ44fijz5pURQiNw4xpEfV9ZysFH8LYBPDxiONQlbLKaDeb7n26TSOPSGHftbRVo25k3uz5of06iGNB4pSfmvsCvm/tTlmML6HKS0vVxZnzEuK95TPGEGt+aE15m6fjtRXQKnUav59VSRHwRj9Z1Kjm1ClfkSPUF5NfUvsb3IAbai0WlzZE1yYCtks7NFRMbTXUMq3bFtNhEERD/7oc504b"
 
+# JSON-RPC protocol version spoken by this plugin. Hosts on the same major version are
+# compatible; minor versions only add methods, params and notifications
+PROTOCOL_VERSION = "1.0"
+
 # Frame sizes
 FRAME_SIZE_2K = 3
 FRAME_SIZE_1080P = 1
 FRAME_SIZE_360P = 2
+FRAME_RESOLUTIONS = {
+    FRAME_SIZE_2K: (2560, 1440),
+    FRAME_SIZE_1080P: (1920, 1080),
+    FRAME_SIZE_360P: (640, 360),
+}
 
+# Known Wyze camera models: product_model -> (name, max resolution, extra capabilities)
+# Cameras with a model missing here still work with the generic capability set and are
+# flagged with model_known=false so the NVR can show them as unverified.
+CAMERA_MODELS: Dict[str, tuple] = {
+    "WYZEC1": ("Wyze Cam v1", "1080p", ["audio"]),
+    "WYZEC1-JZ": ("Wyze Cam v2", "1080p", ["audio"]),
+    "WYZE_CAKP2JFUS": ("Wyze Cam v3", "1080p", ["audio", "siren"]),
+    "HL_CAM3P": ("Wyze Cam v3 Pro", "2k", ["audio", "siren", "spotlight"]),
+    "HL_CAM4": ("Wyze Cam v4", "2.5k", ["audio", "siren", "spotlight", "dual_band_wifi"]),
+    "WYZECP1": ("Wyze Cam Pan", "1080p", ["audio", "ptz"]),
+    "HL_PAN2": ("Wyze Cam Pan v2", "1080p", ["audio", "ptz", "siren"]),
+    "HL_PAN3": ("Wyze Cam Pan v3", "1080p", ["audio", "ptz", "siren"]),
+    "HL_PANP": ("Wyze Cam Pan Pro", "2k", ["audio", "ptz", "siren"]),
+    "WVOD1": ("Wyze Cam Outdoor", "1080p", ["audio", "battery"]),
+    "HL_WCO2": ("Wyze Cam Outdoor v2", "1080p", ["audio", "battery"]),
+    "WYZEDB3": ("Wyze Video Doorbell", "1080p", ["audio", "doorbell"]),
+    "HL_DB2": ("Wyze Video Doorbell v2", "2k", ["audio", "doorbell"]),
+    "GW_BE1": ("Wyze Video Doorbell Pro", "2k", ["audio", "doorbell", "battery"]),
+    "GW_DBD": ("Wyze Duo Cam Doorbell", "2k", ["audio", "doorbell", "spotlight", "dual_band_wifi"]),
+    "GW_GC1": ("Wyze Cam OG", "1080p", ["audio", "spotlight"]),
+    "GW_GC2": ("Wyze Cam OG Telephoto", "1080p", ["audio", "spotlight"]),
+    "HL_CFL2": ("Wyze Cam Floodlight v2", "2k", ["audio", "siren", "floodlight"]),
+    "LD_CFP": ("Wyze Cam Floodlight Pro", "2.5k", ["audio", "siren", "floodlight", "dual_band_wifi"]),
+}
+HIGH_RES_MODELS = tuple(m for m, info in CAMERA_MODELS.items() if info[1] in ("2k", "2.5k"))
+# Minimum firmware per model for features older firmware lacks, on top of the model
+# capabilities above (feature -> model -> version); firmware_requirements adds to it
+FIRMWARE_REQUIREMENTS: Dict[str, Dict[str, str]] = {
+    "siren": {"WYZE_CAKP2JFUS": "4.36.0"},
+}
 
-def log(msg: str):
-    """Log to stderr (stdout is for JSON-RPC or video data)"""
-    print(f"[wyze] {msg}", file=sys.stderr, flush=True)
+# TUTK FRAMEINFO codec_id values
+VIDEO_CODECS = {0x4E: "h264", 0x4F: "mjpeg", 0x50: "h265"}
 
+# Cached auth is reused for this long before logging in again
+AUTH_CACHE_TTL = 3600
 
-def format_exception(e: Exception) -> str:
-    return "\n".join(traceback.format_exception(e))
+# PID files for child processes, used to reap orphans after a crash
+RUN_DIR = os.path.join(PLUGIN_DIR, "run")
+# How long camera payloads reuse one scan of the running stream processes
+STREAM_STATE_TTL = 5
 
+# Per-camera connection history written by stream processes
+STATS_DIR = os.path.join(PLUGIN_DIR, "stats")
+STATS_WRITE_INTERVAL = 5
+DEGRADED_DROP_RATE = 0.05
 
-def get_tutk_library() -> Optional[str]:
-    """Get or download the TUTK library for the current platform"""
-    machine = platform.machine()
-    if machine == "x86_64":
-        suffix = "amd64"
-    elif machine in ("aarch64", "arm64"):
-        suffix = "arm64"
-    else:
-        log(f"Unsupported architecture: {machine}")
-        return None
+# Wyze cloud API calls: retries for idempotent calls and latency histogram buckets (seconds)
+API_RETRIES = 3
+API_RETRY_DELAY = 1.0
+API_RETRY_STATUSES = (429, 500, 502, 503, 504)
+API_LATENCY_BUCKETS = (0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+# Wyze response codes for a revoked or expired access token; after a failed
+# re-authentication further attempts wait REAUTH_BACKOFF seconds
+WYZE_TOKEN_INVALID_CODES = ("2001",)
+REAUTH_BACKOFF = 60
+# Rolling windows for API usage accounting. Wyze does not publish limits; these
+# are informal throttling thresholds (calls per window, overridable with
+# api_usage_limits), warned about at API_USAGE_WARN_FRACTION
+API_USAGE_WINDOWS = {"1m": 60, "5m": 300, "1h": 3600, "24h": 86400}
+API_USAGE_LIMITS = {"5m": 300, "1h": 2000, "24h": 20000}
+API_USAGE_WARN_FRACTION = 0.8
+API_USAGE_MAX_CALLS = 100000
 
-    lib_dir = os.path.join(PLUGIN_DIR, "lib")
-    os.makedirs(lib_dir, exist_ok=True)
+# Name resolution overrides for Wyze API and download hosts (IPv4 for dns_servers)
+DNS_TIMEOUT = 2
+DNS_MAX_TTL = 300
+DNS_FAILURE_TTL = 30
+MAX_DNS_SERVERS = 4
 
-    lib_path = os.path.join(lib_dir, f"lib.{suffix}")
-    if os.path.exists(lib_path):
-        return lib_path
+# Oversized RPC results (inside a janitor-managed directory)
+SPILL_DIR = os.path.join(PLUGIN_DIR, "exports", "results")
 
-    # Download from docker-wyze-bridge (lib files are in app/lib/ subdirectory)
-    url = f"https://github.com/mrlt8/docker-wyze-bridge/raw/main/app/lib/lib.{suffix}"
-    log(f"Downloading TUTK library from {url}...")
+# Longest stdin request line (max_request_bytes); anything longer is skipped up to the next newline
+DEFAULT_MAX_REQUEST_BYTES = 10 * 1024 * 1024
+MAX_REQUEST_BYTES_BOUNDS = (64 * 1024, 256 * 1024 * 1024)
+# Room left for the JSON-RPC envelope when fitting results under the NVR's line limit
+MESSAGE_ENVELOPE_BYTES = 64 * 1024
+# Unparseable input is kept here (janitor-managed) for debugging, truncated
+DEAD_LETTER_DIR = os.path.join(PLUGIN_DIR, "logs")
+DEAD_LETTER_PREVIEW = 1024
+_REQUEST_ID_RE = re.compile(rb'"id"\s*:\s*("(?:[^"\\]|\\.)*"|-?\d+)')
 
-    try:
-        tmp_path = lib_path + ".tmp"
-        urllib.request.urlretrieve(url, tmp_path)
-        os.rename(tmp_path, lib_path)
-        os.chmod(lib_path, 0o755)
-        log(f"TUTK library downloaded: {lib_path}")
-        return lib_path
-    except Exception as e:
-        log(f"Failed to download TUTK library: {e}")
-        return None
+# Plugin-managed data directories (pruned by StorageJanitor)
+MANAGED_DIRS = ("snapshots", "exports", "logs")
 
+# Storage quota defaults (overridable via config)
+DEFAULT_STORAGE_MAX_BYTES = 512 * 1024 * 1024
+DEFAULT_STORAGE_MAX_AGE_DAYS = 7
+DEFAULT_JANITOR_INTERVAL = 3600
 
-def load_config() -> Dict[str, Any]:
-    """Load plugin configuration from file"""
-    config_path = os.path.join(PLUGIN_DIR, "config.json")
-    if os.path.exists(config_path):
-        with open(config_path) as f:
-            return json.load(f)
-    return {}
+# Disk checks of the plugin directory: below the free space or inode floor, non-essential
+# writes (timeline thumbnails, dead-letter logs) pause; slow probe writes only warn
+DISK_CHECK_INTERVAL = 60
+DEFAULT_STORAGE_MIN_FREE_BYTES = 1024 * 1024 * 1024
+STORAGE_MIN_FREE_INODES = 0.05
+STORAGE_SLOW_WRITE_MS = 500
 
+# Snapshot modes: cloud thumbnail, frame grab from the live P2P stream, or off
+SNAPSHOT_MODES = ("api", "stream", "disabled")
+SNAPSHOT_MODE_ALIASES = {"rtsp": "stream", "none": "disabled", "off": "disabled"}
+DEFAULT_SNAPSHOT_MODE = "api"
+DEFAULT_SNAPSHOT_INTERVAL = 60
+# Snapshot fetches per minute, per camera and across all cameras (0 = unlimited); cached
+# snapshots don't count. Buckets hold 10 seconds' worth of fetches as burst
+DEFAULT_SNAPSHOT_RATE_LIMIT = 12
+DEFAULT_SNAPSHOT_GLOBAL_RATE_LIMIT = 120
 
-def save_config(config: Dict[str, Any]):
-    """Save plugin configuration to file"""
-    config_path = os.path.join(PLUGIN_DIR, "config.json")
-    with open(config_path, "w") as f:
-        json.dump(config, f, indent=2)
+# Stream backends: the wyze-bridge TUTK stack in this script, or a native TUTK
+# binary (native_backend_path) following the same `stream <mac>` contract
+STREAM_BACKENDS = ("bridge", "native")
+DEFAULT_STREAM_BACKEND = "bridge"
+PYTHON_REMEDIATION = ("Install Python 3.8+ and re-run the plugin setup to create its venv, set native_backend_path "
+                      "to a native stream binary, or set cloud_only_fallback to run without live streams")
 
+# Config fields holding credentials; each can also be given as <field>_file
+SECRET_FIELDS = ("email", "password", "key_id", "api_key", "totp_key", "rest_api_token", "webhook_secret",
+                 "s3_secret_key", "access_token", "refresh_token")
+SECRET_ENV_VARS = {
+    "email": "WYZE_EMAIL",
+    "password": "WYZE_PASSWORD",
+    "key_id": "WYZE_KEY_ID",
+    "api_key": "WYZE_API_KEY",
+    "totp_key": "WYZE_TOTP_KEY",
+    "access_token": "WYZE_ACCESS_TOKEN",
+    "refresh_token": "WYZE_REFRESH_TOKEN",
+}
 
-def load_auth_cache() -> Optional[Dict[str, Any]]:
-    """Load cached authentication data"""
-    cache_path = os.path.join(PLUGIN_DIR, "auth_cache.json")
-    if os.path.exists(cache_path):
+# Tokens refreshed from an injected access_token/refresh_token pair
+TOKEN_FILE = os.path.join(PLUGIN_DIR, "tokens.json")
+
+# Camera settings that don't change what a running stream does
+DRIFT_IGNORED_SETTINGS = ("tags", "metadata", "snapshot_mode", "snapshot_interval", "ingestion_cooldown",
+                          "event_merge_window", "event_rate_limit", "correlate", "local_detection", "subscription",
+                          "event_polling", "event_poll_interval")
+
+# Limits on user-defined per-camera tags and metadata
+MAX_CAMERA_TAGS = 32
+MAX_CAMERA_METADATA = 32
+MAX_TAG_LENGTH = 64
+MAX_METADATA_VALUE_LENGTH = 256
+
+# Per-camera stream quality (auto picks 2K/1080p by model)
+STREAM_QUALITIES = ("auto", "hd", "sd")
+SD_BITRATE = 60
+
+# Adaptive quality: step a camera down to SD on a poor connection, retry later
+QUALITY_FALLBACK_FILE = os.path.join(PLUGIN_DIR, "quality_fallback.json")
+# Stream/snapshot URLs last handed to the NVR, so changes survive plugin restarts
+PUBLISHED_URLS_FILE = os.path.join(PLUGIN_DIR, "published_urls.json")
+# Soft-deleted cameras awaiting restore_camera or purge
+REMOVED_CAMERAS_FILE = os.path.join(PLUGIN_DIR, "removed_cameras.json")
+# State handed from a plugin process to its upgraded replacement by prepare_upgrade;
+# ignored when older than UPGRADE_CHECKPOINT_TTL seconds
+UPGRADE_CHECKPOINT_FILE = os.path.join(PLUGIN_DIR, "upgrade_checkpoint.json")
+UPGRADE_CHECKPOINT_TTL = 300
+# Running per-camera totals of the current day and the finished daily summaries
+DAILY_STATS_FILE = os.path.join(PLUGIN_DIR, "daily_stats.json")
+DAILY_SUMMARY_DAYS = 30
+# NVR arm state per camera, with the camera-side detection settings to restore on arm
+ARM_STATES_FILE = os.path.join(PLUGIN_DIR, "arm_states.json")
+# Ports the plugin listens on, for the NVR core and other plugins to avoid and open in
+# firewalls. Media ports (RTSP, WebRTC, HLS) belong to go2rtc; the plugin serves none
+PORTS_FILE = os.path.join(PLUGIN_DIR, "ports.json")
+MEDIA_PORT_KINDS = ("rtsp", "webrtc", "hls")
+# Layout version of config.json and the state files above. A release that renames fields
+# or changes defaults bumps it and appends a step to CONFIG_MIGRATIONS
+CONFIG_VERSION = 1
+STATE_VERSION_FILE = os.path.join(PLUGIN_DIR, "state_version.json")
+MIGRATION_BACKUP_DIR = os.path.join(PLUGIN_DIR, "backups")
+MIGRATED_STATE_FILES = ("config.json", "camera_settings.json", "quality_fallback.json", "published_urls.json",
+                        "removed_cameras.json", "arm_states.json", "daily_stats.json")
+PUBLISHED_FIELDS = ("name", "main_stream", "sub_stream", "snapshot_url")
+DEFAULT_HEALTH_INTERVAL = 30
+ADAPTIVE_FAILURES = 3
+ADAPTIVE_WINDOW = 600
+ADAPTIVE_DROP_RATE = 0.10
+ADAPTIVE_MIN_FRAMES = 300
+DEFAULT_ADAPTIVE_RETRY = 1800
+ADAPTIVE_MAX_RETRY = 86400
+
+# Per-camera image orientation (ffmpeg filters; rotation is clockwise)
+ROTATIONS = {0: [], 90: ["transpose=1"], 180: ["transpose=1", "transpose=1"], 270: ["transpose=2"]}
+FLIPS = {"none": [], "horizontal": ["hflip"], "vertical": ["vflip"], "both": ["hflip", "vflip"]}
+# Privacy masks: filled rectangles in fractions of the camera's native (unrotated) frame
+MAX_PRIVACY_MASKS = 8
+# Watermark: NVR label plus UTC time, burned into snapshots and optionally the restream
+MAX_WATERMARK_LABEL = 80
+FFMPEG_INPUT_FORMATS = {"h264": "h264", "h265": "hevc"}
+# Camera audio codecs (wyzecam get_audio_codec) ffmpeg reads raw; others get silence.
+# Streams with audio are MPEG-TS with AAC instead of raw video
+AUDIO_INPUT_FORMATS = {"aac": "aac", "s16le": "s16le", "mulaw": "mulaw", "alaw": "alaw"}
+# Set for stream processes the plugin reads as raw video itself (snapshots, previews)
+VIDEO_ONLY_ENV = "WYZE_STREAM_VIDEO_ONLY"
+
+# Camera commands: run over a streaming camera's session, else over a plugin-held one
+CAMERA_COMMAND_TIMEOUT = 10
+CONTROL_TIMEOUT = CAMERA_COMMAND_TIMEOUT + 5
+COMMAND_SESSION_IDLE = 30
+COMMAND_SESSION_KEEPALIVE = 10
+MAX_COMMAND_SESSIONS = 4
+# Seconds close_all waits for running commands, a LAN search or a session connect before tearing down
+COMMAND_SESSION_CLOSE_WAIT = 25
+
+# Streams waiting for a slot under max_concurrent_streams
+DEFAULT_STREAM_QUEUE_TIMEOUT = 120
+STREAM_QUEUE_POLL = 1.0
+
+# TUTK session modes (SInfoStruct.mode) and the net_mode policies built on them
+SESSION_MODES = {0: "p2p", 1: "relay", 2: "lan"}
+NET_MODES = ("any", "prefer_lan", "p2p", "lan")
+NET_MODE_ALLOWED = {
+    "any": ("lan", "p2p", "relay"),
+    "prefer_lan": ("lan",),
+    "p2p": ("lan", "p2p"),
+    "lan": ("lan",),
+}
+PREFER_LAN_ATTEMPTS = 3
+
+# Stream reconnect backoff per failure class: (first delay, max delay) in seconds
+RECONNECT_POLICIES = {
+    "auth_expired": (1, 60),
+    "device_offline": (30, 600),
+    "network_unreachable": (5, 120),
+    "disconnected": (2, 60),
+    "error": (5, 300),
+}
+DEFAULT_RECONNECT_WINDOW = 1800
+DEFAULT_RECONNECT_MAX_DELAY = 600
+# Stream keepalive: after KEEPALIVE_IDLE seconds without frames (camera reconnecting) the
+# last keyframe is repeated every KEEPALIVE_INTERVAL, so consumers keep their session
+KEEPALIVE_IDLE = 2.0
+KEEPALIVE_INTERVAL = 1.0
+# A session that lasted this long resets the backoff
+RECONNECT_STABLE_SECONDS = 60
+# Stream supervision: go2rtc's stream process runs the camera session in a worker and
+# restarts it, with backoff, when it crashes or is killed (out of memory)
+STREAM_WORKER_ENV = "WYZE_STREAM_WORKER"
+SUPERVISOR_BACKOFF = (1, 60)
+# A worker that ran this long resets the backoff
+SUPERVISOR_STABLE_SECONDS = 120
+# TUTK/AV error codes behind each failure class
+TUTK_OFFLINE_CODES = (-19, -24, -64, -90)
+TUTK_NETWORK_CODES = (-1, -2, -13, -41, -42)
+TUTK_AUTH_CODES = (-20009,)
+TUTK_DISCONNECT_CODES = (-20015, -20016, -14)
+
+# low_resource profile limits for Raspberry Pi class hosts
+LOW_RESOURCE_MAX_STREAMS = 2
+LOW_RESOURCE_SNAPSHOT_INTERVAL = 300
+
+# Results larger than this are written to disk and fetched with fetch_file
+DEFAULT_MAX_INLINE_BYTES = 8 * 1024 * 1024
+DEFAULT_SPILL_TTL = 3600
+FETCH_CHUNK_SIZE = 1024 * 1024
+
+# How often opt-in telemetry is reported
+DEFAULT_TELEMETRY_INTERVAL = 86400
+
+# Hover preview clips
+PREVIEW_FORMATS = {"mp4": "video/mp4", "webp": "image/webp"}
+PREVIEW_FPS = 2
+PREVIEW_WIDTH = 480
+PREVIEW_MIN_DURATION = 3
+# get_snapshots: cameras per call and the shared capture deadline (seconds)
+MAX_SYNC_SNAPSHOT_CAMERAS = 16
+DEFAULT_SYNC_SNAPSHOT_TIMEOUT = 15
+MAX_SYNC_SNAPSHOT_TIMEOUT = 60
+PREVIEW_MAX_DURATION = 5
+DEFAULT_PREVIEW_INTERVAL = 60
+
+# Local person detection on stream keyframes (optional onnxruntime + numpy)
+DEFAULT_DETECTION_MODEL = os.path.join("models", "person.onnx")
+DETECTION_MODEL_FORMATS = ("yolov8", "yolov5")
+DEFAULT_DETECTION_INTERVAL = 2
+DEFAULT_DETECTION_THRESHOLD = 0.5
+DEFAULT_DETECTION_COOLDOWN = 30
+DETECTION_INPUT_SIZE = 640
+DETECTION_NMS_IOU = 0.45
+MAX_DETECTION_BOXES = 20
+
+DEFAULT_REST_API_BIND = "127.0.0.1:8565"
+
+# Unauthenticated /healthz and /readyz for orchestrators; health is recomputed at most this often
+DEFAULT_HEALTHZ_BIND = "127.0.0.1:8566"
+HEALTHZ_CACHE_SECONDS = 2
+
+# HTTP status for structured error reasons (anything else is a 500)
+REST_ERROR_STATUS = {
+    "method_not_found": 404,
+    "camera_not_found": 404,
+    "file_not_found": 404,
+    "invalid_params": 400,
+    "capability_not_supported": 422,
+    "firmware_upgrade_required": 422,
+    "not_initialized": 503,
+    "busy": 503,
+}
+
+# Methods that change camera or plugin state; rejected in read_only mode
+MUTATING_METHODS = ("add_camera", "remove_camera", "restore_camera", "set_camera_config", "set_osd", "take_photo",
+                    "ptz", "wake_camera", "set_arm_state", "reconcile_bridge", "migrate_stream_backend")
+
+# Authorization scopes an NVR can grant at initialize; each implies the ones after it
+SCOPES = ("admin", "control", "view")
+# Scope each method needs; methods missing here need admin
+METHOD_SCOPES = {
+    "ping": None,
+    "health": None,
+    "get_api_schema": None,
+    "capabilities": None,
+    "discover_cameras": "view",
+    "list_cameras": "view",
+    "start_discovery": "view",
+    "cancel_discovery": "view",
+    "get_camera": "view",
+    "probe_camera": "view",
+    "run_selfcheck": "view",
+    "get_connection_stats": "view",
+    "get_api_usage": "view",
+    "get_daily_summary": "view",
+    "query_events": "view",
+    "get_osd": "view",
+    "get_arm_state": "view",
+    "get_plugin_info": "view",
+    "get_ports": "view",
+    "get_subscriptions": "view",
+    "subscribe_events": "view",
+    "get_camera_config": "view",
+    "get_snapshot": "view",
+    "get_snapshots": "view",
+    "get_preview": "view",
+    "get_timeline_thumbnails": "view",
+    "fetch_file": "view",
+    "add_camera": "control",
+    "remove_camera": "control",
+    "restore_camera": "control",
+    "list_removed_cameras": "view",
+    "set_camera_config": "control",
+    "set_osd": "control",
+    "set_arm_state": "control",
+    "take_photo": "control",
+    "ptz": "control",
+    "wake_camera": "control",
+    "initialize": "admin",
+    "verify_credentials": "admin",
+    "shutdown": "admin",
+    "export_diagnostics": "admin",
+    "reconcile_bridge": "admin",
+    "migrate_stream_backend": "admin",
+    "prepare_upgrade": "admin",
+    "set_log_level": "admin",
+}
+
+# Camera capability (see CAMERA_MODELS) a method needs from its camera_id; checked
+# before dispatch for cameras of known models. Unknown models are let through.
+METHOD_CAPABILITIES: Dict[str, str] = {"ptz": "ptz"}
+
+# Methods the NVR owns; never exposed over the REST API (prepare_upgrade checkpoints live tokens
+# that the next initialize restores)
+REST_DENIED_METHODS = ("initialize", "shutdown", "prepare_upgrade")
+# Scopes REST API callers get unless rest_api_scopes says otherwise (never more than the NVR's)
+DEFAULT_REST_API_SCOPES = ["view"]
+
+# TUTK LAN search for camera IPs
+LAN_SEARCH_TIMEOUT_MS = 2000
+LAN_SEARCH_MAX_DEVICES = 64
+
+# Object storage export (S3 / MinIO)
+S3_UPLOAD_KINDS = ("snapshots", "clips", "diagnostics", "results")
+DEFAULT_S3_REGION = "us-east-1"
+S3_TIMEOUT = 30
+
+# Wyze cloud event polling (get_event_list)
+DEFAULT_EVENT_POLL_INTERVAL = 60
+# Property watcher: Wyze cloud properties (get_property_list pid -> name) diffed every
+# property_watch_interval seconds (0 = off) to catch changes made in the Wyze app.
+# watched_properties replaces the map; firmware comes from the device list
+WATCHED_PROPERTIES = {"P3": "power", "P50": "night_vision", "P1": "notifications"}
+EVENT_POLL_COUNT = 20
+EVENT_SEEN_MAX = 500
+EVENT_VALUE_TYPES = {"1": "motion", "2": "sound", "4": "smoke_alarm", "5": "co_alarm", "13": "doorbell"}
+EVENT_TAG_TYPES = {101: "person", 102: "vehicle", 103: "pet", 104: "package", 105: "face"}
+# Merging overlapping events into one incident: the most specific type names the
+# incident and supplies its thumbnail; incidents are closed after MAX_EVENT_MERGE_SECONDS
+EVENT_TYPE_RANK = ("face", "person", "vehicle", "package", "pet", "doorbell", "smoke_alarm", "co_alarm",
+                   "motion", "sound")
+MAX_EVENT_MERGE_WINDOW = 600
+MAX_EVENT_MERGE_SECONDS = 900
+# Cap on camera.events per camera per minute (0 = none); events over it are summarized
+# in one overflow event per window, listing at most MAX_OVERFLOW_EVENT_IDS of them
+EVENT_RATE_WINDOW = 60
+MAX_EVENT_RATE_LIMIT = 600
+MAX_OVERFLOW_EVENT_IDS = 100
+# Events on different cameras within incident_window seconds of each other form one
+# incident, sent once it closes when at least INCIDENT_MIN_CAMERAS cameras took part
+MAX_INCIDENT_WINDOW = 300
+MAX_INCIDENT_SECONDS = 900
+INCIDENT_MIN_CAMERAS = 2
+
+# Wyze subscription plans and the event features they unlock. The account APIs we
+# use don't report plans, so "auto" infers Cam Plus from AI-tagged events seen
+# within SUBSCRIPTION_EVIDENCE_DAYS; the subscription config/setting overrides it.
+SUBSCRIPTION_PLANS = ("auto", "cam_plus", "cam_plus_lite", "none")
+SUBSCRIPTION_FEATURES = {
+    "cam_plus": ["ai_tags", "full_length_clips", "no_event_cooldown"],
+    "cam_plus_lite": ["no_event_cooldown"],
+    "none": [],
+}
+SUBSCRIPTION_EVIDENCE_DAYS = 14
+SUBSCRIPTION_FEATURE_LIMITS = {
+    "ai_tags": "its events carry no person/vehicle/pet/package tags",
+    "no_event_cooldown": "Wyze records at most one event per 5 minutes, so event_only wakes can miss activity",
+}
+
+# Per-camera ingestion profiles; event_only streams are allowed while woken by an event
+INGESTION_PROFILES = ("continuous", "event_only", "disabled")
+WAKE_EVENT_TYPES = ("motion", "person", "vehicle", "pet", "package", "doorbell")
+DEFAULT_INGESTION_COOLDOWN = 120
+
+# Retry backoff for the background camera enumeration after initialize
+ENUMERATION_RETRY_MIN = 5
+ENUMERATION_RETRY_MAX = 300
+
+# Local event history for query_events
+DEFAULT_EVENT_RETENTION_DAYS = 30
+DEFAULT_EVENT_QUERY_LIMIT = 100
+MAX_EVENT_QUERY_LIMIT = 1000
+
+# How often the device list is re-fetched to pick up new cameras
+DEFAULT_DISCOVERY_INTERVAL = 300
+
+# Allowed (min, max) seconds for background intervals; 0 keeps its "off" meaning
+# where the setting has one
+INTERVAL_BOUNDS = {
+    "discovery_interval": (60, 86400),
+    "health_interval": (10, 3600),
+    "snapshot_interval": (5, 86400),
+    "preview_interval": (5, 3600),
+    "timeline_interval": (10, 86400),
+    "telemetry_interval": (3600, 7 * 86400),
+    "event_poll_interval": (10, 3600),
+    "property_watch_interval": (60, 86400),
+    "detection_interval": (1, 60),
+}
+DISABLEABLE_INTERVALS = ("snapshot_interval", "timeline_interval", "property_watch_interval")
+# A camera whose next event poll is this close (as a fraction of its interval) joins a
+# poll that is due anyway, so cameras on similar schedules share one API call
+EVENT_POLL_COALESCE = 0.25
+
+# Random +/- fraction applied to background schedules so plugin fleets don't sync up
+DEFAULT_REFRESH_JITTER = 0.1
+MAX_REFRESH_JITTER = 0.5
+
+# Consecutive refreshes a camera must be missing before it counts as removed
+DEFAULT_REMOVED_CAMERA_THRESHOLD = 3
+# Removed cameras keep their settings and history this long, so restore_camera can bring them back
+DEFAULT_REMOVED_CAMERA_RETENTION_DAYS = 30
+
+# Cameras enriched (LAN address, ping) at once by start_discovery
+DISCOVERY_WORKERS = 4
+
+# run_selfcheck: how long the stream and snapshot steps may take, and how far back the
+# event step looks
+SELFCHECK_TIMEOUT = 20
+SELFCHECK_EVENT_LOOKBACK = 86400
+
+
+# Log levels: a default plus optional per-component overrides, shared with stream
+# processes through LOG_LEVELS_FILE (re-read at most every LOG_LEVELS_RECHECK seconds)
+LOG_LEVELS = ("debug", "info", "warning", "error")
+LOG_COMPONENTS = ("api", "bridge", "rpc", "camera")
+LOG_LEVELS_FILE = os.path.join(RUN_DIR, "log_levels.json")
+LOG_LEVELS_RECHECK = 5
+MAX_LOG_LEVEL_DURATION = 86400
+
+_log_state: Dict[str, Any] = {"levels": {"default": "info"}}
+_log_state_checked = 0.0
+_log_state_mtime = 0.0
+
+
+def current_log_levels() -> Dict[str, Any]:
+    """The log levels in force: default and per-component, plus when a temporary change reverts"""
+    global _log_state, _log_state_checked, _log_state_mtime
+    now = time.time()
+    if now - _log_state_checked >= LOG_LEVELS_RECHECK:
+        _log_state_checked = now
         try:
-            with open(cache_path) as f:
-                cache = json.load(f)
-                # Check if cache is still valid (tokens expire, but we cache for 1 hour)
-                cached_time = cache.get("cached_at", 0)
-                if time.time() - cached_time < 3600:  # 1 hour cache
-                    return cache
-        except Exception as e:
-            log(f"Failed to load auth cache: {e}")
-    return None
+            mtime = os.path.getmtime(LOG_LEVELS_FILE)
+            if mtime != _log_state_mtime:
+                with open(LOG_LEVELS_FILE) as f:
+                    _log_state = json.load(f)
+                _log_state_mtime = mtime
+        except (OSError, ValueError):
+            pass
+    revert_at = _log_state.get("revert_at")
+    if revert_at and now >= revert_at:
+        return {"levels": dict(_log_state.get("previous") or {"default": "info"}), "revert_at": None}
+    return {"levels": dict(_log_state.get("levels") or {"default": "info"}), "revert_at": revert_at}
 
 
-def save_auth_cache(auth_info: Any, account: Any, cameras: Dict[str, Any]):
-    """Save authentication data to cache"""
-    cache_path = os.path.join(PLUGIN_DIR, "auth_cache.json")
+def save_log_levels(levels: Dict[str, str], revert_at: Optional[float] = None,
+                    previous: Optional[Dict[str, str]] = None):
+    """Apply log levels here and in every stream process"""
+    global _log_state, _log_state_checked, _log_state_mtime
+    _log_state = {"levels": levels, "revert_at": revert_at, "previous": previous}
     try:
-        # Serialize auth info and cameras
-        cache = {
-            "cached_at": time.time(),
-            "auth_info": auth_info.model_dump() if hasattr(auth_info, 'model_dump') else auth_info.__dict__,
-            "account": account.model_dump() if hasattr(account, 'model_dump') else account.__dict__,
-            "cameras": {mac: (cam.model_dump() if hasattr(cam, 'model_dump') else cam.__dict__)
-                       for mac, cam in cameras.items()}
-        }
-        with open(cache_path, "w") as f:
-            json.dump(cache, f, indent=2)
-        log("Auth cache saved")
-    except Exception as e:
-        log(f"Failed to save auth cache: {e}")
+        os.makedirs(RUN_DIR, exist_ok=True)
+        tmp_path = LOG_LEVELS_FILE + ".tmp"
+        with open(tmp_path, "w") as f:
+            json.dump(_log_state, f)
+        os.replace(tmp_path, LOG_LEVELS_FILE)
+        _log_state_mtime = os.path.getmtime(LOG_LEVELS_FILE)
+    except OSError as e:
+        log(f"Failed to save log levels: {e}")
+    _log_state_checked = time.time()
 
 
-class WyzeAuth:
-    """Manages Wyze authentication"""
+def log(msg: str, level: str = "info", component: str = ""):
+    """Log to stderr (stdout is for JSON-RPC or video data)"""
+    levels = current_log_levels()["levels"]
+    threshold = levels.get(component) or levels.get("default", "info")
+    if LOG_LEVELS.index(level) < LOG_LEVELS.index(threshold):
+        return
+    tag = f"[{component}] " if component else ""
+    severity = "" if level == "info" else f"{level.upper()}: "
+    print(f"[wyze] {tag}{severity}{msg}", file=sys.stderr, flush=True)
 
-    def __init__(self, config: Dict[str, Any]):
-        self.config = config
-        self.auth_info: Optional[wyzecam.WyzeCredential] = None
-        self.account: Optional[wyzecam.WyzeAccount] = None
-        self.cameras: Dict[str, wyzecam.WyzeCamera] = {}
 
-    def login(self, use_cache: bool = True):
-        """Login to Wyze and get camera list (with caching)"""
-        # Try to use cached auth first
-        if use_cache:
-            cache = load_auth_cache()
-            if cache:
+# Webhook event delivery
+WEBHOOK_QUEUE_SIZE = 1000
+WEBHOOK_MAX_ATTEMPTS = 5
+
+# How long shutdown waits for in-flight requests before cancelling them
+DEFAULT_SHUTDOWN_DRAIN_TIMEOUT = 10
+
+# Child processes started by this plugin process
+_children: set = set()
+
+# Notifications waiting for stdout while the NVR is not reading it; past this, the
+# oldest low-priority one is dropped. Responses are never dropped
+DEFAULT_NOTIFICATION_QUEUE_SIZE = 1000
+NOTIFICATION_QUEUE_BOUNDS = (100, 100000)
+# Notifications that may be dropped under backpressure: superseded by later ones, repeated
+# while their cause persists, or kept in the event store for query_events
+LOW_PRIORITY_NOTIFICATIONS = ("camera.event", "camera.connection_state", "camera.quality_changed",
+                              "discovery.progress", "warning")
+# How long exiting waits for queued messages to reach a stalled NVR
+STDOUT_DRAIN_TIMEOUT = 5
+
+
+class StdoutWriter:
+    """Writes JSON-RPC messages to stdout from one thread, so a stalled NVR blocks no caller
+
+    Messages go out in the order they were sent. Only notifications count
+    toward the queue limit, which is never exceeded: low-priority ones are
+    dropped first, then the oldest of any priority.
+    """
+
+    def __init__(self, limit: int = DEFAULT_NOTIFICATION_QUEUE_SIZE):
+        self.limit = limit
+        self.cond = threading.Condition()
+        self.pending: deque = deque()
+        self.notifications = 0
+        self.writing = False
+        self.dropped: Dict[str, int] = {}
+        self.dropped_high_priority = 0
+        self.thread: Optional[threading.Thread] = None
+
+    def send(self, message: Dict[str, Any]):
+        with self.cond:
+            if "id" not in message:
+                self.notifications += 1
+                if self.notifications > self.limit:
+                    self._drop_oldest()
+            self.pending.append(message)
+            if not self.thread:
+                self.thread = threading.Thread(target=self._run, daemon=True)
+                self.thread.start()
+            self.cond.notify_all()
+
+    def _drop_oldest(self):
+        """Make room by dropping the oldest low-priority notification, else the oldest notification"""
+        notifications = [i for i, queued in enumerate(self.pending) if "id" not in queued]
+        low = [i for i in notifications if self.pending[i].get("method") in LOW_PRIORITY_NOTIFICATIONS]
+        if not low and not notifications:
+            return
+        index = (low or notifications)[0]
+        method = self.pending[index].get("method")
+        del self.pending[index]
+        self.notifications -= 1
+        self.dropped[method] = self.dropped.get(method, 0) + 1
+        if not low:
+            self.dropped_high_priority += 1
+
+    def _run(self):
+        while True:
+            with self.cond:
+                while not self.pending:
+                    self.cond.wait()
+                message = self.pending.popleft()
+                if "id" not in message:
+                    self.notifications -= 1
+                self.writing = True
+            try:
+                print(json.dumps(message), flush=True)
+            except (OSError, ValueError) as e:
+                log(f"Failed to write {message.get('method') or 'response'} to stdout: {e}")
+            with self.cond:
+                self.writing = False
+                self.cond.notify_all()
+
+    def drain(self, timeout: float) -> bool:
+        """Wait for queued messages to be written; False if the NVR isn't reading"""
+        deadline = time.monotonic() + timeout
+        with self.cond:
+            while self.pending or self.writing:
+                remaining = deadline - time.monotonic()
+                if remaining <= 0:
+                    return False
+                self.cond.wait(remaining)
+        return True
+
+    def status(self) -> Dict[str, Any]:
+        with self.cond:
+            return {"queued": len(self.pending), "notifications_queued": self.notifications, "limit": self.limit,
+                    "dropped": dict(self.dropped), "dropped_total": sum(self.dropped.values()),
+                    "dropped_high_priority": self.dropped_high_priority}
+
+
+_stdout = StdoutWriter()
+
+
+def send_message(message: Dict[str, Any]):
+    """Queue a JSON-RPC message for stdout"""
+    _stdout.send(message)
+
+
+def read_request_lines(stream: Any, get_limit: Any):
+    """Yield (line, oversized) from a binary stream without buffering more than the limit
+
+    get_limit() is read per line so a new limit applies from the next request.
+    An oversized line is cut to its first limit bytes and the rest is skipped
+    up to the next newline, so the reader resynchronizes on the next request.
+    """
+    while True:
+        limit = get_limit()
+        line = stream.readline(limit + 1)
+        if not line:
+            return
+        if len(line) > limit and not line.endswith(b"\n"):
+            while True:
+                rest = stream.readline(limit)
+                if not rest or rest.endswith(b"\n"):
+                    break
+            yield line[:limit], True
+        else:
+            yield line, False
+
+
+def salvage_request_id(line: bytes) -> Any:
+    """Best-effort request id from a line that isn't valid JSON"""
+    match = _REQUEST_ID_RE.search(line)
+    if not match:
+        return None
+    try:
+        return json.loads(match.group(1))
+    except ValueError:
+        return None
+
+
+def dead_letter(line: bytes, reason: str, size: int):
+    """Record unparseable input for later inspection"""
+    entry = {
+        "at": format_time(time.time()),
+        "reason": reason,
+        "size": size,
+        "preview": line[:DEAD_LETTER_PREVIEW].decode("utf-8", "replace"),
+    }
+    try:
+        os.makedirs(DEAD_LETTER_DIR, exist_ok=True)
+        path = os.path.join(DEAD_LETTER_DIR, time.strftime("dead_letter-%Y%m%d.jsonl", time.gmtime()))
+        with open(path, "a") as f:
+            f.write(json.dumps(entry) + "\n")
+    except OSError as e:
+        log(f"Failed to write dead letter: {e}")
+
+
+class WebhookDispatcher:
+    """Delivers notifications to an NVR webhook with retries and HMAC signing"""
+
+    def __init__(self, url: str, secret: str = ""):
+        self.url = url
+        self.secret = secret.encode()
+        self.queue: "queue.Queue[Dict[str, Any]]" = queue.Queue(maxsize=WEBHOOK_QUEUE_SIZE)
+        self.thread = threading.Thread(target=self._run, daemon=True)
+        self.thread.start()
+
+    def send(self, message: Dict[str, Any]):
+        try:
+            self.queue.put_nowait(message)
+        except queue.Full:
+            log(f"Webhook queue full, dropping {message.get('method')}")
+
+    def _post(self, body: bytes):
+        timestamp = str(int(time.time()))
+        headers = {"Content-Type": "application/json", "X-Wyze-Timestamp": timestamp}
+        if self.secret:
+            signature = hmac.new(self.secret, timestamp.encode() + b"." + body, hashlib.sha256).hexdigest()
+            headers["X-Wyze-Signature"] = f"sha256={signature}"
+        req = urllib.request.Request(self.url, data=body, headers=headers, method="POST")
+        with plugin_resolution():
+            urllib.request.urlopen(req, timeout=10).close()
+
+    def _run(self):
+        while True:
+            message = self.queue.get()
+            body = json.dumps(message).encode()
+            for attempt in range(WEBHOOK_MAX_ATTEMPTS):
                 try:
-                    log("Using cached authentication")
-                    self.auth_info = wyzecam.WyzeCredential.model_validate(cache["auth_info"])
-                    self.account = wyzecam.WyzeAccount.model_validate(cache["account"])
-                    for mac, cam_data in cache["cameras"].items():
-                        self.cameras[mac] = wyzecam.WyzeCamera.model_validate(cam_data)
-                    log(f"Loaded {len(self.cameras)} cameras from cache")
-                    return self
+                    self._post(body)
+                    break
                 except Exception as e:
-                    log(f"Cache load failed, will re-authenticate: {e}")
+                    log(f"Webhook delivery of {message.get('method')} failed (attempt {attempt + 1}): {e}")
+                    time.sleep(2 ** attempt)
 
-        email = self.config.get("email")
-        password = self.config.get("password")
-        key_id = self.config.get("key_id")
-        api_key = self.config.get("api_key")
 
-        if not email or not password:
-            raise ValueError("email and password are required")
+class EventStore:
+    """Local history of every notification, queryable after NVR downtime"""
 
-        log(f"Logging into Wyze as {email}...")
-        self.auth_info = wyzecam.login(
-            email, password,
-            api_key=api_key,
-            key_id=key_id
+    def __init__(self, path: str):
+        self.lock = threading.Lock()
+        self.db = sqlite3.connect(path, check_same_thread=False)
+        self.db.execute(
+            "CREATE TABLE IF NOT EXISTS events ("
+            "id INTEGER PRIMARY KEY AUTOINCREMENT, ts REAL NOT NULL, "
+            "camera_id TEXT, type TEXT NOT NULL, data TEXT NOT NULL)"
         )
-        self.account = wyzecam.get_user_info(self.auth_info)
-        log(f"Logged in successfully as {self.account.nickname}")
+        self.db.execute("CREATE INDEX IF NOT EXISTS events_ts ON events (ts)")
+        self.db.commit()
+
+    def add(self, event_type: str, params: Dict[str, Any]):
+        camera_id = params.get("camera_id") or params.get("id")
+        with self.lock:
+            self.db.execute("INSERT INTO events (ts, camera_id, type, data) VALUES (?, ?, ?, ?)",
+                            (time.time(), camera_id, event_type, json.dumps(params)))
+            self.db.commit()
+
+    def query(self, camera_id: Optional[str], start: float, end: float, types: List[str],
+              limit: int, after_id: int) -> List[Dict[str, Any]]:
+        """Events in [start, end] oldest first, resuming after the given id"""
+        sql = "SELECT id, ts, camera_id, type, data FROM events WHERE ts >= ? AND ts <= ? AND id > ?"
+        args: List[Any] = [start, end, after_id]
+        if camera_id:
+            sql += " AND camera_id = ?"
+            args.append(camera_id)
+        if types:
+            sql += f" AND type IN ({','.join('?' * len(types))})"
+            args.extend(types)
+        sql += " ORDER BY id LIMIT ?"
+        args.append(limit)
+        with self.lock:
+            rows = self.db.execute(sql, args).fetchall()
+        return [{"id": row[0], "timestamp": format_time(row[1]), "camera_id": row[2],
+                 "type": row[3], "data": json.loads(row[4])} for row in rows]
+
+    def count_types(self, start: float, end: float, event_type: str) -> Dict[str, Dict[str, int]]:
+        """camera_id -> params["type"] -> count for events in [start, end)"""
+        with self.lock:
+            rows = self.db.execute("SELECT camera_id, data FROM events WHERE ts >= ? AND ts < ? AND type = ?",
+                                   (start, end, event_type)).fetchall()
+        counts: Dict[str, Dict[str, int]] = {}
+        for camera_id, data in rows:
+            kind = json.loads(data).get("type") or "unknown"
+            per_camera = counts.setdefault(camera_id, {})
+            per_camera[kind] = per_camera.get(kind, 0) + 1
+        return counts
+
+    def last_tagged(self, since: float) -> Dict[str, float]:
+        """camera_id -> time of its latest camera.event with AI tags since the given time"""
+        with self.lock:
+            rows = self.db.execute("SELECT camera_id, MAX(ts) FROM events WHERE ts >= ? AND type = 'camera.event' "
+                                   "AND data LIKE '%\"tags\": [\"%' GROUP BY camera_id", (since,)).fetchall()
+        return {camera_id: ts for camera_id, ts in rows if camera_id}
+
+    def prune(self, max_age_days: int):
+        with self.lock:
+            cur = self.db.execute("DELETE FROM events WHERE ts < ?", (time.time() - max_age_days * 86400,))
+            self.db.commit()
+        if cur.rowcount:
+            log(f"Pruned {cur.rowcount} events older than {max_age_days} days")
+
+
+def event_rank(event_type: str) -> int:
+    """Lower is more specific; unknown types rank after the known ones"""
+    return EVENT_TYPE_RANK.index(event_type) if event_type in EVENT_TYPE_RANK else len(EVENT_TYPE_RANK)
+
+
+class EventMerger:
+    """Folds overlapping Wyze events per camera into one incident
+
+    An incident stays open while new events arrive within the merge window of
+    the previous one; flush() hands back incidents whose window has passed the
+    polled time range, each as a single camera.event with start/end, the ids it
+    absorbed and the thumbnail of its most specific event.
+    """
+
+    def __init__(self):
+        self.open: Dict[str, Dict[str, Any]] = {}
+
+    def add(self, event: Dict[str, Any], ts: float, window: int) -> List[Dict[str, Any]]:
+        """Merge an event; returns incidents it closed (and the event itself when not merged)"""
+        mac = event["camera_id"]
+        closed = []
+        incident = self.open.get(mac)
+        if incident and (ts > incident["deadline"] or ts - incident["start"] >= MAX_EVENT_MERGE_SECONDS):
+            closed.append(self._close(self.open.pop(mac)))
+            incident = None
+        if window <= 0:
+            return closed + [event]
+        if not incident:
+            self.open[mac] = {"event": dict(event), "start": ts, "end": ts, "deadline": ts + window,
+                              "event_ids": [event["event_id"]], "tags": list(event["tags"]),
+                              "thumbnail_rank": event_rank(event["type"])}
+            return closed
+
+        incident["end"] = max(incident["end"], ts)
+        incident["deadline"] = max(incident["deadline"], ts + window)
+        incident["event_ids"].append(event["event_id"])
+        incident["tags"] += [tag for tag in event["tags"] if tag not in incident["tags"]]
+        best = incident["event"]
+        if event_rank(event["type"]) < event_rank(best["type"]):
+            best["type"] = event["type"]
+        if event["thumbnail_url"] and (not best["thumbnail_url"] or
+                                       event_rank(event["type"]) < incident["thumbnail_rank"]):
+            best["thumbnail_url"] = event["thumbnail_url"]
+            incident["thumbnail_rank"] = event_rank(event["type"])
+        return closed
+
+    def flush(self, until: Optional[float] = None) -> List[Dict[str, Any]]:
+        """Close incidents whose window ended before until (all of them when None)"""
+        done = [mac for mac, incident in self.open.items() if until is None or incident["deadline"] <= until]
+        return [self._close(self.open.pop(mac)) for mac in done]
+
+    @staticmethod
+    def _close(incident: Dict[str, Any]) -> Dict[str, Any]:
+        event = dict(incident["event"])
+        event.update({
+            "tags": incident["tags"],
+            "timestamp": format_time(incident["start"]),
+            "start": format_time(incident["start"]),
+            "end": format_time(incident["end"]),
+            "event_ids": incident["event_ids"],
+            "merged": len(incident["event_ids"]),
+        })
+        return event
+
+
+class TokenBucket:
+    """`rate` actions per minute, with bursts of up to `burst`"""
+
+    def __init__(self, rate: float, burst: int):
+        self.rate = rate / 60.0
+        self.burst = max(1, burst)
+        self.tokens = float(self.burst)
+        self.updated = time.monotonic()
+
+    def wait(self) -> float:
+        """Seconds until a token is available (0 when one is)"""
+        now = time.monotonic()
+        self.tokens = min(self.burst, self.tokens + (now - self.updated) * self.rate)
+        self.updated = now
+        return 0.0 if self.tokens >= 1 else (1 - self.tokens) / self.rate
+
+
+class SnapshotLimiter:
+    """Per-camera and global token buckets for snapshot fetches"""
+
+    def __init__(self, camera_rate: int = DEFAULT_SNAPSHOT_RATE_LIMIT,
+                 global_rate: int = DEFAULT_SNAPSHOT_GLOBAL_RATE_LIMIT):
+        self.lock = threading.Lock()
+        self.camera_rate = camera_rate
+        self.global_rate = global_rate
+        self.cameras: Dict[str, TokenBucket] = {}
+        self.all = TokenBucket(global_rate, global_rate // 6) if global_rate > 0 else None
+        self.throttled = 0
+        self.coalesced = 0
+
+    def acquire(self, mac: str) -> float:
+        """Take a fetch from both buckets; returns 0, or the seconds to wait when either is empty"""
+        with self.lock:
+            buckets = [self.all] if self.all else []
+            if self.camera_rate > 0:
+                if mac not in self.cameras:
+                    self.cameras[mac] = TokenBucket(self.camera_rate, self.camera_rate // 6)
+                buckets.append(self.cameras[mac])
+            wait = max([bucket.wait() for bucket in buckets] or [0.0])
+            if wait:
+                self.throttled += 1
+                return wait
+            for bucket in buckets:
+                bucket.tokens -= 1
+            return 0.0
+
+    def status(self) -> Dict[str, Any]:
+        return {"camera_rate_limit": self.camera_rate, "global_rate_limit": self.global_rate,
+                "throttled": self.throttled, "coalesced": self.coalesced}
+
+
+class EventRateLimiter:
+    """Caps camera.events per camera per EVENT_RATE_WINDOW
+
+    Each camera's window starts with its first event. Events beyond the limit
+    are held back as counts; when the window ends flush() returns one overflow
+    event summarizing them.
+    """
+
+    def __init__(self):
+        self.windows: Dict[str, Dict[str, Any]] = {}
+
+    def allow(self, event: Dict[str, Any], limit: int, now: float) -> bool:
+        mac = event["camera_id"]
+        window = self.windows.get(mac)
+        if not window or now >= window["start"] + EVENT_RATE_WINDOW:
+            window = self.windows[mac] = {"start": now, "sent": 0, "suppressed": 0, "types": {}, "event_ids": [],
+                                          "first": 0.0, "last": 0.0}
+        if limit <= 0 or window["sent"] < limit:
+            window["sent"] += 1
+            return True
+        window["suppressed"] += 1
+        window["types"][event["type"]] = window["types"].get(event["type"], 0) + 1
+        window["event_ids"] = (window["event_ids"] + event.get("event_ids", [event["event_id"]]))[:MAX_OVERFLOW_EVENT_IDS]
+        window["first"] = window["first"] or now
+        window["last"] = now
+        return False
+
+    def flush(self, until: Optional[float] = None) -> List[Dict[str, Any]]:
+        """Overflow events for windows that ended before until (all of them when None)"""
+        overflow = []
+        for mac, window in list(self.windows.items()):
+            if until is not None and until < window["start"] + EVENT_RATE_WINDOW:
+                continue
+            del self.windows[mac]
+            if window["suppressed"]:
+                overflow.append({
+                    "camera_id": mac,
+                    "event_id": f"overflow-{uuid.uuid4().hex[:12]}",
+                    "type": "overflow",
+                    "tags": sorted(window["types"]),
+                    "timestamp": format_time(window["first"]),
+                    "start": format_time(window["first"]),
+                    "end": format_time(window["last"]),
+                    "thumbnail_url": "",
+                    "suppressed": window["suppressed"],
+                    "suppressed_types": window["types"],
+                    "event_ids": window["event_ids"],
+                })
+        return overflow
+
+
+class IncidentCorrelator:
+    """Groups camera.events from several cameras that happen close together into incidents
+
+    One incident is open at a time. It grows while events arrive within the
+    window of the previous one (by event time) and closes after that, or
+    after MAX_INCIDENT_SECONDS.
+    """
+
+    def __init__(self):
+        self.open: Optional[Dict[str, Any]] = None
+
+    def add(self, event: Dict[str, Any], ts: float, window: int) -> List[Dict[str, Any]]:
+        """Record an event; returns the incident it closed, if that one spanned enough cameras"""
+        closed = []
+        incident = self.open
+        if incident and (ts > incident["end"] + window or ts - incident["start"] >= MAX_INCIDENT_SECONDS):
+            closed = self.flush()
+            incident = None
+        if window <= 0:
+            return closed
+        if not incident:
+            incident = self.open = {"incident_id": f"inc-{uuid.uuid4().hex[:12]}", "start": ts, "end": ts,
+                                    "window": window, "events": []}
+        incident["start"] = min(incident["start"], ts)
+        incident["end"] = max(incident["end"], ts)
+        incident["events"].append({"camera_id": event["camera_id"], "event_id": event["event_id"],
+                                   "type": event["type"], "timestamp": format_time(ts)})
+        return closed
+
+    def flush(self, until: Optional[float] = None) -> List[Dict[str, Any]]:
+        """Close the open incident if its window ended before until (always when None)"""
+        incident = self.open
+        if not incident or (until is not None and until < incident["end"] + incident["window"]):
+            return []
+        self.open = None
+        cameras = sorted({e["camera_id"] for e in incident["events"]})
+        if len(cameras) < INCIDENT_MIN_CAMERAS:
+            return []
+        return [{
+            "incident_id": incident["incident_id"],
+            "start": format_time(incident["start"]),
+            "end": format_time(incident["end"]),
+            "cameras": cameras,
+            "types": sorted({e["type"] for e in incident["events"]}, key=event_rank),
+            "events": sorted(incident["events"], key=lambda e: e["timestamp"]),
+        }]
+
+
+# Webhook delivery, configured at initialize
+_webhook: Optional[WebhookDispatcher] = None
+_stdout_events = True
+_event_store: Optional[EventStore] = None
+
+# Every notification the plugin sends; subscribe_events narrows what goes to stdout
+# (None = everything). ready is always sent, since the NVR waits for it
+NOTIFICATION_TYPES = (
+    "ready", "camera.discovered", "camera.added", "camera.updated", "camera.removed", "camera.removed_from_account",
+    "camera.event", "camera.ingestion_started", "camera.ingestion_stopped", "camera.connection_state",
+    "camera.online", "camera.offline", "camera.stream_crashed", "camera.quality_changed", "camera.property_changed",
+    "incident",
+    "discovery.progress", "discovery.completed", "auth.refreshed", "auth.failed", "warning", "summary.daily",
+    "storage.state_changed",
+)
+_stdout_subscriptions: Optional[List[str]] = None
+
+
+def stdout_subscribed(method: str) -> bool:
+    """Whether the NVR opted in to this notification on stdout"""
+    subscriptions = _stdout_subscriptions
+    return subscriptions is None or method == "ready" or any(fnmatch.fnmatchcase(method, p) for p in subscriptions)
+
+
+def configure_event_delivery(config: Dict[str, Any]):
+    """Select stdout and/or webhook delivery for notifications"""
+    global _webhook, _stdout_events
+    mode = config.get("event_delivery", "stdout")
+    url = config.get("webhook_url")
+    if mode in ("webhook", "both") and url:
+        if not _webhook or _webhook.url != url:
+            _webhook = WebhookDispatcher(url, config.get("webhook_secret", ""))
+    else:
+        _webhook = None
+    _stdout_events = mode != "webhook" or _webhook is None
+
+
+def notify(method: str, params: Dict[str, Any]):
+    """Send a JSON-RPC notification (no id) to the NVR"""
+    log(f"Notification: {method}")
+    message = {"jsonrpc": "2.0", "method": method, "params": params}
+    if _stdout_events and stdout_subscribed(method):
+        send_message(message)
+    if _webhook:
+        _webhook.send(message)
+    if _event_store:
+        try:
+            _event_store.add(method, params)
+        except sqlite3.Error as e:
+            log(f"Failed to record event {method}: {e}")
+
+
+# Sent warning notifications: (code, camera_id) -> (message, sent at). A warning whose
+# cause persists is repeated at most this often
+WARNING_REPEAT_INTERVAL = 3600
+_warnings_sent: Dict[tuple, tuple] = {}
+_warnings_lock = threading.Lock()
+
+
+def warn(code: str, message: str, camera_id: Optional[str] = None, component: str = "") -> str:
+    """Log a non-fatal problem and surface it to the NVR as a warning notification
+
+    Returns the message, so callers can list it as well (setup summary).
+    """
+    now = time.time()
+    with _warnings_lock:
+        last = _warnings_sent.get((code, camera_id))
+        if last and last[0] == message and now - last[1] < WARNING_REPEAT_INTERVAL:
+            return message
+        _warnings_sent[(code, camera_id)] = (message, now)
+    log(message, "warning", component)
+    params = {"code": code, "message": message, "timestamp": format_time(now)}
+    if camera_id:
+        params["camera_id"] = camera_id
+    notify("warning", params)
+    return message
+
+
+def format_exception(e: Exception) -> str:
+    return "\n".join(traceback.format_exception(e))
+
+
+# reason -> (JSON-RPC code, default message, remediation key)
+# Messages are English defaults; the NVR can localize by reason/remediation.
+ERRORS: Dict[str, tuple] = {
+    "parse_error": (-32700, "Parse error", ""),
+    "payload_too_large": (-32600, "Request exceeds the maximum line size", "reduce_request_size"),
+    "invalid_request": (-32600, "Invalid request", ""),
+    "method_not_found": (-32601, "Method not found", "update_plugin"),
+    "invalid_params": (-32602, "Invalid parameters", "check_params"),
+    "internal_error": (-32603, "Internal error", "check_logs"),
+    "not_initialized": (-32603, "Plugin is not initialized", "initialize_plugin"),
+    "auth_failed": (-32603, "Wyze login failed", "check_credentials"),
+    "tutk_library_unavailable": (-32603, "TUTK library is not available", "install_tutk_library"),
+    "camera_not_found": (-32603, "Camera not found", "check_camera_id"),
+    "snapshots_disabled": (-32603, "Snapshots are disabled for this camera", "enable_snapshots"),
+    "snapshot_unavailable": (-32603, "No snapshot is available for this camera", "change_snapshot_mode"),
+    "cloud_only_mode": (-32603, "Not available in cloud-only mode", "disable_cloud_only"),
+    "file_not_found": (-32603, "File not found or expired", "refetch_result"),
+    "read_only": (-32603, "The plugin is in read-only mode", "disable_read_only"),
+    "forbidden": (-32603, "Not permitted by the granted scopes", "grant_scope"),
+    "camera_command_failed": (-32603, "The camera did not accept the command", "check_camera_online"),
+    "capability_not_supported": (-32603, "The camera does not support this feature", "check_capabilities"),
+    "firmware_upgrade_required": (-32603, "The camera firmware is too old for this feature", "update_camera_firmware"),
+    "stream_backend_unavailable": (-32603, "The stream backend is not available", "check_stream_backend"),
+    "python_unavailable": (-32603, "No Python interpreter for stream processes", "install_python"),
+    "snapshot_rate_limited": (-32603, "Too many snapshot requests", "retry_later"),
+    "shutting_down": (-32603, "The plugin is shutting down", "retry_later"),
+    "request_cancelled": (-32603, "Request cancelled by plugin shutdown", "retry_later"),
+    "wyze_api_unavailable": (-32603, "The Wyze cloud API is unreachable", "retry_later"),
+    "wyze_rate_limited": (-32603, "The Wyze cloud API rate limit was hit", "retry_later"),
+    "wyze_api_error": (-32603, "The Wyze cloud API returned an error", "check_logs"),
+    "busy": (-32603, "Every camera command session is busy", "retry_later"),
+}
+
+
+class PluginError(Exception):
+    """An error with a stable machine-readable reason for the NVR"""
+
+    def __init__(self, reason: str, message: Optional[str] = None, camera_id: Optional[str] = None,
+                 data: Optional[Dict[str, Any]] = None):
+        self.reason = reason if reason in ERRORS else "internal_error"
+        code, default_message, remediation = ERRORS[self.reason]
+        self.code = code
+        self.message = message or default_message
+        self.camera_id = camera_id
+        self.remediation = remediation
+        self.data = data or {}
+        super().__init__(self.message)
+
+    def to_error(self) -> Dict[str, Any]:
+        """Build the JSON-RPC error object"""
+        data: Dict[str, Any] = {"reason": self.reason, **self.data}
+        if self.camera_id:
+            data["camera_id"] = self.camera_id
+        if self.remediation:
+            data["remediation"] = self.remediation
+        return {"code": self.code, "message": self.message, "data": data}
+
+
+# Zone that RFC3339 times without an offset are read in (set by configure_timezone);
+# emitted times are always UTC
+_timezone: datetime.tzinfo = datetime.timezone.utc
+_timezone_name = "UTC"
+_UTC_OFFSET_RE = re.compile(r"^([+-])(\d{2}):(\d{2})$")
+
+
+def configure_timezone(config: Dict[str, Any]):
+    """Apply the timezone setting: an IANA name (Europe/Berlin) or a fixed offset (+02:00)"""
+    global _timezone, _timezone_name
+    name = str(config.get("timezone") or "UTC")
+    offset = _UTC_OFFSET_RE.match(name)
+    if name in ("UTC", "Z"):
+        zone: datetime.tzinfo = datetime.timezone.utc
+    elif offset:
+        sign = -1 if offset.group(1) == "-" else 1
+        zone = datetime.timezone(sign * datetime.timedelta(hours=int(offset.group(2)), minutes=int(offset.group(3))))
+    elif ZoneInfo is None:
+        raise PluginError("invalid_params", "Named timezones need Python 3.9+; use a fixed offset like +02:00")
+    else:
+        try:
+            zone = ZoneInfo(name)
+        except (ZoneInfoNotFoundError, ValueError):
+            raise PluginError("invalid_params", f"Unknown timezone: {name}")
+    _timezone, _timezone_name = zone, name
+
+
+def timezone_status() -> Dict[str, Any]:
+    offset = datetime.datetime.now(_timezone).strftime("%z")
+    return {"name": _timezone_name, "utc_offset": f"{offset[:3]}:{offset[3:]}"}
+
+
+def format_time(ts: float) -> str:
+    """Format a unix timestamp as RFC3339 UTC"""
+    return time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(ts))
+
+
+def format_time_ms(ts: float) -> str:
+    """Format a unix timestamp as RFC3339 UTC with milliseconds"""
+    return time.strftime("%Y-%m-%dT%H:%M:%S", time.gmtime(ts)) + f".{int(ts * 1000) % 1000:03d}Z"
+
+
+def parse_time(value: Any) -> float:
+    """Parse a unix timestamp or RFC3339 string into a unix timestamp
+
+    Strings without an offset are taken to be in the configured timezone.
+    """
+    if isinstance(value, (int, float)):
+        return float(value)
+    text = str(value).strip()
+    if text.endswith("Z"):
+        text = text[:-1] + "+00:00"
+    parsed = datetime.datetime.fromisoformat(text)
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=_timezone)
+    return parsed.timestamp()
+
+
+def get_plugin_version() -> str:
+    """Read the plugin version from manifest.yaml"""
+    try:
+        with open(os.path.join(PLUGIN_DIR, "manifest.yaml")) as f:
+            for line in f:
+                if line.startswith("version:"):
+                    return line.split(":", 1)[1].strip()
+    except OSError:
+        pass
+    return "unknown"
+
+
+def bridge_source(config: Dict[str, Any]) -> tuple:
+    """Get the (owner/repo, ref) of docker-wyze-bridge to pull assets from"""
+    repo = str(config.get("bridge_repo") or DEFAULT_BRIDGE_REPO)
+    for prefix in ("https://github.com/", "http://github.com/", "git@github.com:"):
+        if repo.startswith(prefix):
+            repo = repo[len(prefix):]
+    if repo.endswith(".git"):
+        repo = repo[:-4]
+    ref = str(config.get("bridge_ref") or DEFAULT_BRIDGE_REF)
+    return repo.strip("/"), ref
+
+
+def get_wyzecam_source() -> str:
+    """Read where the installed wyzecam library came from (written by setup.sh)"""
+    for path in (os.path.join(PLUGIN_DIR, "wyzecam", ".source"),
+                 os.path.join(WYZE_BRIDGE_DIR, "wyzecam", ".source")):
+        try:
+            with open(path) as f:
+                return f.read().strip()
+        except OSError:
+            continue
+    return "unknown"
+
+
+def git_commit(path: str) -> str:
+    """Commit checked out in a git work tree at path (read without running git), or "" """
+    git_dir = os.path.join(path, ".git")
+    try:
+        if os.path.isfile(git_dir):
+            # Submodules and worktrees point at their git directory
+            with open(git_dir) as f:
+                git_dir = os.path.join(path, f.read().split(":", 1)[1].strip())
+        with open(os.path.join(git_dir, "HEAD")) as f:
+            head = f.read().strip()
+        if not head.startswith("ref: "):
+            return head
+        ref = head[5:]
+        if os.path.exists(os.path.join(git_dir, ref)):
+            with open(os.path.join(git_dir, ref)) as f:
+                return f.read().strip()
+        with open(os.path.join(git_dir, "packed-refs")) as f:
+            for line in f:
+                if line.rstrip().endswith(" " + ref):
+                    return line.split()[0]
+    except (OSError, IndexError):
+        pass
+    return ""
+
+
+_ffmpeg_version: Optional[str] = None
+
+
+def ffmpeg_version() -> str:
+    """Version of the ffmpeg on PATH ("" when missing), looked up once"""
+    global _ffmpeg_version
+    if _ffmpeg_version is None:
+        try:
+            out = subprocess.run(["ffmpeg", "-hide_banner", "-version"], capture_output=True, text=True,
+                                 timeout=10).stdout
+            words = out.split()
+            _ffmpeg_version = words[2] if len(words) > 2 and words[:2] == ["ffmpeg", "version"] else ""
+        except (OSError, subprocess.SubprocessError):
+            _ffmpeg_version = ""
+    return _ffmpeg_version
+
+
+def file_sha256(path: str) -> str:
+    """Hex SHA-256 of a file"""
+    digest = hashlib.sha256()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(65536), b""):
+            digest.update(chunk)
+    return digest.hexdigest()
+
+
+_system_getaddrinfo = socket.getaddrinfo
+_dns: Dict[str, Any] = {"hosts": {}, "servers": [], "cache": {}, "lookups": 0, "failures": 0}
+_dns_lock = threading.Lock()
+# Per-thread nesting depth of plugin_resolution blocks
+_dns_scope = threading.local()
+
+
+def configure_dns(config: Dict[str, Any]):
+    """Set the host_overrides and dns_servers used inside plugin_resolution blocks
+
+    Those wrap the plugin's own HTTP calls: the Wyze cloud API, thumbnail and
+    library downloads, webhooks, telemetry and object storage. Lookups by
+    anything else in the process (and TUTK, which resolves its P2P servers
+    itself) keep the system resolver.
+    """
+    hosts: Dict[str, List[str]] = {}
+    for name, value in (config.get("host_overrides") or {}).items():
+        ips = value if isinstance(value, list) else [value]
+        try:
+            hosts[str(name).lower().rstrip(".")] = [str(ipaddress.ip_address(ip)) for ip in ips]
+        except ValueError:
+            raise PluginError("invalid_params", f"host_overrides.{name} must be an IP address or a list of them")
+        if not ips:
+            raise PluginError("invalid_params", f"host_overrides.{name} is empty")
+
+    servers = []
+    for server in config.get("dns_servers") or []:
+        host, _, port = str(server).partition(":") if str(server).count(":") == 1 else (str(server), "", "")
+        try:
+            servers.append((str(ipaddress.IPv4Address(host)), int(port or 53)))
+        except ValueError:
+            raise PluginError("invalid_params", f"dns_servers entries must be IPv4 addresses (optionally :port): {server}")
+    if len(servers) > MAX_DNS_SERVERS:
+        raise PluginError("invalid_params", f"At most {MAX_DNS_SERVERS} dns_servers")
+
+    with _dns_lock:
+        _dns.update(hosts=hosts, servers=servers, cache={})
+    if (hosts or servers) and socket.getaddrinfo is not _resolving_getaddrinfo:
+        # Installed once; it passes lookups outside plugin_resolution straight to the system
+        socket.getaddrinfo = _resolving_getaddrinfo
+    if hosts or servers:
+        log(f"Name resolution: {len(hosts)} host overrides, resolvers {[s[0] for s in servers] or 'system'}")
+
+
+@contextmanager
+def plugin_resolution():
+    """Resolve names looked up on this thread in this block with host_overrides and dns_servers"""
+    depth = getattr(_dns_scope, "depth", 0)
+    _dns_scope.depth = depth + 1
+    try:
+        yield
+    finally:
+        _dns_scope.depth = depth
+
+
+def _override_ips(name: str) -> Optional[List[str]]:
+    """Static IPs for a host; "*.example.com" entries match any subdomain"""
+    hosts = _dns["hosts"]
+    if name in hosts:
+        return hosts[name]
+    parts = name.split(".")
+    for i in range(1, len(parts) - 1):
+        wildcard = "*." + ".".join(parts[i:])
+        if wildcard in hosts:
+            return hosts[wildcard]
+    return None
+
+
+def _resolving_getaddrinfo(host, port, family=0, type=0, proto=0, flags=0):
+    if not getattr(_dns_scope, "depth", 0):
+        return _system_getaddrinfo(host, port, family, type, proto, flags)
+    if isinstance(host, bytes):
+        host = host.decode("ascii", "ignore")
+    if not isinstance(host, str) or not host:
+        return _system_getaddrinfo(host, port, family, type, proto, flags)
+    name = host.lower().rstrip(".")
+    try:
+        ipaddress.ip_address(name)
+        return _system_getaddrinfo(host, port, family, type, proto, flags)
+    except ValueError:
+        pass
+    ips = _override_ips(name)
+    if ips is None and _dns["servers"] and name != "localhost":
+        ips = dns_lookup(name)
+    if not ips:
+        return _system_getaddrinfo(host, port, family, type, proto, flags)
+    results = []
+    for ip in ips:
+        try:
+            results += _system_getaddrinfo(ip, port, family, type, proto, flags | socket.AI_NUMERICHOST)
+        except socket.gaierror:
+            continue
+    return results or _system_getaddrinfo(host, port, family, type, proto, flags)
+
+
+def dns_lookup(name: str) -> Optional[List[str]]:
+    """A records for name from the configured dns_servers (cached by TTL); None falls back to the system"""
+    with _dns_lock:
+        cached = _dns["cache"].get(name)
+        if cached and cached[0] > time.time():
+            # A cached failure (None) keeps going to the system resolver without re-querying
+            return cached[1]
+        _dns["lookups"] += 1
+    query_id = random.randint(0, 0xFFFF)
+    question = b"".join(bytes([len(label)]) + label.encode("idna") for label in name.split(".")) + b"\0"
+    packet = query_id.to_bytes(2, "big") + b"\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00" + question + b"\x00\x01\x00\x01"
+    for server in _dns["servers"]:
+        try:
+            with socket.socket(socket.AF_INET, socket.SOCK_DGRAM) as sock:
+                sock.settimeout(DNS_TIMEOUT)
+                sock.sendto(packet, server)
+                reply = sock.recv(4096)
+            if reply[:2] != packet[:2]:
+                continue
+            ips, ttl = _parse_dns_reply(reply)
+        except (OSError, ValueError, IndexError) as e:
+            log(f"DNS query for {name} to {server[0]} failed: {e}", "debug", "api")
+            continue
+        if ips:
+            with _dns_lock:
+                _dns["cache"][name] = (time.time() + min(ttl, DNS_MAX_TTL), ips)
+            return ips
+    with _dns_lock:
+        _dns["failures"] += 1
+        _dns["cache"][name] = (time.time() + DNS_FAILURE_TTL, None)
+    warn("dns_fallback", f"No answer for {name} from dns_servers, using the system resolver", component="api")
+    return None
+
+
+def _parse_dns_reply(reply: bytes) -> tuple:
+    """(IPv4 addresses, lowest TTL) from the answer section of a DNS response"""
+    if reply[2] & 0x02:
+        # There is no TCP retry; a truncated answer falls through to the next server or the system resolver
+        raise ValueError("truncated reply")
+    if reply[3] & 0x0F:
+        raise ValueError(f"rcode {reply[3] & 0x0F}")
+    questions, answers = int.from_bytes(reply[4:6], "big"), int.from_bytes(reply[6:8], "big")
+
+    def skip_name(pos: int) -> int:
+        while reply[pos]:
+            if reply[pos] & 0xC0 == 0xC0:
+                return pos + 2
+            pos += reply[pos] + 1
+        return pos + 1
+
+    pos = 12
+    for _ in range(questions):
+        pos = skip_name(pos) + 4
+    ips, ttl = [], DNS_MAX_TTL
+    for _ in range(answers):
+        pos = skip_name(pos)
+        rtype, rttl, length = int.from_bytes(reply[pos:pos + 2], "big"), int.from_bytes(reply[pos + 4:pos + 8], "big"), \
+            int.from_bytes(reply[pos + 8:pos + 10], "big")
+        pos += 10
+        if rtype == 1 and length == 4:
+            ips.append(".".join(str(b) for b in reply[pos:pos + 4]))
+            ttl = min(ttl, rttl)
+        pos += length
+    return ips, ttl
+
+
+def dns_status() -> Dict[str, Any]:
+    return {
+        "host_overrides": sorted(_dns["hosts"]),
+        "dns_servers": [f"{host}:{port}" for host, port in _dns["servers"]],
+        "lookups": _dns["lookups"],
+        "failures": _dns["failures"],
+    }
+
+
+def get_tutk_library(config: Dict[str, Any]) -> Optional[str]:
+    """Get or download the TUTK library for the current platform
+
+    A user-supplied library path (tutk_library config) takes precedence over
+    the downloaded Linux builds.
+    """
+    override = config.get("tutk_library")
+    if override:
+        if os.path.exists(override):
+            return override
+        log(f"Configured TUTK library not found: {override}")
+        return None
+
+    lib_dir = os.path.join(PLUGIN_DIR, "lib")
+    os.makedirs(lib_dir, exist_ok=True)
+
+    # The published libraries are Linux ELF builds and will not load on macOS,
+    # regardless of Rosetta or an x86_64 Python
+    if sys.platform == "darwin":
+        log("No TUTK library is published for macOS. Set tutk_library to a macOS build, "
+            "or run the plugin inside a Linux container/VM (e.g. Docker Desktop)")
+        return None
+
+    # docker-wyze-bridge only publishes Linux builds; Windows hosts must supply a DLL
+    if IS_WINDOWS:
+        lib_path = os.path.join(lib_dir, WINDOWS_TUTK_LIB)
+        if os.path.exists(lib_path):
+            return lib_path
+        log(f"No TUTK library for Windows; place a Windows build of the TUTK library at {lib_path}")
+        return None
+
+    machine = platform.machine().lower()
+    if machine in ("x86_64", "amd64"):
+        suffix = "amd64"
+    elif machine in ("aarch64", "arm64"):
+        suffix = "arm64"
+    else:
+        log(f"Unsupported architecture: {machine}")
+        return None
+
+    lib_path = os.path.join(lib_dir, f"lib.{suffix}")
+    if os.path.exists(lib_path):
+        return lib_path
+
+    # Download from docker-wyze-bridge (lib files are in app/lib/ subdirectory),
+    # or from a mirror when one is configured
+    repo, ref = bridge_source(config)
+    url = f"https://github.com/{repo}/raw/{ref}/app/lib/lib.{suffix}"
+    if config.get("tutk_library_url"):
+        url = str(config["tutk_library_url"]).replace("{arch}", suffix)
+    log(f"Downloading TUTK library from {url}...")
+
+    expected = config.get("tutk_library_sha256")
+    if isinstance(expected, dict):
+        expected = expected.get(suffix)
+
+    try:
+        tmp_path = lib_path + ".tmp"
+        with plugin_resolution():
+            urllib.request.urlretrieve(url, tmp_path)
+        if expected:
+            actual = file_sha256(tmp_path)
+            if actual.lower() != str(expected).lower():
+                os.remove(tmp_path)
+                log(f"TUTK library checksum mismatch: expected {expected}, got {actual}")
+                return None
+        os.replace(tmp_path, lib_path)
+        os.chmod(lib_path, 0o755)
+        log(f"TUTK library downloaded: {lib_path}")
+        return lib_path
+    except Exception as e:
+        log(f"Failed to download TUTK library: {e}")
+        return None
+
+
+def load_config() -> Dict[str, Any]:
+    """Load plugin configuration from file"""
+    config_path = os.path.join(PLUGIN_DIR, "config.json")
+    if os.path.exists(config_path):
+        with open(config_path) as f:
+            return json.load(f)
+    return {}
+
+
+def normalize_intervals(config: Dict[str, Any]) -> Dict[str, Any]:
+    """Clamp background intervals and jitter into their allowed ranges"""
+    config = dict(config)
+    for key, (low, high) in INTERVAL_BOUNDS.items():
+        if key not in config:
+            continue
+        try:
+            value = int(config[key])
+        except (TypeError, ValueError):
+            raise PluginError("invalid_params", f"{key} must be an integer")
+        if value <= 0 and key in DISABLEABLE_INTERVALS:
+            config[key] = 0
+            continue
+        clamped = max(low, min(value, high))
+        if clamped != value:
+            warn("interval_clamped", f"{key}={value} out of range, using {clamped} (allowed {low}-{high})")
+        config[key] = clamped
+
+    if "refresh_jitter" in config:
+        try:
+            jitter = float(config["refresh_jitter"])
+        except (TypeError, ValueError):
+            raise PluginError("invalid_params", "refresh_jitter must be a number")
+        config["refresh_jitter"] = max(0.0, min(jitter, MAX_REFRESH_JITTER))
+    return config
+
+
+def jittered(interval: float, config: Dict[str, Any]) -> float:
+    """Spread an interval by the configured random jitter fraction"""
+    jitter = float(config.get("refresh_jitter", DEFAULT_REFRESH_JITTER))
+    return interval * (1 + random.uniform(-jitter, jitter))
+
+
+def config_hash(config: Dict[str, Any], settings: Optional[Dict[str, Any]] = None) -> str:
+    """Fingerprint of the configuration a stream process runs with"""
+    settings = {k: v for k, v in (settings or {}).items() if k not in DRIFT_IGNORED_SETTINGS}
+    config = {k: v for k, v in config.items() if k != "config_version"}
+    payload = json.dumps({"config": config, "settings": settings}, sort_keys=True, default=str)
+    return hashlib.sha256(payload.encode()).hexdigest()[:16]
+
+
+def save_config(config: Dict[str, Any]):
+    """Save plugin configuration to file (owner-only, it holds credentials)"""
+    config_path = os.path.join(PLUGIN_DIR, "config.json")
+    fd = os.open(config_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w") as f:
+        json.dump(config, f, indent=2)
+
+
+def read_secret_reference(ref: str) -> str:
+    """Read a secret from a file path or an inherited file descriptor ("fd:N")"""
+    if ref.startswith("fd:"):
+        with os.fdopen(int(ref[3:]), "r", closefd=True) as f:
+            return f.read().strip()
+    with open(ref) as f:
+        return f.read().strip()
+
+
+def resolve_secrets(config: Dict[str, Any]) -> Dict[str, Any]:
+    """Fill credentials from <field>_file references or environment variables
+
+    Inline values take precedence over environment variables; a <field>_file
+    reference takes precedence over both.
+    """
+    resolved = dict(config)
+    for field in SECRET_FIELDS:
+        ref = resolved.pop(f"{field}_file", None)
+        if ref:
+            try:
+                resolved[field] = read_secret_reference(str(ref))
+            except (OSError, ValueError) as e:
+                raise PluginError("invalid_params", f"Cannot read {field}_file: {e}")
+        elif not resolved.get(field) and os.environ.get(SECRET_ENV_VARS.get(field, "")):
+            resolved[field] = os.environ[SECRET_ENV_VARS[field]]
+    return resolved
+
+
+def scrub_config(config: Dict[str, Any]) -> Dict[str, Any]:
+    """Copy of config safe to echo back or log"""
+    return {key: ("********" if key in SECRET_FIELDS and value else value)
+            for key, value in config.items()}
+
+
+class CameraFilter:
+    """Which account cameras the plugin sets up
+
+    `cameras` entries include their MACs; camera_filter adds include and
+    exclude rules. A rule matches when each of its fields (mac, model, name,
+    group, tag) matches, case-insensitively and with * ? [] globs. With no
+    include rule and no `cameras` entry every camera is included except the
+    excluded ones. Exclude rules win.
+    """
+
+    FIELDS = ("mac", "model", "name", "group", "tag")
+
+    def __init__(self, config: Dict[str, Any]):
+        self.macs = {entry["mac"] for entry in config.get("cameras") or []
+                     if isinstance(entry, dict) and entry.get("mac")}
+        rules = config.get("camera_filter") or {}
+        if not isinstance(rules, dict) or set(rules) - {"include", "exclude"}:
+            raise PluginError("invalid_params", "camera_filter must be an object with include and/or exclude lists")
+        for key in ("include", "exclude"):
+            if not isinstance(rules.get(key) or [], list):
+                raise PluginError("invalid_params", f"camera_filter.{key} must be a list of rules")
+            for rule in rules.get(key) or []:
+                if (not isinstance(rule, dict) or not rule or set(rule) - set(self.FIELDS)
+                        or not all(isinstance(v, str) and v for v in rule.values())):
+                    raise PluginError("invalid_params", f"camera_filter.{key} rules must be objects of "
+                                      f"{', '.join(self.FIELDS)} patterns")
+        self.include: List[Dict[str, str]] = list(rules.get("include") or [])
+        self.exclude: List[Dict[str, str]] = list(rules.get("exclude") or [])
+
+    @property
+    def restricted(self) -> bool:
+        return bool(self.macs or self.include)
+
+    @property
+    def needs_groups(self) -> bool:
+        return any("group" in rule for rule in self.include + self.exclude)
+
+    def _matches(self, rule: Dict[str, str], values: Dict[str, List[str]]) -> bool:
+        return all(any(fnmatch.fnmatchcase(v.lower(), pattern.lower()) for v in values[field])
+                   for field, pattern in rule.items())
+
+    def reason(self, camera: Any, groups: List[str], tags: List[str]) -> Optional[str]:
+        """None when the camera is included, otherwise why it is left out"""
+        values = {"mac": [camera.mac], "model": [camera.product_model or ""], "name": [camera.nickname or ""],
+                  "group": list(groups), "tag": [str(t) for t in tags]}
+        if any(self._matches(rule, values) for rule in self.exclude):
+            return "excluded_by_filter"
+        if not self.restricted or camera.mac in self.macs or any(self._matches(r, values) for r in self.include):
+            return None
+        return "not_in_camera_list"
+
+
+def parse_firmware(version: Any) -> Optional[tuple]:
+    """"4.36.10.4060" -> (4, 36, 10, 4060), stopping at a non-numeric part ("4.36.x");
+    None when there is no leading number"""
+    parts = []
+    for part in str(version or "").strip().split("."):
+        if not part.isdigit():
+            break
+        parts.append(int(part))
+    return tuple(parts) or None
+
+
+class FirmwareCapabilities:
+    """Features a camera's firmware is too old for, cached per model and firmware version
+
+    Rules come from FIRMWARE_REQUIREMENTS plus the firmware_requirements config.
+    Cameras whose firmware version is unknown or unparsable are let through.
+    """
+
+    def __init__(self, config: Dict[str, Any]):
+        self.rules: Dict[str, Dict[str, str]] = {f: dict(models) for f, models in FIRMWARE_REQUIREMENTS.items()}
+        configured = config.get("firmware_requirements") or {}
+        if not isinstance(configured, dict) or not all(
+                isinstance(models, dict) and all(parse_firmware(v) for v in models.values())
+                for models in configured.values()):
+            raise PluginError("invalid_params", "firmware_requirements must map features to "
+                              "{model: minimum firmware version}")
+        for feature, models in configured.items():
+            self.rules.setdefault(feature, {}).update(models)
+        self.cache: Dict[tuple, Dict[str, str]] = {}
+        self.lock = threading.Lock()
+
+    def missing(self, model: str, firmware: str) -> Dict[str, str]:
+        """feature -> minimum firmware, for the features this firmware is too old for"""
+        key = (model, firmware)
+        with self.lock:
+            if key not in self.cache:
+                version = parse_firmware(firmware)
+                self.cache[key] = {} if version is None else {
+                    feature: models[model] for feature, models in self.rules.items()
+                    if model in models and version < parse_firmware(models[model])}
+            return dict(self.cache[key])
+
+
+class CameraSettingsStore:
+    """Per-camera setting overrides persisted in camera_settings.json"""
+
+    def __init__(self):
+        self.path = os.path.join(PLUGIN_DIR, "camera_settings.json")
+        self.lock = threading.Lock()
+        self.settings: Dict[str, Dict[str, Any]] = {}
+        if os.path.exists(self.path):
+            try:
+                with open(self.path) as f:
+                    self.settings = json.load(f)
+            except (OSError, ValueError) as e:
+                log(f"Failed to load camera settings: {e}")
+
+    def _save(self):
+        tmp_path = self.path + ".tmp"
+        with open(tmp_path, "w") as f:
+            json.dump(self.settings, f, indent=2)
+        os.replace(tmp_path, self.path)
+
+    def get(self, mac: str) -> Dict[str, Any]:
+        """Get the stored overrides for a camera"""
+        return dict(self.settings.get(mac, {}))
+
+    def update(self, mac: str, settings: Dict[str, Any], replace: bool = False) -> Dict[str, Any]:
+        """Merge (or replace) a camera's overrides; None values remove a key"""
+        validate_camera_settings(settings)
+        with self.lock:
+            current = {} if replace else dict(self.settings.get(mac, {}))
+            for key, value in settings.items():
+                if value is None:
+                    current.pop(key, None)
+                else:
+                    current[key] = value
+            if current:
+                self.settings[mac] = current
+            else:
+                self.settings.pop(mac, None)
+            self._save()
+            return dict(current)
+
+    def effective(self, config: Dict[str, Any], mac: str) -> Dict[str, Any]:
+        """Merge the cameras config list entry with stored overrides"""
+        settings: Dict[str, Any] = {}
+        for entry in config.get("cameras") or []:
+            if isinstance(entry, dict) and entry.get("mac") == mac:
+                settings.update(entry)
+        settings.update(self.settings.get(mac, {}))
+        return settings
+
+
+def validate_camera_settings(settings: Dict[str, Any]):
+    """Reject malformed values for the per-camera settings we act on"""
+    if not isinstance(settings, dict):
+        raise PluginError("invalid_params", "settings must be an object")
+
+    mode = settings.get("snapshot_mode")
+    if mode is not None:
+        mode = SNAPSHOT_MODE_ALIASES.get(str(mode).lower(), str(mode).lower())
+        if mode not in SNAPSHOT_MODES:
+            raise PluginError("invalid_params", f"Invalid snapshot_mode: {settings['snapshot_mode']}")
+
+    interval = settings.get("snapshot_interval")
+    if interval is not None and (not isinstance(interval, int) or isinstance(interval, bool) or interval < 0):
+        raise PluginError("invalid_params", "snapshot_interval must be a non-negative integer")
+
+    quality = settings.get("quality")
+    if quality is not None and quality not in STREAM_QUALITIES:
+        raise PluginError("invalid_params", f"quality must be one of {', '.join(STREAM_QUALITIES)}")
+
+    net_mode = settings.get("net_mode")
+    if net_mode is not None and net_mode not in NET_MODES:
+        raise PluginError("invalid_params", f"net_mode must be one of {', '.join(NET_MODES)}")
+
+    ingestion = settings.get("ingestion")
+    if ingestion is not None and ingestion not in INGESTION_PROFILES:
+        raise PluginError("invalid_params", f"ingestion must be one of {', '.join(INGESTION_PROFILES)}")
+
+    plan = settings.get("subscription")
+    if plan is not None and plan not in SUBSCRIPTION_PLANS:
+        raise PluginError("invalid_params", f"subscription must be one of {', '.join(SUBSCRIPTION_PLANS)}")
+
+    backend = settings.get("stream_backend")
+    if backend is not None and backend not in STREAM_BACKENDS:
+        raise PluginError("invalid_params", f"stream_backend must be one of {', '.join(STREAM_BACKENDS)}")
+
+    correlate = settings.get("correlate")
+    if correlate is not None and not isinstance(correlate, bool):
+        raise PluginError("invalid_params", "correlate must be a boolean")
+
+    keepalive = settings.get("keepalive")
+    if keepalive is not None and not isinstance(keepalive, bool):
+        raise PluginError("invalid_params", "keepalive must be a boolean")
+
+    audio = settings.get("audio")
+    if audio is not None and not isinstance(audio, bool):
+        raise PluginError("invalid_params", "audio must be a boolean")
+
+    polling = settings.get("event_polling")
+    if polling is not None and not isinstance(polling, bool):
+        raise PluginError("invalid_params", "event_polling must be a boolean")
+
+    low, high = INTERVAL_BOUNDS["event_poll_interval"]
+    poll_interval = settings.get("event_poll_interval")
+    if poll_interval is not None and (not isinstance(poll_interval, int) or isinstance(poll_interval, bool)
+                                      or not low <= poll_interval <= high):
+        raise PluginError("invalid_params", f"event_poll_interval must be {low}-{high} seconds")
+
+    rate = settings.get("event_rate_limit")
+    if rate is not None and (not isinstance(rate, int) or isinstance(rate, bool) or not 0 <= rate <= MAX_EVENT_RATE_LIMIT):
+        raise PluginError("invalid_params", f"event_rate_limit must be 0-{MAX_EVENT_RATE_LIMIT} events per minute")
+
+    merge = settings.get("event_merge_window")
+    if merge is not None:
+        windows = merge if isinstance(merge, dict) else {"default": merge}
+        for event_type, window in windows.items():
+            if not isinstance(window, int) or isinstance(window, bool) or not 0 <= window <= MAX_EVENT_MERGE_WINDOW:
+                raise PluginError("invalid_params", f"event_merge_window must be 0-{MAX_EVENT_MERGE_WINDOW} seconds "
+                                                    "or an object of event type to seconds")
+
+    masks = settings.get("privacy_masks")
+    if masks is not None:
+        if not isinstance(masks, list) or len(masks) > MAX_PRIVACY_MASKS:
+            raise PluginError("invalid_params", f"privacy_masks must be a list of at most {MAX_PRIVACY_MASKS} rectangles")
+        for mask in masks:
+            values = [mask.get(k) for k in ("x", "y", "w", "h")] if isinstance(mask, dict) else [None]
+            if not all(isinstance(v, (int, float)) and not isinstance(v, bool) for v in values) or \
+                    not (0 <= values[0] < 1 and 0 <= values[1] < 1 and 0 < values[2] <= 1 and 0 < values[3] <= 1) or \
+                    values[0] + values[2] > 1 or values[1] + values[3] > 1:
+                raise PluginError("invalid_params", "privacy_masks entries need x, y, w, h as fractions of the frame (0-1)")
+
+    mark = settings.get("watermark")
+    if mark is not None:
+        if not isinstance(mark, dict) or not isinstance(mark.get("label", ""), str) or \
+                len(mark.get("label", "")) > MAX_WATERMARK_LABEL:
+            raise PluginError("invalid_params", f"watermark must be an object with a label of at most "
+                                                f"{MAX_WATERMARK_LABEL} characters")
+        for key in ("snapshots", "stream"):
+            if not isinstance(mark.get(key, False), bool):
+                raise PluginError("invalid_params", f"watermark.{key} must be a boolean")
+
+    rotate = settings.get("rotate")
+    if rotate is not None and rotate not in ROTATIONS:
+        raise PluginError("invalid_params", "rotate must be one of 0, 90, 180, 270")
+
+    flip = settings.get("flip")
+    if flip is not None and flip not in FLIPS:
+        raise PluginError("invalid_params", f"flip must be one of {', '.join(FLIPS)}")
+
+    priority = settings.get("priority")
+    if priority is not None and (not isinstance(priority, int) or isinstance(priority, bool)):
+        raise PluginError("invalid_params", "priority must be an integer")
+
+    for key in ("adaptive_quality", "local_detection"):
+        if settings.get(key) is not None and not isinstance(settings[key], bool):
+            raise PluginError("invalid_params", f"{key} must be a boolean")
+
+    tags = settings.get("tags")
+    if tags is not None:
+        if not isinstance(tags, list) or len(tags) > MAX_CAMERA_TAGS:
+            raise PluginError("invalid_params", f"tags must be a list of at most {MAX_CAMERA_TAGS} strings")
+        for tag in tags:
+            if not isinstance(tag, str) or not tag.strip() or len(tag) > MAX_TAG_LENGTH:
+                raise PluginError("invalid_params", f"tags must be non-empty strings of at most {MAX_TAG_LENGTH} characters")
+
+    metadata = settings.get("metadata")
+    if metadata is not None:
+        if not isinstance(metadata, dict) or len(metadata) > MAX_CAMERA_METADATA:
+            raise PluginError("invalid_params", f"metadata must be an object with at most {MAX_CAMERA_METADATA} keys")
+        for key, value in metadata.items():
+            if len(key) > MAX_TAG_LENGTH:
+                raise PluginError("invalid_params", f"metadata keys must be at most {MAX_TAG_LENGTH} characters")
+            if not isinstance(value, (str, int, float, bool)) or (isinstance(value, str) and len(value) > MAX_METADATA_VALUE_LENGTH):
+                raise PluginError("invalid_params",
+                                  f"metadata.{key} must be a string (at most {MAX_METADATA_VALUE_LENGTH} characters), number or boolean")
+
+
+def load_quality_fallbacks() -> Dict[str, Dict[str, Any]]:
+    """Cameras currently stepped down to SD by adaptive quality"""
+    try:
+        with open(QUALITY_FALLBACK_FILE) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def save_quality_fallbacks(fallbacks: Dict[str, Dict[str, Any]]):
+    tmp_path = QUALITY_FALLBACK_FILE + ".tmp"
+    with open(tmp_path, "w") as f:
+        json.dump(fallbacks, f, indent=2)
+    os.replace(tmp_path, QUALITY_FALLBACK_FILE)
+
+
+def load_published_urls() -> Dict[str, Dict[str, Any]]:
+    """Per-camera endpoints from the last camera.added/camera.updated"""
+    try:
+        with open(PUBLISHED_URLS_FILE) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def save_published_urls(published: Dict[str, Dict[str, Any]]):
+    tmp_path = PUBLISHED_URLS_FILE + ".tmp"
+    with open(tmp_path, "w") as f:
+        json.dump(published, f, indent=2)
+    os.replace(tmp_path, PUBLISHED_URLS_FILE)
+
+
+def credentials_fingerprint(config: Dict[str, Any]) -> str:
+    """Identifies the Wyze login a config uses, without storing the credentials"""
+    payload = json.dumps([config.get(k) for k in ("email", "key_id", "api_key", "access_token")])
+    return hashlib.sha256(payload.encode()).hexdigest()[:16]
+
+
+def save_upgrade_checkpoint(checkpoint: Dict[str, Any]):
+    """Write the checkpoint owner-only, it holds access tokens"""
+    tmp_path = UPGRADE_CHECKPOINT_FILE + ".tmp"
+    fd = os.open(tmp_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w") as f:
+        json.dump(checkpoint, f, indent=2, default=str)
+    os.replace(tmp_path, UPGRADE_CHECKPOINT_FILE)
+
+
+def take_upgrade_checkpoint() -> Optional[Dict[str, Any]]:
+    """Read and remove the upgrade checkpoint; it is used by one startup only"""
+    try:
+        with open(UPGRADE_CHECKPOINT_FILE) as f:
+            checkpoint = json.load(f)
+    except (OSError, ValueError):
+        return None
+    finally:
+        try:
+            os.remove(UPGRADE_CHECKPOINT_FILE)
+        except OSError:
+            pass
+    if time.time() - checkpoint.get("created_at", 0) > UPGRADE_CHECKPOINT_TTL:
+        log("Ignoring stale upgrade checkpoint")
+        return None
+    return checkpoint
+
+
+def _migrate_v1(config: Optional[Dict[str, Any]], files: Dict[str, Any]):
+    """Version 1 is the first versioned layout; unversioned files already match it"""
+
+
+# (version, description, step). A step rewrites the config (None when it is already past
+# that version) and the loaded state files (file name -> data) in place
+CONFIG_MIGRATIONS: List[Tuple[int, str, Callable[[Optional[Dict[str, Any]], Dict[str, Any]], None]]] = [
+    (1, "Start versioning config and state files", _migrate_v1),
+]
+
+
+def load_state_version() -> Optional[int]:
+    try:
+        with open(STATE_VERSION_FILE) as f:
+            return int(json.load(f)["config_version"])
+    except (OSError, ValueError, KeyError, TypeError):
+        return None
+
+
+def migrate_state(config: Dict[str, Any]) -> Tuple[Dict[str, Any], Dict[str, Any]]:
+    """Bring the config and persisted state files up to CONFIG_VERSION
+
+    State files are at the version recorded in state_version.json (0 when they
+    predate it); the config is at its config_version, or the state files' version
+    when the host doesn't set one. The originals are copied to backups/ before
+    anything is rewritten, and a failing step leaves every file as it was.
+    """
+    paths = {name: os.path.join(PLUGIN_DIR, name) for name in MIGRATED_STATE_FILES}
+    present = [name for name, path in paths.items() if os.path.exists(path)]
+    stored = load_state_version()
+    if stored is None:
+        stored = 0 if present else CONFIG_VERSION
+    try:
+        config_version = int(config.get("config_version", stored))
+    except (TypeError, ValueError):
+        raise PluginError("invalid_params", "config_version must be an integer")
+
+    report: Dict[str, Any] = {"from_version": min(stored, config_version), "to_version": CONFIG_VERSION,
+                              "applied": []}
+    if max(stored, config_version) > CONFIG_VERSION:
+        report["to_version"] = max(stored, config_version)
+        report["error"] = (f"Config version {report['to_version']} is newer than this plugin supports "
+                           f"({CONFIG_VERSION}); files left unchanged")
+        warn("config_migration_failed", report["error"])
+        return config, report
+    if report["from_version"] == CONFIG_VERSION:
+        return dict(config, config_version=CONFIG_VERSION), report
+
+    files: Dict[str, Any] = {}
+    if stored < CONFIG_VERSION:
+        for name in present:
+            if name == "config.json":
+                continue
+            try:
+                with open(paths[name]) as f:
+                    files[name] = json.load(f)
+            except (OSError, ValueError) as e:
+                log(f"Not migrating unreadable {name}: {e}", "warning")
+
+    migrated = json.loads(json.dumps(config))
+    version = report["from_version"]
+    try:
+        for version, description, step in CONFIG_MIGRATIONS:
+            if version <= report["from_version"]:
+                continue
+            step(migrated if config_version < version else None, files if stored < version else {})
+            report["applied"].append(f"v{version}: {description}")
+        if stored < CONFIG_VERSION and present:
+            backup = os.path.join(MIGRATION_BACKUP_DIR,
+                                  f"v{stored}-{format_time(time.time()).replace(':', '')}")
+            os.makedirs(backup, mode=0o700, exist_ok=True)
+            for name in present:
+                # copy2 keeps config.json owner-only
+                shutil.copy2(paths[name], backup)
+            report["backup"] = backup
+            for name, data in files.items():
+                tmp_path = paths[name] + ".tmp"
+                with open(tmp_path, "w") as f:
+                    json.dump(data, f, indent=2)
+                os.replace(tmp_path, paths[name])
+        tmp_path = STATE_VERSION_FILE + ".tmp"
+        with open(tmp_path, "w") as f:
+            json.dump({"config_version": CONFIG_VERSION, "migrated_at": format_time(time.time())}, f)
+        os.replace(tmp_path, STATE_VERSION_FILE)
+    except Exception as e:
+        report["error"] = f"Migration to version {version} failed, running unmigrated: {e}"
+        warn("config_migration_failed", report["error"])
+        return config, report
+
+    migrated["config_version"] = CONFIG_VERSION
+    log(f"Migrated config and state from version {report['from_version']} to {CONFIG_VERSION}"
+        + (f", originals in {report['backup']}" if report.get("backup") else ""))
+    return migrated, report
+
+
+def load_arm_states() -> Dict[str, Dict[str, Any]]:
+    try:
+        with open(ARM_STATES_FILE) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def save_arm_states(states: Dict[str, Dict[str, Any]]):
+    tmp_path = ARM_STATES_FILE + ".tmp"
+    with open(tmp_path, "w") as f:
+        json.dump(states, f, indent=2)
+    os.replace(tmp_path, ARM_STATES_FILE)
+
+
+def load_removed_cameras() -> Dict[str, Dict[str, Any]]:
+    try:
+        with open(REMOVED_CAMERAS_FILE) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def save_removed_cameras(removed: Dict[str, Dict[str, Any]]):
+    tmp_path = REMOVED_CAMERAS_FILE + ".tmp"
+    with open(tmp_path, "w") as f:
+        json.dump(removed, f, indent=2)
+    os.replace(tmp_path, REMOVED_CAMERAS_FILE)
+
+
+def load_auth_cache() -> Optional[Dict[str, Any]]:
+    """Load cached authentication data"""
+    cache_path = os.path.join(PLUGIN_DIR, "auth_cache.json")
+    if os.path.exists(cache_path):
+        try:
+            with open(cache_path) as f:
+                cache = json.load(f)
+                # Check if cache is still valid (tokens expire, but we cache for 1 hour)
+                cached_time = cache.get("cached_at", 0)
+                if time.time() - cached_time < AUTH_CACHE_TTL:
+                    return cache
+        except Exception as e:
+            log(f"Failed to load auth cache: {e}")
+    return None
+
+
+def save_auth_cache(auth_info: Any, account: Any, cameras: Dict[str, Any]):
+    """Save authentication data to cache"""
+    cache_path = os.path.join(PLUGIN_DIR, "auth_cache.json")
+    try:
+        # Serialize auth info and cameras
+        cache = {
+            "cached_at": time.time(),
+            "auth_info": auth_info.model_dump() if hasattr(auth_info, 'model_dump') else auth_info.__dict__,
+            "account": account.model_dump() if hasattr(account, 'model_dump') else account.__dict__,
+            "cameras": {mac: (cam.model_dump() if hasattr(cam, 'model_dump') else cam.__dict__)
+                       for mac, cam in cameras.items()}
+        }
+        # Owner-only like tokens.json: the cache holds the access and refresh tokens
+        tmp_path = cache_path + ".tmp"
+        fd = os.open(tmp_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+        with os.fdopen(fd, "w") as f:
+            json.dump(cache, f, indent=2)
+        os.replace(tmp_path, cache_path)
+        log("Auth cache saved")
+    except Exception as e:
+        log(f"Failed to save auth cache: {e}")
+
+
+def load_refreshed_tokens(config: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+    """Tokens refreshed from the configured pair, unless the config has since been given a new pair"""
+    try:
+        with open(TOKEN_FILE) as f:
+            tokens = json.load(f)
+    except (OSError, ValueError):
+        return None
+    if tokens.get("source") != token_fingerprint(config):
+        return None
+    return tokens
+
+
+def save_refreshed_tokens(config: Dict[str, Any], auth_info: Any):
+    tokens = {
+        "source": token_fingerprint(config),
+        "access_token": auth_info.access_token,
+        "refresh_token": auth_info.refresh_token,
+        "phone_id": getattr(auth_info, "phone_id", None),
+        "refreshed_at": time.time(),
+    }
+    tmp_path = TOKEN_FILE + ".tmp"
+    fd = os.open(tmp_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w") as f:
+        json.dump(tokens, f)
+    os.replace(tmp_path, TOKEN_FILE)
+
+
+def token_fingerprint(config: Dict[str, Any]) -> str:
+    pair = f"{config.get('access_token', '')}:{config.get('refresh_token', '')}"
+    return hashlib.sha256(pair.encode()).hexdigest()[:16]
+
+
+class DailyStats:
+    """Per-camera totals of the current day, kept across restarts
+
+    Counters that only grow (bytes streamed, stream failures) are stored as
+    their value when the day began, or when the camera was first seen that
+    day; streaming time is added up from samples. sample() hands back the
+    previous day when the date changes, for the plugin to summarize.
+    """
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        try:
+            with open(DAILY_STATS_FILE) as f:
+                self.state = json.load(f)
+        except (OSError, ValueError):
+            self.state = {}
+        self.state.setdefault("current", None)
+        self.state.setdefault("days", {})
+
+    def _save(self):
+        tmp_path = DAILY_STATS_FILE + ".tmp"
+        with open(tmp_path, "w") as f:
+            json.dump(self.state, f)
+        os.replace(tmp_path, DAILY_STATS_FILE)
+
+    def sample(self, day: str, start: float, counters: Dict[str, Dict[str, int]], streaming: List[str],
+               elapsed: float) -> Optional[Dict[str, Any]]:
+        """Account elapsed seconds to the current day; returns the day that just ended, if any"""
+        with self.lock:
+            ended = None
+            current = self.state["current"]
+            if not current or current["day"] != day:
+                ended = current
+                current = {"day": day, "start": start, "baseline": {}, "streaming": {}, "sampled": 0.0}
+                self.state["current"] = current
+                elapsed = 0.0
+            current["sampled"] += elapsed
+            for mac, values in counters.items():
+                current["baseline"].setdefault(mac, dict(values))
+            for mac in streaming:
+                current["streaming"][mac] = current["streaming"].get(mac, 0.0) + elapsed
+            self._save()
+            return ended
+
+    def current(self) -> Optional[Dict[str, Any]]:
+        with self.lock:
+            return json.loads(json.dumps(self.state["current"])) if self.state["current"] else None
+
+    def store(self, day: str, summary: Dict[str, Any]):
+        with self.lock:
+            self.state["days"][day] = summary
+            for old in sorted(self.state["days"])[:-DAILY_SUMMARY_DAYS]:
+                del self.state["days"][old]
+            self._save()
+
+    def get(self, day: str) -> Optional[Dict[str, Any]]:
+        with self.lock:
+            return self.state["days"].get(day)
+
+
+class StorageJanitor:
+    """Prunes plugin data files against byte and age quotas"""
+
+    def __init__(self, config: Dict[str, Any]):
+        self.max_bytes = int(config.get("storage_max_bytes", DEFAULT_STORAGE_MAX_BYTES))
+        self.max_age = float(config.get("storage_max_age_days", DEFAULT_STORAGE_MAX_AGE_DAYS)) * 86400
+        self.interval = int(config.get("janitor_interval", DEFAULT_JANITOR_INTERVAL))
+        self.last_run = 0.0
+        self.used_bytes = 0
+        self.reclaimed_bytes = 0
+        self.min_free_bytes = int(config.get("storage_min_free_bytes", DEFAULT_STORAGE_MIN_FREE_BYTES))
+        self.disk: Dict[str, Any] = {"state": "ok", "warnings": []}
+        self.last_disk_check = 0.0
+
+    def _remove(self, path: str, size: int):
+        try:
+            os.remove(path)
+            self.reclaimed_bytes += size
+        except OSError as e:
+            log(f"Janitor failed to remove {path}: {e}")
+
+    def _managed_files(self) -> List[tuple]:
+        """Return (mtime, size, path) for every file in the managed directories"""
+        files = []
+        for name in MANAGED_DIRS:
+            root_dir = os.path.join(PLUGIN_DIR, name)
+            for root, _, names in os.walk(root_dir):
+                for fname in names:
+                    path = os.path.join(root, fname)
+                    try:
+                        st = os.stat(path)
+                    except OSError:
+                        continue
+                    files.append((st.st_mtime, st.st_size, path))
+        return files
+
+    def run(self):
+        """Prune stale token files, leftover downloads, and files over quota"""
+        now = time.time()
+        self.last_run = now
+
+        # Expired auth cache only holds stale tokens
+        cache_path = os.path.join(PLUGIN_DIR, "auth_cache.json")
+        try:
+            st = os.stat(cache_path)
+            if now - st.st_mtime > AUTH_CACHE_TTL:
+                self._remove(cache_path, st.st_size)
+        except OSError:
+            pass
+
+        # Partial library downloads
+        lib_dir = os.path.join(PLUGIN_DIR, "lib")
+        if os.path.isdir(lib_dir):
+            for fname in os.listdir(lib_dir):
+                if fname.endswith(".tmp"):
+                    path = os.path.join(lib_dir, fname)
+                    try:
+                        self._remove(path, os.path.getsize(path))
+                    except OSError:
+                        pass
+
+        # Age quota, then byte quota (oldest first)
+        files = []
+        for mtime, size, path in self._managed_files():
+            if now - mtime > self.max_age:
+                self._remove(path, size)
+            else:
+                files.append((mtime, size, path))
+
+        files.sort()
+        used = sum(size for _, size, _ in files)
+        while files and used > self.max_bytes:
+            _, size, path = files.pop(0)
+            self._remove(path, size)
+            used -= size
+
+        self.used_bytes = used
+        log(f"Janitor: {used} bytes in use, {self.reclaimed_bytes} bytes reclaimed total")
+
+    def maybe_run(self):
+        """Run if the cleanup interval has elapsed"""
+        if time.time() - self.last_run >= self.interval:
+            self.run()
+
+    def check_disk(self) -> bool:
+        """Measure free space, free inodes and write latency of the plugin directory
+
+        Returns True when the state (ok, slow, low) changed.
+        """
+        self.last_disk_check = time.time()
+        disk: Dict[str, Any] = {"free_bytes": None, "free_inodes": None, "write_ms": None}
+        warnings = []
+        try:
+            usage = shutil.disk_usage(PLUGIN_DIR)
+            disk["free_bytes"] = usage.free
+            disk["total_bytes"] = usage.total
+            if usage.free < self.min_free_bytes:
+                warnings.append(f"{usage.free // (1024 * 1024)}MB free, below storage_min_free_bytes")
+        except OSError as e:
+            warnings.append(f"Free space unknown: {e}")
+        if hasattr(os, "statvfs"):
+            try:
+                st = os.statvfs(PLUGIN_DIR)
+                if st.f_files:
+                    disk["free_inodes"] = round(st.f_favail / st.f_files, 4)
+                    if disk["free_inodes"] < STORAGE_MIN_FREE_INODES:
+                        warnings.append(f"{disk['free_inodes']:.1%} of inodes free")
+            except OSError:
+                pass
+        low = bool(warnings)
+
+        probe = os.path.join(RUN_DIR, ".write_probe")
+        started = time.monotonic()
+        try:
+            os.makedirs(RUN_DIR, exist_ok=True)
+            with open(probe, "wb") as f:
+                f.write(b"\0" * 4096)
+                f.flush()
+                os.fsync(f.fileno())
+            os.remove(probe)
+            disk["write_ms"] = round((time.monotonic() - started) * 1000, 1)
+            if disk["write_ms"] > STORAGE_SLOW_WRITE_MS:
+                warnings.append(f"Slow writes: {disk['write_ms']}ms for 4KB")
+        except OSError as e:
+            low = True
+            warnings.append(f"Write failed: {e}")
+
+        disk["state"] = "low" if low else ("slow" if warnings else "ok")
+        disk["warnings"] = warnings
+        disk["checked_at"] = format_time(self.last_disk_check)
+        changed = disk["state"] != self.disk["state"]
+        self.disk = disk
+        return changed
+
+    @property
+    def low_disk(self) -> bool:
+        return self.disk["state"] == "low"
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "used_bytes": self.used_bytes,
+            "max_bytes": self.max_bytes,
+            "reclaimed_bytes": self.reclaimed_bytes,
+            "last_cleanup": format_time(self.last_run) if self.last_run else "",
+            "disk": dict(self.disk),
+        }
+
+
+class S3Uploader:
+    """PUT objects to an S3-compatible endpoint (path-style, SigV4)"""
+
+    def __init__(self, config: Dict[str, Any]):
+        self.endpoint = config["s3_endpoint"].rstrip("/")
+        self.bucket = config["s3_bucket"]
+        self.prefix = config.get("s3_prefix", "")
+        self.region = config.get("s3_region", DEFAULT_S3_REGION)
+        self.access_key = config.get("s3_access_key", "")
+        self.secret_key = config.get("s3_secret_key", "")
+        self.public_url = config.get("s3_public_url", "").rstrip("/")
+        self.kinds = config.get("s3_upload") or list(S3_UPLOAD_KINDS)
+
+    @classmethod
+    def from_config(cls, config: Dict[str, Any]) -> Optional["S3Uploader"]:
+        if not (config.get("s3_endpoint") and config.get("s3_bucket")):
+            return None
+        return cls(config)
+
+    def wants(self, kind: str) -> bool:
+        return kind in self.kinds
+
+    def _sign(self, key: bytes, msg: str) -> bytes:
+        return hmac.new(key, msg.encode(), hashlib.sha256).digest()
+
+    def put(self, key: str, data: bytes, content_type: str) -> str:
+        """Upload an object and return its URL"""
+        key = self.prefix + key
+        path = "/" + urllib.parse.quote(f"{self.bucket}/{key}", safe="/-_.~")
+        url = self.endpoint + path
+
+        now = datetime.datetime.now(datetime.timezone.utc)
+        amz_date = now.strftime("%Y%m%dT%H%M%SZ")
+        date = now.strftime("%Y%m%d")
+        payload_hash = hashlib.sha256(data).hexdigest()
+        headers = {
+            "content-type": content_type,
+            "host": urllib.parse.urlparse(self.endpoint).netloc,
+            "x-amz-content-sha256": payload_hash,
+            "x-amz-date": amz_date,
+        }
+        signed_headers = ";".join(sorted(headers))
+        canonical = "\n".join([
+            "PUT", path, "",
+            "".join(f"{k}:{headers[k]}\n" for k in sorted(headers)),
+            signed_headers, payload_hash,
+        ])
+        scope = f"{date}/{self.region}/s3/aws4_request"
+        string_to_sign = "\n".join([
+            "AWS4-HMAC-SHA256", amz_date, scope, hashlib.sha256(canonical.encode()).hexdigest(),
+        ])
+        signing_key = ("AWS4" + self.secret_key).encode()
+        for part in (date, self.region, "s3", "aws4_request"):
+            signing_key = self._sign(signing_key, part)
+        signature = hmac.new(signing_key, string_to_sign.encode(), hashlib.sha256).hexdigest()
+        headers["authorization"] = (
+            f"AWS4-HMAC-SHA256 Credential={self.access_key}/{scope}, "
+            f"SignedHeaders={signed_headers}, Signature={signature}"
+        )
+        del headers["host"]
+
+        request = urllib.request.Request(url, data=data, headers=headers, method="PUT")
+        with plugin_resolution(), urllib.request.urlopen(request, timeout=S3_TIMEOUT):
+            pass
+
+        if self.public_url:
+            return f"{self.public_url}/{urllib.parse.quote(key, safe='/-_.~')}"
+        return url
+
+    def upload_file(self, kind: str, key: str, path: str, content_type: str) -> Optional[str]:
+        """Upload a file if this kind is enabled; failures are logged, not raised"""
+        if not self.wants(kind):
+            return None
+        try:
+            with open(path, "rb") as f:
+                return self.put(key, f.read(), content_type)
+        except (OSError, urllib.error.URLError) as e:
+            log(f"S3 upload of {key} failed: {e}")
+            return None
+
+
+class Telemetry:
+    """Opt-in anonymous usage reporting
+
+    Reports only the plugin version, platform, camera model counts, and error
+    category counts. No account details, MACs, names, IPs, or media are sent.
+    Disabled unless telemetry_enabled is set and telemetry_endpoint is given.
+    """
+
+    def __init__(self, config: Dict[str, Any]):
+        self.enabled = bool(config.get("telemetry_enabled", False)) and bool(config.get("telemetry_endpoint"))
+        self.endpoint = config.get("telemetry_endpoint", "")
+        self.interval = int(config.get("telemetry_interval", DEFAULT_TELEMETRY_INTERVAL))
+        self.last_report = time.time()
+        self.errors: Dict[str, int] = {}
+        self.lock = threading.Lock()
+
+    def record_error(self, category: str):
+        if not self.enabled:
+            return
+        with self.lock:
+            self.errors[category] = self.errors.get(category, 0) + 1
+
+    def maybe_report(self, cameras: List[Any]):
+        """Send a report if the interval has elapsed"""
+        if not self.enabled or time.time() - self.last_report < self.interval:
+            return
+        self.last_report = time.time()
+
+        models: Dict[str, int] = {}
+        for camera in cameras:
+            models[camera.product_model] = models.get(camera.product_model, 0) + 1
+        with self.lock:
+            errors, self.errors = self.errors, {}
+
+        report = {
+            "plugin": "wyze",
+            "version": get_plugin_version(),
+            "protocol_version": PROTOCOL_VERSION,
+            "os": sys.platform,
+            "arch": platform.machine(),
+            "python": platform.python_version(),
+            "camera_models": models,
+            "errors": errors,
+        }
+        try:
+            req = urllib.request.Request(
+                self.endpoint,
+                data=json.dumps(report).encode(),
+                headers={"Content-Type": "application/json"},
+                method="POST",
+            )
+            with plugin_resolution():
+                urllib.request.urlopen(req, timeout=10).close()
+        except Exception as e:
+            log(f"Telemetry report failed: {e}")
+
+
+def expand_scopes(declared: Any, key: str) -> set:
+    """Scopes granted by a list of scope names; a scope grants everything below it"""
+    if not isinstance(declared, list) or any(scope not in SCOPES for scope in declared):
+        raise PluginError("invalid_params", f"{key} must be a list of {', '.join(SCOPES)}")
+    return {implied for scope in declared for implied in SCOPES[SCOPES.index(scope):]}
+
+
+class RestAPIServer:
+    """Token-authenticated local HTTP access to the plugin's RPC methods
+
+    POST /api/v1/<method> with a JSON params object (or GET for methods
+    without params). Requests must carry "Authorization: Bearer <token>".
+    """
+
+    def __init__(self, plugin: "WyzePlugin", bind: str, token: str):
+        host, _, port = bind.rpartition(":")
+        handler = self._make_handler(plugin, token)
+        self.server = http.server.ThreadingHTTPServer((host or "127.0.0.1", int(port)), handler)
+        self.thread = threading.Thread(target=self.server.serve_forever, daemon=True)
+
+    def start(self):
+        host, port = self.server.server_address[:2]
+        log(f"REST API listening on {host}:{port}")
+        self.thread.start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    @staticmethod
+    def _make_handler(plugin: "WyzePlugin", token: str):
+        class Handler(http.server.BaseHTTPRequestHandler):
+            def _reply(self, status: int, body: Dict[str, Any]):
+                data = json.dumps(body).encode()
+                self.send_response(status)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(data)))
+                self.end_headers()
+                self.wfile.write(data)
+
+            def _handle(self, params: Dict[str, Any]):
+                if not hmac.compare_digest(self.headers.get("Authorization", ""), f"Bearer {token}"):
+                    self._reply(401, {"error": "unauthorized"})
+                    return
+
+                prefix = "/api/v1/"
+                method = self.path.split("?", 1)[0]
+                if not method.startswith(prefix):
+                    self._reply(404, {"error": "not found"})
+                    return
+                method = method[len(prefix):]
+                if method in REST_DENIED_METHODS:
+                    self._reply(403, {"error": f"{method} is only available to the NVR"})
+                    return
+
+                response = plugin.handle_request({"jsonrpc": "2.0", "id": None, "method": method, "params": params},
+                                                 plugin.rest_scopes)
+                if "error" in response:
+                    status = REST_ERROR_STATUS.get(response["error"].get("data", {}).get("reason"), 500)
+                    self._reply(status, {"error": response["error"]})
+                else:
+                    self._reply(200, {"result": response.get("result")})
+
+            def do_GET(self):
+                self._handle({})
+
+            def do_POST(self):
+                try:
+                    length = int(self.headers.get("Content-Length", 0))
+                    params = json.loads(self.rfile.read(length) or b"{}")
+                except ValueError:
+                    self._reply(400, {"error": "invalid JSON body"})
+                    return
+                if not isinstance(params, dict):
+                    self._reply(400, {"error": "params must be a JSON object"})
+                    return
+                self._handle(params)
+
+            def log_message(self, format, *args):
+                pass
+
+        return Handler
+
+
+class HealthzServer:
+    """Passive HTTP health probes mirroring the health RPC
+
+    GET (or HEAD) /healthz answers 200 while the plugin is healthy or degraded
+    and 503 when unhealthy; /readyz answers 200 only once startup has finished
+    and the plugin is not unhealthy. Both return the HealthStatus as JSON.
+    """
+
+    def __init__(self, plugin: "WyzePlugin", bind: str):
+        host, _, port = bind.rpartition(":")
+        self.plugin = plugin
+        self.lock = threading.Lock()
+        self.cached: tuple = (0.0, {})
+        self.server = http.server.ThreadingHTTPServer((host or "127.0.0.1", int(port)), self._make_handler())
+        self.thread = threading.Thread(target=self.server.serve_forever, daemon=True)
+
+    def start(self):
+        host, port = self.server.server_address[:2]
+        log(f"Health endpoints listening on {host}:{port}")
+        self.thread.start()
+
+    def stop(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def health(self) -> Dict[str, Any]:
+        with self.lock:
+            checked, status = self.cached
+            if time.monotonic() - checked >= HEALTHZ_CACHE_SECONDS:
+                try:
+                    status = self.plugin.health()
+                except Exception as e:
+                    status = {"state": "unhealthy", "message": f"Health check failed: {e}",
+                              "last_check": format_time(time.time()), "details": {}}
+                self.cached = (time.monotonic(), status)
+            return status
+
+    def _make_handler(self):
+        probe = self
+
+        class Handler(http.server.BaseHTTPRequestHandler):
+            def _reply(self, status: int, body: Dict[str, Any], head: bool):
+                data = json.dumps(body).encode()
+                self.send_response(status)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(data)))
+                self.send_header("Cache-Control", "no-store")
+                self.end_headers()
+                if not head:
+                    self.wfile.write(data)
+
+            def _handle(self, head: bool):
+                path = self.path.split("?", 1)[0].rstrip("/")
+                if path not in ("/healthz", "/readyz"):
+                    self._reply(404, {"error": "not found"}, head)
+                    return
+                status = probe.health()
+                ok = status.get("state") != "unhealthy"
+                if path == "/readyz":
+                    ok = ok and probe.plugin.ready
+                self._reply(200 if ok else 503, status, head)
+
+            def do_GET(self):
+                self._handle(head=False)
+
+            def do_HEAD(self):
+                self._handle(head=True)
+
+            def log_message(self, format, *args):
+                pass
+
+        return Handler
+
+
+class WyzeApiError(PluginError):
+    """A failed Wyze cloud call, mapped to a structured reason; the original exception is in cause"""
+
+    def __init__(self, name: str, cause: Exception):
+        self.cause = cause
+        self.status = getattr(getattr(cause, "response", None), "status_code", None)
+        if token_invalid(cause):
+            reason, message = "auth_failed", "Wyze access token expired"
+        elif self.status in (400, 401, 403):
+            reason, message = "auth_failed", f"Wyze rejected {name} ({self.status})"
+        elif self.status == 429:
+            reason, message = "wyze_rate_limited", None
+        elif api_transient(cause):
+            reason, message = "wyze_api_unavailable", None
+        else:
+            reason, message = "wyze_api_error", None
+        super().__init__(reason, f"{message or ERRORS[reason][1]}: {name}: {cause}")
+
+
+class ApiMetrics:
+    """Call counts, outcomes and latency histograms per Wyze cloud call"""
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.calls: Dict[str, Dict[str, Any]] = {}
+
+    def record(self, name: str, outcome: str, seconds: float, retry: bool = False):
+        with self.lock:
+            entry = self.calls.setdefault(name, {
+                "count": 0, "errors": 0, "retries": 0, "outcomes": {},
+                "latency_total": 0.0, "buckets": [0] * (len(API_LATENCY_BUCKETS) + 1),
+            })
+            entry["count"] += 1
+            entry["retries"] += int(retry)
+            if outcome != "ok":
+                entry["errors"] += 1
+            entry["outcomes"][outcome] = entry["outcomes"].get(outcome, 0) + 1
+            entry["latency_total"] += seconds
+            index = next((i for i, le in enumerate(API_LATENCY_BUCKETS) if seconds <= le), len(API_LATENCY_BUCKETS))
+            entry["buckets"][index] += 1
+
+    def snapshot(self) -> Dict[str, Any]:
+        with self.lock:
+            result = {}
+            for name, entry in self.calls.items():
+                # Cumulative counts, Prometheus style
+                histogram, total = {}, 0
+                for le, count in zip([str(le) for le in API_LATENCY_BUCKETS] + ["+Inf"], entry["buckets"]):
+                    total += count
+                    histogram[le] = total
+                result[name] = {
+                    "count": entry["count"],
+                    "errors": entry["errors"],
+                    "retries": entry["retries"],
+                    "outcomes": dict(entry["outcomes"]),
+                    "avg_latency_ms": round(entry["latency_total"] * 1000 / entry["count"], 1),
+                    "latency_seconds": histogram,
+                }
+            return result
+
+
+class ApiUsage:
+    """Wyze cloud calls over rolling windows, per endpoint and per camera"""
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        # (time, name, cameras, throttled), oldest first
+        self.calls: deque = deque(maxlen=API_USAGE_MAX_CALLS)
+
+    def record(self, name: str, cameras: Optional[List[str]] = None, throttled: bool = False):
+        with self.lock:
+            self.calls.append((time.time(), name, tuple(cameras or ()), throttled))
+
+    def snapshot(self) -> Dict[str, Any]:
+        now = time.time()
+        horizon = max(API_USAGE_WINDOWS.values())
+        with self.lock:
+            while self.calls and self.calls[0][0] < now - horizon:
+                self.calls.popleft()
+            calls = list(self.calls)
+        result = {}
+        for window, seconds in API_USAGE_WINDOWS.items():
+            entry = {"total": 0, "throttled": 0, "endpoints": {}, "cameras": {}}
+            for ts, name, cameras, throttled in calls:
+                if ts < now - seconds:
+                    continue
+                entry["total"] += 1
+                entry["throttled"] += int(throttled)
+                entry["endpoints"][name] = entry["endpoints"].get(name, 0) + 1
+                for mac in cameras:
+                    entry["cameras"][mac] = entry["cameras"].get(mac, 0) + 1
+            result[window] = entry
+        return result
+
+
+_api_metrics = ApiMetrics()
+_api_usage = ApiUsage()
+
+# Called with the rejected credential when Wyze reports an invalid access token;
+# returns a fresh credential, or None when re-authentication failed
+_reauth_handler: Optional[Any] = None
+_reauth_state = threading.local()
+
+
+def token_invalid(error: Exception) -> bool:
+    """Wyze rejected the access token (expired or revoked), e.g. response code 2001"""
+    return isinstance(error, AccessTokenError) or str(getattr(error, "code", "")) in WYZE_TOKEN_INVALID_CODES
+
+
+def reauthenticate_for(stale: Any) -> Optional[Any]:
+    """Fresh credential to retry with, unless no handler is set or we are already re-authenticating"""
+    if not _reauth_handler or getattr(_reauth_state, "active", False):
+        return None
+    _reauth_state.active = True
+    try:
+        return _reauth_handler(stale)
+    finally:
+        _reauth_state.active = False
+
+
+def api_transient(error: Exception) -> bool:
+    """Whether a failed Wyze call is worth retrying"""
+    status = getattr(getattr(error, "response", None), "status_code", None)
+    if status is not None:
+        return status in API_RETRY_STATUSES
+    return isinstance(error, (OSError, urllib.error.URLError)) or type(error).__name__ in ("ConnectionError", "Timeout")
+
+
+def wyze_api(name: str, fn: Any, *args, idempotent: bool = True, cameras: Optional[List[str]] = None,
+             **kwargs) -> Any:
+    """Call a wyzecam API function with metrics, retries for idempotent calls, and error mapping
+
+    Every attempt counts towards API usage, attributed to cameras when the call
+    is about specific cameras. Failures raise WyzeApiError.
+    """
+    attempts = API_RETRIES if idempotent else 1
+    attempt = 0
+    reauthed = False
+    while attempt < attempts:
+        attempt += 1
+        started = time.monotonic()
+        try:
+            with plugin_resolution():
+                result = fn(*args, **kwargs)
+        except Exception as e:
+            status = getattr(getattr(e, "response", None), "status_code", None)
+            _api_usage.record(name, cameras, status == 429)
+            outcome = str(status) if status else ("auth_expired" if token_invalid(e) else type(e).__name__)
+            stale = next((a for a in args if isinstance(a, wyzecam.WyzeCredential)), None)
+            if token_invalid(e) and stale is not None and not reauthed:
+                fresh = reauthenticate_for(stale)
+                if fresh is not None:
+                    # A rejected token means the call never ran, so even non-idempotent calls are safe to repeat
+                    _api_metrics.record(name, outcome, time.monotonic() - started, True)
+                    args = tuple(fresh if a is stale else a for a in args)
+                    reauthed = True
+                    attempt -= 1
+                    continue
+            retry = attempt < attempts and api_transient(e)
+            _api_metrics.record(name, outcome, time.monotonic() - started, retry)
+            if not retry:
+                log(f"{name} failed ({outcome}) after {attempt} attempt(s): {e}", "debug", "api")
+                raise WyzeApiError(name, e) from e
+            delay = API_RETRY_DELAY * 2 ** (attempt - 1) * random.uniform(0.8, 1.2)
+            log(f"Wyze API {name} failed ({outcome}), retrying in {delay:.1f}s", "warning", "api")
+            time.sleep(delay)
+            continue
+        _api_metrics.record(name, "ok", time.monotonic() - started)
+        _api_usage.record(name, cameras)
+        log(f"{name} ok in {(time.monotonic() - started) * 1000:.0f}ms", "debug", "api")
+        return result
+
+
+class WyzeAuth:
+    """Manages Wyze authentication"""
+
+    def __init__(self, config: Dict[str, Any]):
+        self.config = config
+        self.auth_info: Optional[wyzecam.WyzeCredential] = None
+        self.account: Optional[wyzecam.WyzeAccount] = None
+        self.cameras: Dict[str, wyzecam.WyzeCamera] = {}
+
+    def restore(self, state: Dict[str, Any]):
+        """Load credentials, account and cameras saved by the auth cache or an upgrade checkpoint"""
+        self.auth_info = wyzecam.WyzeCredential.model_validate(state["auth_info"])
+        self.account = wyzecam.WyzeAccount.model_validate(state["account"])
+        self.cameras = {mac: wyzecam.WyzeCamera.model_validate(cam_data)
+                        for mac, cam_data in state["cameras"].items()}
+
+    def dump(self) -> Dict[str, Any]:
+        """State for restore()"""
+        def plain(obj: Any) -> Any:
+            return obj.model_dump() if hasattr(obj, 'model_dump') else obj.__dict__
+        return {
+            "auth_info": plain(self.auth_info),
+            "account": plain(self.account),
+            "cameras": {mac: plain(cam) for mac, cam in self.cameras.items()},
+        }
+
+    def login(self, use_cache: bool = True, with_cameras: bool = True):
+        """Login to Wyze and get camera list (with caching)
+
+        With with_cameras=False a fresh login stops after authentication and
+        the caller fetches the camera list later with enumerate_cameras().
+        """
+        # Try to use cached auth first
+        if use_cache:
+            cache = load_auth_cache()
+            if cache:
+                try:
+                    log("Using cached authentication")
+                    self.restore(cache)
+                    log(f"Loaded {len(self.cameras)} cameras from cache")
+                    return self
+                except Exception as e:
+                    log(f"Cache load failed, will re-authenticate: {e}")
+
+        if self.config.get("access_token"):
+            self._token_login()
+            if with_cameras:
+                self.enumerate_cameras()
+            return self
+
+        email = self.config.get("email")
+        password = self.config.get("password")
+        key_id = self.config.get("key_id")
+        api_key = self.config.get("api_key")
+
+        if not email or not password:
+            raise ValueError("email and password (or access_token) are required")
+
+        log(f"Logging into Wyze as {email}...")
+        # Not retried: repeated logins count against Wyze's rate limit
+        self.auth_info = wyze_api(
+            "login", wyzecam.login,
+            email, password,
+            api_key=api_key,
+            key_id=key_id,
+            idempotent=False,
+        )
+        if not getattr(self.auth_info, "access_token", None) and getattr(self.auth_info, "mfa_options", None):
+            warn("mfa_required", "Wyze requires two-factor authentication for this account"
+                 + ("" if self.config.get("totp_key") else "; set totp_key"), component="api")
+        self.account = wyze_api("get_user_info", wyzecam.get_user_info, self.auth_info)
+        log(f"Logged in successfully as {self.account.nickname}")
+
+        if with_cameras:
+            self.enumerate_cameras()
+        return self
+
+    def _token_login(self):
+        """Use an injected access/refresh token pair instead of a password login
+
+        The pair is checked with a user info lookup and refreshed once if the
+        access token has expired. Refreshed tokens are kept in TOKEN_FILE and
+        used until the config supplies a different pair.
+        """
+        tokens = load_refreshed_tokens(self.config) or {
+            "access_token": self.config["access_token"],
+            "refresh_token": self.config.get("refresh_token"),
+            "phone_id": self.config.get("phone_id"),
+        }
+        self.auth_info = wyzecam.WyzeCredential.model_validate({
+            "access_token": tokens["access_token"],
+            "refresh_token": tokens.get("refresh_token"),
+            "phone_id": tokens.get("phone_id") or str(uuid.uuid4()),
+        })
+        log("Using injected Wyze access token")
+        try:
+            self.account = wyze_api("get_user_info", wyzecam.get_user_info, self.auth_info)
+        except WyzeApiError as e:
+            if not token_invalid(e.cause):
+                raise
+            if not self.auth_info.refresh_token:
+                raise PluginError("auth_failed", "Injected access_token has expired and no refresh_token was given")
+            log("Injected access token expired, refreshing")
+            self.refresh_token()
+            self.account = wyze_api("get_user_info", wyzecam.get_user_info, self.auth_info)
+        log(f"Authenticated as {self.account.nickname}")
+
+    def refresh_token(self):
+        """Exchange the refresh token for a new access token"""
+        # Not retried: a refresh token may only be usable once
+        refreshed = wyze_api("refresh_token", wyzecam.api.refresh_token, self.auth_info, idempotent=False)
+        if not getattr(refreshed, "phone_id", None):
+            refreshed.phone_id = self.auth_info.phone_id
+        self.auth_info = refreshed
+        if self.config.get("access_token"):
+            try:
+                save_refreshed_tokens(self.config, self.auth_info)
+            except OSError as e:
+                log(f"Failed to save refreshed tokens: {e}")
+
+    def reauthenticate(self) -> str:
+        """Replace a rejected access token: refresh it if we can, else log in again
+
+        Returns how the new token was obtained ("refresh_token" or "login").
+        """
+        method = None
+        if self.auth_info and getattr(self.auth_info, "refresh_token", None):
+            try:
+                self.refresh_token()
+                method = "refresh_token"
+            except Exception as e:
+                log(f"Token refresh failed: {e}")
+        if not method:
+            if self.config.get("access_token") and not self.config.get("password"):
+                raise PluginError("auth_failed", "Access token was rejected and could not be refreshed")
+            self.login(use_cache=False, with_cameras=False)
+            method = "login"
+        save_auth_cache(self.auth_info, self.account, self.cameras)
+        return method
+
+    def enumerate_cameras(self):
+        """Fetch the full camera list and cache it with the credentials"""
+        camera_list = wyze_api("get_camera_list", wyzecam.get_camera_list, self.auth_info)
+        cameras = {}
+        for camera in camera_list:
+            cameras[camera.mac] = camera
+            log(f"Found camera: {camera.nickname} ({camera.mac}) - {camera.product_model}")
+            if camera.product_model not in CAMERA_MODELS:
+                log(f"Unknown camera model {camera.product_model}; using generic capabilities")
+        self.cameras = cameras
+
+        # Save to cache
+        save_auth_cache(self.auth_info, self.account, self.cameras)
+
+    def refresh_cameras(self) -> tuple:
+        """Re-fetch the camera list
+
+        Returns (new cameras, MACs missing from the account). Missing cameras
+        are kept until the caller decides to forget them.
+        """
+        known = set(self.cameras)
+        try:
+            camera_list = wyze_api("get_camera_list", wyzecam.get_camera_list, self.auth_info)
+        except Exception as e:
+            log(f"Camera list refresh failed, re-authenticating: {e}")
+            self.login(use_cache=False)
+            camera_list = list(self.cameras.values())
+
+        cameras = {camera.mac: camera for camera in camera_list}
+        new_cameras = [camera for mac, camera in cameras.items() if mac not in known]
+        missing = [mac for mac in known if mac not in cameras]
+        for mac in missing:
+            if mac in self.cameras:
+                cameras[mac] = self.cameras[mac]
+
+        # Swap the whole dict so readers never see a partial update
+        self.cameras = cameras
+        save_auth_cache(self.auth_info, self.account, self.cameras)
+
+        for camera in new_cameras:
+            log(f"New camera: {camera.nickname} ({camera.mac}) - {camera.product_model}")
+        return new_cameras, missing
+
+    def forget_camera(self, mac: str):
+        """Drop a camera from the roster"""
+        cameras = dict(self.cameras)
+        cameras.pop(mac, None)
+        self.cameras = cameras
+        save_auth_cache(self.auth_info, self.account, self.cameras)
+
+    def get_camera(self, mac: str) -> Optional[wyzecam.WyzeCamera]:
+        """Get a camera by MAC address"""
+        return self.cameras.get(mac)
+
+
+def mask_filters(masks: Any) -> List[str]:
+    """drawbox filters blacking out each privacy mask rectangle"""
+    filters = []
+    for mask in masks if isinstance(masks, list) else []:
+        try:
+            x, y, w, h = (float(mask[k]) for k in ("x", "y", "w", "h"))
+        except (KeyError, TypeError, ValueError):
+            continue
+        filters.append(f"drawbox=x=iw*{x:.4f}:y=ih*{y:.4f}:w=iw*{w:.4f}:h=ih*{h:.4f}:color=black:t=fill")
+    return filters
+
+
+def video_filter(settings: Dict[str, Any], name: str = "") -> str:
+    """ffmpeg -vf chain for a camera's privacy mask/rotate/flip/name overlay settings, empty when untouched"""
+    # Masks go first so their coordinates stay in the camera's own orientation
+    filters = mask_filters(settings.get("privacy_masks"))
+    filters += ROTATIONS.get(settings.get("rotate", 0), []) + FLIPS.get(settings.get("flip", "none"), [])
+    if settings.get("osd_name") and name:
+        text = drawtext_escape(name)
+        filters.append(f"drawtext=text='{text}':x=10:y=h-th-10:fontsize=h/24:fontcolor=white:box=1:boxcolor=black@0.4")
+    return ",".join(filters)
+
+
+def drawtext_escape(text: str) -> str:
+    """Escape literal text for an ffmpeg drawtext text='...' option"""
+    return text.replace("\\", "\\\\").replace("'", "\\'").replace(":", "\\:").replace("%", "\\%")
+
+
+def watermark_filter(settings: Dict[str, Any], still: Optional[str] = None) -> str:
+    """drawtext for the camera's watermark label and UTC time, empty without one
+
+    The restream (still=None) gets a running clock; a still gets the given
+    fixed time text.
+    """
+    mark = settings.get("watermark")
+    if not isinstance(mark, dict):
+        return ""
+    stamp = drawtext_escape(still) if still is not None else "%{gmtime} UTC"
+    text = "  ".join(part for part in (drawtext_escape(str(mark.get("label", ""))), stamp) if part)
+    return f"drawtext=text='{text}':x=10:y=10:fontsize=h/28:fontcolor=white:box=1:boxcolor=black@0.5"
+
+
+def transform_image(path: str, vf: str):
+    """Apply an ffmpeg filter chain to a JPEG in place"""
+    tmp_path = path + ".vf.jpg"
+    subprocess.run(
+        ["ffmpeg", "-hide_banner", "-loglevel", "error", "-i", path, "-vf", vf, "-y", tmp_path],
+        check=True, capture_output=True, timeout=30,
+    )
+    os.replace(tmp_path, path)
+
+
+class _OnOffMessage(tutk_protocol.TutkWyzeProtocolMessage):
+    """Wyze IOCTL carrying or returning one on/off byte (1 = on, 2 = off)"""
+
+    def __init__(self, code: int, enabled: Optional[bool] = None):
+        super().__init__(code)
+        self.enabled = enabled
+
+    def encode(self) -> bytes:
+        if self.enabled is None:
+            return tutk_protocol.encode(self.code, None)
+        return tutk_protocol.encode(self.code, bytes([1 if self.enabled else 2]))
+
+    def parse_response(self, resp_data: bytes) -> Any:
+        if self.enabled is None:
+            # A relayed query that got no answer comes back empty
+            if not resp_data:
+                raise PluginError("camera_command_failed", f"K{self.code} returned no state")
+            return resp_data[0] == 1
+        return resp_data[0] == 1 if resp_data else True
+
+
+class _TakePhotoMessage(tutk_protocol.TutkWyzeProtocolMessage):
+    """K10058: the camera captures a still and saves it to its SD card"""
+
+    def __init__(self):
+        super().__init__(10058)
+
+    def parse_response(self, resp_data: bytes) -> Any:
+        # K10059 carries a single status byte; 1 means the photo was taken
+        return not resp_data or resp_data[0] == 1
+
+
+class _RotaryActionMessage(tutk_protocol.TutkWyzeProtocolMessage):
+    """K11002: turn a Pan camera (horizontal 1 = left, 2 = right; vertical 1 = up, 2 = down; 0 = stop)"""
+
+    def __init__(self, horizontal: int, vertical: int, speed: int):
+        super().__init__(PTZ_ROTARY_ACTION)
+        self.horizontal = horizontal
+        self.vertical = vertical
+        self.speed = speed
+
+    def encode(self) -> bytes:
+        return tutk_protocol.encode(self.code, bytes([self.horizontal, self.vertical, self.speed]))
+
+    def parse_response(self, resp_data: bytes) -> Any:
+        return True
+
+
+class _RotaryDegreeMessage(tutk_protocol.TutkWyzeProtocolMessage):
+    """K11000: turn a Pan camera by degrees (positive pan is right, positive tilt is up)"""
+
+    def __init__(self, pan: int, tilt: int, speed: int):
+        super().__init__(PTZ_ROTARY_DEGREE)
+        self.pan = pan
+        self.tilt = tilt
+        self.speed = speed
+
+    def encode(self) -> bytes:
+        return tutk_protocol.encode(self.code, struct.pack("<hhB", self.pan, self.tilt, self.speed))
+
+    def parse_response(self, resp_data: bytes) -> Any:
+        return True
+
+
+# OSD IOCTLs: timestamp overlay and Wyze logo watermark
+OSD_COMMANDS = {
+    "timestamp": (10070, 10072),
+    "logo": (10074, 10076),
+}
+
+# Camera-side motion detection switch (get, set) and the Wyze cloud property for the
+# account's push notifications from the camera
+MOTION_ALARM_COMMANDS = (10200, 10202)
+NOTIFICATION_PROPERTY = "P1"
+
+# Pan/tilt (Cam Pan): K11002 turns by direction, K11000 by degrees. The camera only turns
+# a little per K11002, so a move resends it every PTZ_REPEAT_INTERVAL until stopped, for
+# at most PTZ_MAX_MOVE seconds
+PTZ_ROTARY_ACTION = 11002
+PTZ_ROTARY_DEGREE = 11000
+PTZ_DIRECTIONS = {"left": (1, 0), "right": (2, 0), "up": (0, 1), "down": (0, 2)}
+PTZ_COMMANDS = tuple(PTZ_DIRECTIONS) + ("stop", "rotate")
+PTZ_SPEEDS = (1, 9)
+DEFAULT_PTZ_SPEED = 5
+PTZ_REPEAT_INTERVAL = 0.5
+PTZ_MAX_MOVE = 30
+
+# Feature each IOCTL belongs to, checked against the firmware requirements before sending
+COMMAND_FEATURES: Dict[int, str] = {
+    10058: "photo",
+    **{code: "osd" for codes in OSD_COMMANDS.values() for code in codes},
+    **{code: "motion_detection" for code in MOTION_ALARM_COMMANDS},
+    PTZ_ROTARY_ACTION: "ptz",
+    PTZ_ROTARY_DEGREE: "ptz",
+}
+
+
+class _RelayedMessage(tutk_protocol.TutkWyzeProtocolMessage):
+    """An IOCTL forwarded by the plugin process: sent pre-encoded, response returned raw"""
+
+    def __init__(self, code: int, expected: int, encoded: bytes):
+        super().__init__(code)
+        self.expected_response_code = expected
+        self.encoded = encoded
+
+    def encode(self) -> bytes:
+        return self.encoded
+
+    def parse_response(self, resp_data: bytes) -> Any:
+        return resp_data
+
+
+class StreamControlServer:
+    """Localhost control channel into a stream process's TUTK session
+
+    The plugin sends one JSON line per request, authenticated with a token
+    that is only published in the owner-only stream state file, to run IOCTLs over the
+    session the stream already has open or fetch its latest keyframe, instead
+    of opening a second session to the camera.
+    """
+
+    def __init__(self, state: Dict[str, Any], share_keyframes: bool = True):
+        self.token = uuid.uuid4().hex
+        self.share_keyframes = share_keyframes
+        self.lock = threading.Lock()
+        self.session: Optional[WyzeIOTCSession] = None
+        self.mux: Any = None
+        self.keyframe: Optional[bytes] = None
+        self.codec = "h264"
+        self.sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        self.sock.bind(("127.0.0.1", 0))
+        self.sock.listen(4)
+        state["control"] = {"port": self.sock.getsockname()[1], "token": self.token}
+        threading.Thread(target=self._serve, daemon=True).start()
+
+    def attach(self, session: WyzeIOTCSession):
+        with self.lock:
+            self.session = session
+            self.keyframe = None
+
+    def detach(self):
+        with self.lock:
+            if self.mux:
+                try:
+                    self.mux.__exit__(None, None, None)
+                except Exception:
+                    pass
+            self.session = None
+            self.mux = None
+
+    def _serve(self):
+        while True:
+            try:
+                conn, _ = self.sock.accept()
+            except OSError:
+                return
+            with conn:
+                conn.settimeout(CONTROL_TIMEOUT)
+                try:
+                    request = json.loads(conn.makefile("rb").readline())
+                    response = self._handle(request)
+                except Exception as e:
+                    response = {"error": f"{type(e).__name__}: {e}"}
+                try:
+                    conn.sendall(json.dumps(response).encode() + b"\n")
+                except OSError:
+                    pass
+
+    def _handle(self, request: Dict[str, Any]) -> Dict[str, Any]:
+        if not hmac.compare_digest(str(request.get("token", "")), self.token):
+            return {"error": "unauthorized"}
+        with self.lock:
+            if not self.session:
+                return {"error": "no_session"}
+            if request.get("op") == "keyframe":
+                if not self.keyframe or not self.share_keyframes:
+                    return {"error": "no_keyframe"}
+                return {"keyframe": base64.b64encode(self.keyframe).decode(), "codec": self.codec}
+            if request.get("op") != "ioctl":
+                return {"error": "unknown_op"}
+            if not self.mux:
+                mux = self.session.iotctrl_mux()
+                mux.__enter__()
+                self.mux = mux
+            mux = self.mux
+
+        # Waiting on the camera without the lock, so attach/detach (reconnects, teardown) aren't held up
+        results = []
+        for msg in request.get("messages", []):
+            relayed = _RelayedMessage(msg["code"], msg["expected"], base64.b64decode(msg["data"]))
+            try:
+                raw = mux.send_ioctl(relayed).result(timeout=CAMERA_COMMAND_TIMEOUT)
+            except Exception:
+                if self.mux is not mux:
+                    return {"error": "no_session"}
+                raise
+            if self.mux is not mux:
+                return {"error": "no_session"}  # detached mid-request
+            results.append(base64.b64encode(raw or b"").decode())
+        return {"results": results}
+
+    def close(self):
+        self.detach()
+        try:
+            self.sock.close()
+        except OSError:
+            pass
+
+
+def stream_control(mac: str, request: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+    """Send a request to the running stream for mac; None when no stream has a session to offer"""
+    stream = next((s for s in list_active_streams() if s["mac"] == mac and s.get("control")), None)
+    if not stream:
+        return None
+    control = stream["control"]
+    with socket.create_connection(("127.0.0.1", control["port"]), timeout=CONTROL_TIMEOUT) as sock:
+        sock.sendall(json.dumps({**request, "token": control["token"]}).encode() + b"\n")
+        response = json.loads(sock.makefile("rb").readline() or b"{}")
+    if response.get("error") in ("no_session", "no_keyframe"):
+        return None
+    if "error" in response:
+        raise RuntimeError(f"stream control: {response['error']}")
+    return response
+
+
+def relay_camera_commands(mac: str, messages: List[tutk_protocol.TutkWyzeProtocolMessage]) -> Optional[List[Any]]:
+    """Run IOCTLs over the camera's streaming session, if it has one"""
+    response = stream_control(mac, {"op": "ioctl", "messages": [
+        {"code": msg.code, "expected": msg.expected_response_code, "data": base64.b64encode(msg.encode()).decode()}
+        for msg in messages
+    ]})
+    if response is None:
+        return None
+    return [msg.parse_response(base64.b64decode(raw)) for msg, raw in zip(messages, response["results"])]
+
+
+class CameraSessionManager:
+    """TUTK sessions for camera commands when the camera isn't streaming
+
+    A session stays open for COMMAND_SESSION_IDLE seconds after its last
+    command so bursts (e.g. PTZ moves) reuse it. A keepalive thread checks
+    open sessions and closes idle or broken ones; at most MAX_COMMAND_SESSIONS
+    are open, the least recently used idle one is closed to make room.
+
+    The manager lock only guards the sessions dict. Connecting happens under
+    the new entry's own lock so an unreachable camera doesn't hold up the
+    others, and an entry's lock is held whenever its session is in use.
+
+    TUTK initialization is process-wide, so the manager owns the plugin's
+    only WyzeIOTC; other users (the LAN search) borrow it with borrow_iotc.
+    """
+
+    def __init__(self, tutk_lib: str):
+        self.tutk_lib = tutk_lib
+        self.iotc: Optional[WyzeIOTC] = None
+        self.iotc_users = 0
+        self.sessions: Dict[str, Dict[str, Any]] = {}
+        self.lock = threading.Lock()
+        self.iotc_idle = threading.Condition(self.lock)
+        self.running = True
+        threading.Thread(target=self._keepalive, daemon=True).start()
+
+    def run(self, account: Any, camera: Any, messages: List[tutk_protocol.TutkWyzeProtocolMessage]) -> List[Any]:
+        while True:
+            entry = self._acquire(account, camera)
+            with entry["lock"]:
+                if self.sessions.get(camera.mac) is not entry:
+                    continue  # closed (keepalive, eviction, failed connect) before we got it; open another
+                try:
+                    results = [entry["mux"].send_ioctl(msg).result(timeout=CAMERA_COMMAND_TIMEOUT)
+                               for msg in messages]
+                except Exception:
+                    self._close(camera.mac, entry)
+                    raise
+                entry["last_used"] = time.monotonic()
+                return results
+
+    def _acquire(self, account: Any, camera: Any) -> Dict[str, Any]:
+        """The camera's session entry, connecting a new one if there is none"""
+        with self.lock:
+            entry = self.sessions.get(camera.mac)
+            if entry:
+                return entry
+            evicted = self._evict_locked(camera.mac) if len(self.sessions) >= MAX_COMMAND_SESSIONS else None
+            # Reserved with its lock held until connected, so other callers wait on this camera only
+            entry = {"session": None, "mux": None, "lock": threading.Lock(), "last_used": time.monotonic()}
+            entry["lock"].acquire()
+            self.sessions[camera.mac] = entry
+
+        if evicted:
+            evicted_mac, evicted_entry = evicted
+            try:
+                self._exit(evicted_entry)
+            finally:
+                evicted_entry["lock"].release()
+            log(f"Closed command session to {evicted_mac}")
+
+        try:
+            with self.borrow_iotc() as iotc:
+                session = WyzeIOTCSession(iotc.tutk_platform_lib, account, camera, connect_timeout=20)
+                session.__enter__()
+                try:
+                    mux = session.iotctrl_mux()
+                    mux.__enter__()
+                except Exception:
+                    session.__exit__(None, None, None)
+                    raise
+        except Exception:
+            with self.lock:
+                if self.sessions.get(camera.mac) is entry:
+                    del self.sessions[camera.mac]
+            entry["lock"].release()
+            raise
+
+        with self.lock:
+            kept = self.sessions.get(camera.mac) is entry
+            if kept:
+                # Set under the lock: close_all leaves entries without a session to us
+                entry["session"], entry["mux"] = session, mux
+        entry["lock"].release()
+        if not kept:  # close_all ran while connecting
+            self._exit({"session": session, "mux": mux})
+        else:
+            log(f"Opened command session to {camera.nickname}")
+        return entry
+
+    @contextmanager
+    def borrow_iotc(self):
+        """The shared WyzeIOTC, initialized on first use; close_all waits for borrowers before deinitializing"""
+        with self.lock:
+            if not self.running:
+                raise PluginError("shutting_down")
+            if not self.iotc:
+                self.iotc = WyzeIOTC(tutk_platform_lib=self.tutk_lib, sdk_key=SDK_KEY,
+                                     max_num_av_channels=MAX_COMMAND_SESSIONS)
+                self.iotc.initialize()
+            self.iotc_users += 1
+            iotc = self.iotc
+        try:
+            yield iotc
+        finally:
+            with self.lock:
+                self.iotc_users -= 1
+                self.iotc_idle.notify_all()
+
+    def _evict_locked(self, mac: str) -> tuple:
+        """Remove the least recently used idle session; busy if every session is in use
+
+        Returns (mac, entry) with the entry's lock held; the caller closes it
+        and releases the lock once the manager lock is released.
+        """
+        for oldest in sorted(self.sessions, key=lambda m: self.sessions[m]["last_used"]):
+            entry = self.sessions[oldest]
+            if not entry["lock"].acquire(blocking=False):
+                continue  # running a command or still connecting
+            del self.sessions[oldest]
+            return oldest, entry
+        raise PluginError("busy", f"All {MAX_COMMAND_SESSIONS} camera command sessions are busy", mac)
+
+    def _close(self, mac: str, entry: Dict[str, Any]):
+        """Close entry if it is still the camera's session (the caller holds its lock)"""
+        with self.lock:
+            if self.sessions.get(mac) is not entry:
+                return
+            del self.sessions[mac]
+        self._exit(entry)
+        log(f"Closed command session to {mac}")
+
+    @staticmethod
+    def _exit(entry: Dict[str, Any]):
+        for ctx in (entry["mux"], entry["session"]):
+            if ctx is None:
+                continue
+            try:
+                ctx.__exit__(None, None, None)
+            except Exception:
+                pass
+
+    def _keepalive(self):
+        while self.running:
+            time.sleep(COMMAND_SESSION_KEEPALIVE)
+            for mac, entry in list(self.sessions.items()):
+                if not entry["lock"].acquire(blocking=False):
+                    continue  # busy with a command or connecting
+                try:
+                    if self.sessions.get(mac) is not entry:
+                        continue
+                    if time.monotonic() - entry["last_used"] >= COMMAND_SESSION_IDLE:
+                        self._close(mac, entry)
+                    else:
+                        entry["session"].session_check()
+                except Exception as e:
+                    log(f"Command session to {mac} failed keepalive: {e}")
+                    self._close(mac, entry)
+                finally:
+                    entry["lock"].release()
+
+    def close_all(self):
+        self.running = False
+        with self.lock:
+            # Entries still connecting have no session yet; _acquire closes those itself
+            closing = [(mac, entry) for mac, entry in self.sessions.items() if entry["session"] is not None]
+            self.sessions.clear()
+        deadline = time.monotonic() + COMMAND_SESSION_CLOSE_WAIT
+        for mac, entry in closing:
+            # Let a running command finish first; past the deadline it is closed anyway
+            acquired = entry["lock"].acquire(timeout=max(0.0, deadline - time.monotonic()))
+            try:
+                self._exit(entry)
+            finally:
+                if acquired:
+                    entry["lock"].release()
+            log(f"Closed command session to {mac}")
+        with self.lock:
+            # A LAN search or connect still using the library finishes within its own timeout
+            self.iotc_idle.wait_for(lambda: not self.iotc_users, timeout=COMMAND_SESSION_CLOSE_WAIT)
+            if self.iotc:
+                try:
+                    self.iotc.deinitialize()
+                except Exception:
+                    pass
+                self.iotc = None
+
+    def status(self) -> List[str]:
+        return sorted(self.sessions)
+
+
+def fetch_api_snapshot(camera: Any, path: str):
+    """Download the camera's cloud thumbnail to path"""
+    url = getattr(camera, 'thumbnail', None)
+    if not url:
+        raise PluginError("snapshot_unavailable", f"No cloud thumbnail available for camera {camera.mac}",
+                          camera.mac)
+
+    tmp_path = path + ".tmp"
+    _api_usage.record("thumbnail", [camera.mac])
+    with plugin_resolution():
+        urllib.request.urlretrieve(url, tmp_path)
+    os.replace(tmp_path, path)
+
+
+def _pid_file(pid: int) -> str:
+    return os.path.join(RUN_DIR, f"child-{pid}.pid")
+
+
+def spawn_child(cmd: List[str], **kwargs) -> subprocess.Popen:
+    """Start a child process and record its PID so orphans can be reaped"""
+    if IS_WINDOWS:
+        kwargs.setdefault("creationflags", subprocess.CREATE_NEW_PROCESS_GROUP)
+    proc = subprocess.Popen(cmd, **kwargs)
+    os.makedirs(RUN_DIR, exist_ok=True)
+    with open(_pid_file(proc.pid), "w") as f:
+        f.write(f"{proc.pid}\n{cmd[0]}\n")
+    _children.add(proc)
+    return proc
+
+
+def stop_child(proc: subprocess.Popen, timeout: float = 5):
+    """Terminate a child process and forget its PID file"""
+    if proc.poll() is None:
+        proc.terminate()
+        try:
+            proc.wait(timeout=timeout)
+        except subprocess.TimeoutExpired:
+            proc.kill()
+            proc.wait()
+    _children.discard(proc)
+    try:
+        os.remove(_pid_file(proc.pid))
+    except OSError:
+        pass
+
+
+def stop_all_children():
+    """Terminate every child process we started"""
+    for proc in list(_children):
+        stop_child(proc)
+
+
+def _process_matches(pid: int, executable: str) -> bool:
+    """Check that pid is still running the executable we started (guards PID reuse)"""
+    if IS_WINDOWS:
+        try:
+            out = subprocess.run(["tasklist", "/FI", f"PID eq {pid}", "/FO", "CSV", "/NH"],
+                                 capture_output=True, text=True, timeout=5).stdout
+        except Exception:
+            return False
+        name = os.path.splitext(os.path.basename(executable))[0].lower()
+        return name in out.lower()
+
+    try:
+        with open(f"/proc/{pid}/cmdline", "rb") as f:
+            cmdline = f.read().decode(errors="replace")
+    except FileNotFoundError:
+        return False
+    except OSError:
+        try:
+            cmdline = subprocess.run(["ps", "-p", str(pid), "-o", "command="],
+                                     capture_output=True, text=True, timeout=5).stdout
+        except Exception:
+            return False
+    return os.path.basename(executable) in cmdline
+
+
+def kill_process_tree(pid: int):
+    """Terminate a process we no longer hold a handle for"""
+    if IS_WINDOWS:
+        subprocess.run(["taskkill", "/PID", str(pid), "/T", "/F"], capture_output=True, timeout=10)
+    else:
+        os.kill(pid, signal.SIGTERM)
+
+
+def reap_orphans():
+    """Kill children left behind by a previous plugin process that was killed"""
+    if not os.path.isdir(RUN_DIR):
+        return
+
+    for fname in os.listdir(RUN_DIR):
+        if not (fname.startswith("child-") and fname.endswith(".pid")):
+            continue
+        path = os.path.join(RUN_DIR, fname)
+        try:
+            with open(path) as f:
+                pid_line, executable = (f.read().splitlines() + ["", ""])[:2]
+            pid = int(pid_line)
+            if _process_matches(pid, executable):
+                log(f"Reaping orphaned child process {pid} ({executable})")
+                kill_process_tree(pid)
+        except (OSError, ValueError) as e:
+            log(f"Failed to reap orphan from {fname}: {e}")
+        try:
+            os.remove(path)
+        except OSError:
+            pass
+
+
+class LanSearchInfo2(Structure):
+    """TUTK st_LanSearchInfo2"""
+    _fields_ = [
+        ("UID", c_char * 21),
+        ("IP", c_char * 46),
+        ("port", c_ushort),
+        ("DeviceName", c_char * 129),
+        ("Reserved", c_char),
+    ]
+
+
+def lan_search(sessions: CameraSessionManager, timeout_ms: int = LAN_SEARCH_TIMEOUT_MS) -> Dict[str, Dict[str, Any]]:
+    """Broadcast a TUTK LAN search and return {UID: {"ip", "port"}} for responding devices
+
+    Runs on the session manager's WyzeIOTC: initializing and deinitializing
+    a second one would tear TUTK down under the open command sessions.
+    """
+    with sessions.borrow_iotc() as iotc:
+        lib = iotc.tutk_platform_lib
+        lib.IOTC_Lan_Search2.argtypes = [POINTER(LanSearchInfo2), c_int, c_int]
+        lib.IOTC_Lan_Search2.restype = c_int
+        results = (LanSearchInfo2 * LAN_SEARCH_MAX_DEVICES)()
+        count = lib.IOTC_Lan_Search2(results, LAN_SEARCH_MAX_DEVICES, timeout_ms)
+        if count < 0:
+            raise RuntimeError(f"IOTC_Lan_Search2 failed with code {count}")
+
+        found = {}
+        for info in results[:count]:
+            uid = info.UID.decode(errors="replace")
+            found[uid] = {"ip": info.IP.decode(errors="replace"), "port": info.port}
+        return found
+
+
+def ping_host(host: str, timeout: int = 2) -> Dict[str, Any]:
+    """ICMP ping a host with the system ping command"""
+    if IS_WINDOWS:
+        cmd = ["ping", "-n", "1", "-w", str(timeout * 1000), host]
+    else:
+        cmd = ["ping", "-c", "1", "-W", str(timeout), host]
+    started = time.monotonic()
+    try:
+        ok = subprocess.run(cmd, capture_output=True, timeout=timeout + 2).returncode == 0
+    except (OSError, subprocess.TimeoutExpired):
+        ok = False
+    return {"reachable": ok, "rtt_ms": round((time.monotonic() - started) * 1000, 1) if ok else None}
+
+
+def _pid_alive(pid: int) -> bool:
+    if IS_WINDOWS:
+        # os.kill(pid, 0) would terminate the process on Windows
+        return _process_matches(pid, sys.executable)
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return False
+    except PermissionError:
+        pass
+    return True
+
+
+def _wake_file(mac: str) -> str:
+    return os.path.join(RUN_DIR, f"wake-{mac}.json")
+
+
+def read_wake(mac: str) -> Optional[float]:
+    """End of an event_only camera's current wake window, if any"""
+    try:
+        with open(_wake_file(mac)) as f:
+            return float(json.load(f)["until"])
+    except (OSError, ValueError, KeyError):
+        return None
+
+
+def write_wake(mac: str, until: float):
+    os.makedirs(RUN_DIR, exist_ok=True)
+    path = _wake_file(mac)
+    with open(path + ".tmp", "w") as f:
+        json.dump({"until": until}, f)
+    os.replace(path + ".tmp", path)
+
+
+def clear_wake(mac: str):
+    try:
+        os.remove(_wake_file(mac))
+    except OSError:
+        pass
+
+
+def _stream_file(pid: int) -> str:
+    return os.path.join(RUN_DIR, f"stream-{pid}.json")
+
+
+def list_active_streams() -> List[Dict[str, Any]]:
+    """Return state of running stream processes, dropping entries for dead ones"""
+    streams = []
+    if not os.path.isdir(RUN_DIR):
+        return streams
+
+    for fname in os.listdir(RUN_DIR):
+        if not (fname.startswith("stream-") and fname.endswith(".json")):
+            continue
+        path = os.path.join(RUN_DIR, fname)
+        try:
+            with open(path) as f:
+                state = json.load(f)
+        except (OSError, ValueError):
+            continue
+        if _pid_alive(int(state.get("pid", 0))):
+            streams.append(state)
+        else:
+            try:
+                os.remove(path)
+            except OSError:
+                pass
+    return streams
+
+
+def write_stream_state(state: Dict[str, Any]):
+    """Publish this stream process's state for the plugin process to read (owner-only, it holds the control token)"""
+    os.makedirs(RUN_DIR, exist_ok=True)
+    path = _stream_file(os.getpid())
+    fd = os.open(path + ".tmp", os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w") as f:
+        json.dump(state, f)
+    os.replace(path + ".tmp", path)
+
+
+@contextmanager
+def stream_slot_lock():
+    """Serialize stream slot decisions across stream processes"""
+    os.makedirs(RUN_DIR, exist_ok=True)
+    with open(os.path.join(RUN_DIR, "slots.lock"), "a+") as f:
+        if IS_WINDOWS:
+            import msvcrt
+            f.seek(0)
+            msvcrt.locking(f.fileno(), msvcrt.LK_LOCK, 1)
+        else:
+            import fcntl
+            fcntl.flock(f, fcntl.LOCK_EX)
+        try:
+            yield
+        finally:
+            if IS_WINDOWS:
+                f.seek(0)
+                msvcrt.locking(f.fileno(), msvcrt.LK_UNLCK, 1)
+            else:
+                fcntl.flock(f, fcntl.LOCK_UN)
+
+
+def acquire_stream_slot(state: Dict[str, Any], max_streams: int, timeout: int) -> bool:
+    """Wait for a free stream slot, highest priority first
+
+    Queued streams are published with status "queued". A queued stream that
+    outranks the lowest-priority active stream preempts it.
+    """
+    state["status"] = "queued"
+    write_stream_state(state)
+    deadline = time.time() + timeout
+    preempted = set()
+    while True:
+        with stream_slot_lock():
+            streams = [s for s in list_active_streams() if s["pid"] != state["pid"]]
+            active = [s for s in streams if s.get("status") != "queued"]
+            ahead = [s for s in streams if s.get("status") == "queued" and
+                     (-s.get("priority", 0), s["started_at"]) < (-state["priority"], state["started_at"])]
+            if not ahead:
+                if len(active) < max_streams:
+                    state["status"] = "active"
+                    write_stream_state(state)
+                    return True
+
+                victim = min(active, key=lambda s: (s.get("priority", 0), -s["started_at"]))
+                if victim.get("priority", 0) < state["priority"] and victim["pid"] not in preempted:
+                    log(f"Preempting lower priority stream for {victim['mac']} (pid {victim['pid']})")
+                    preempted.add(victim["pid"])
+                    try:
+                        kill_process_tree(int(victim["pid"]))
+                    except (OSError, subprocess.SubprocessError) as e:
+                        log(f"Failed to preempt stream {victim['pid']}: {e}")
+
+        if time.time() >= deadline:
+            clear_stream_state()
+            return False
+        time.sleep(STREAM_QUEUE_POLL)
+
+
+def clear_stream_state():
+    try:
+        os.remove(_stream_file(os.getpid()))
+    except OSError:
+        pass
+
+
+def _stats_file(mac: str) -> str:
+    return os.path.join(STATS_DIR, f"{mac}.json")
+
+
+def load_connection_history(mac: str) -> Dict[str, Any]:
+    """Cumulative connection history for a camera across stream processes"""
+    try:
+        with open(_stats_file(mac)) as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def update_connection_history(mac: str, **changes):
+    """Add to a camera's history counters (connects, failures, crashes, *_total) and set other fields"""
+    history = load_connection_history(mac)
+    for key, value in changes.items():
+        if key.endswith("_total") or key in ("connects", "failures", "crashes", "restarts"):
+            history[key] = history.get(key, 0) + value
+        else:
+            history[key] = value
+    os.makedirs(STATS_DIR, exist_ok=True)
+    path = _stats_file(mac)
+    with open(path + ".tmp", "w") as f:
+        json.dump(history, f)
+    os.replace(path + ".tmp", path)
+
+
+class StreamStats:
+    """Connection quality counters for one stream process
+
+    Live counters go into the stream state file; totals are folded into the
+    camera's history file so reconnects and failures survive process restarts.
+    """
+
+    def __init__(self, mac: str, state: Dict[str, Any]):
+        self.mac = mac
+        self.state = state
+        self.frames = 0
+        self.bytes = 0
+        self.dropped = 0
+        self.last_frame_no: Optional[int] = None
+        self.last_write = 0.0
+        self.video: Optional[Dict[str, Any]] = None
+
+    def _update_history(self, **changes):
+        update_connection_history(self.mac, **changes)
+
+    def connected(self, mode: str, connect_ms: float):
+        self.state.update({"connection_mode": mode, "connected_at": time.time(), "connect_ms": connect_ms})
+        write_stream_state(self.state)
+        self._update_history(connects=1, connect_ms_total=connect_ms, last_connect_ms=connect_ms,
+                             last_connection_mode=mode, last_connected_at=time.time())
+
+    def failed(self, error: str):
+        self._update_history(failures=1, last_error=error, last_error_at=time.time())
+
+    def crashed(self, error: str):
+        self._update_history(crashes=1, last_crash=error, last_crash_at=time.time())
+
+    def frame(self, size: int, frame_no: Optional[int] = None):
+        self.frames += 1
+        self.bytes += size
+        if frame_no is not None:
+            # Gaps in the TUTK frame counter are frames lost between camera and us
+            if self.last_frame_no is not None and frame_no > self.last_frame_no + 1:
+                self.dropped += frame_no - self.last_frame_no - 1
+            self.last_frame_no = frame_no
+
+        now = time.time()
+        if now - self.last_write >= STATS_WRITE_INTERVAL:
+            self.last_write = now
+            self.state.update({"frames": self.frames, "bytes": self.bytes,
+                               "dropped_frames": self.dropped, "last_frame_at": now})
+            write_stream_state(self.state)
+
+    def video_info(self, frame_info: Any, requested_size: int):
+        """Record codec, resolution and fps from the TUTK frame header"""
+        codec = VIDEO_CODECS.get(getattr(frame_info, "codec_id", None), "h264")
+        size = getattr(frame_info, "frame_size", requested_size)
+        width, height = FRAME_RESOLUTIONS.get(size, FRAME_RESOLUTIONS.get(requested_size, (0, 0)))
+        video = {"codec": codec, "width": width, "height": height,
+                 "fps": int(getattr(frame_info, "framerate", 0) or 0)}
+        if video == self.video:
+            return
+        self.video = video
+        log(f"Video: {codec} {width}x{height} @ {video['fps']}fps")
+        self.state["video"] = video
+        write_stream_state(self.state)
+        self._update_history(video=video)
+
+    def finish(self):
+        if self.frames or self.dropped:
+            self._update_history(frames_total=self.frames, dropped_frames_total=self.dropped, bytes_total=self.bytes)
+
+
+def classify_failure(error: Exception) -> str:
+    """Map a stream failure to a RECONNECT_POLICIES class"""
+    if isinstance(error, WyzeApiError):
+        error = error.cause
+    if token_invalid(error):
+        return "auth_expired"
+    code = getattr(error, "code", None)
+    if code in TUTK_AUTH_CODES or "AUTH_FAILED" in str(error):
+        return "auth_expired"
+    if code in TUTK_OFFLINE_CODES:
+        return "device_offline"
+    if code in TUTK_NETWORK_CODES or isinstance(error, OSError):
+        return "network_unreachable"
+    if code in TUTK_DISCONNECT_CODES:
+        return "disconnected"
+    return "error"
+
+
+class ReconnectPolicy:
+    """Reconnect state machine for one stream process
+
+    connecting -> streaming -> backoff -> connecting ... until the camera has
+    gone `window` seconds without a session (given_up). The state is published
+    in the stream state file and the camera's history for the plugin to report.
+    """
+
+    def __init__(self, stats: StreamStats, window: int, max_delay: int):
+        self.stats = stats
+        self.window = window
+        self.max_delay = max_delay
+        self.attempt = 0
+        self.failure = ""
+        self.failing_since: Optional[float] = None
+        self.connected_at: Optional[float] = None
+        self.state = "idle"
+
+    def _set(self, state: str, **extra):
+        self.state = state
+        reconnect = {"state": state, "attempt": self.attempt, "failure": self.failure, **extra}
+        self.stats.state["reconnect"] = reconnect
+        write_stream_state(self.stats.state)
+        self.stats._update_history(reconnect=reconnect)
+
+    def connecting(self):
+        self._set("connecting")
+
+    def connected(self):
+        self.connected_at = time.time()
+        self.failing_since = None
+        self.failure = ""
+        self._set("streaming")
+
+    def failed(self, failure: str) -> Optional[float]:
+        """Record a failure; returns the delay before the next attempt, or None to give up"""
+        now = time.time()
+        if self.connected_at and now - self.connected_at >= RECONNECT_STABLE_SECONDS:
+            self.attempt = 0
+        self.connected_at = None
+        if self.failing_since is None:
+            self.failing_since = now
+        self.failure = failure
+        self.attempt += 1
+        if self.window and now - self.failing_since >= self.window:
+            self._set("given_up", since=self.failing_since)
+            return None
+
+        first, cap = RECONNECT_POLICIES[failure]
+        delay = min(first * 2 ** (self.attempt - 1), cap, self.max_delay)
+        # Spread retries so cameras behind one outage don't reconnect in lockstep
+        delay *= random.uniform(0.8, 1.2)
+        if self.window:
+            delay = min(delay, self.failing_since + self.window - now)
+        self._set("backoff", retry_at=now + delay, since=self.failing_since)
+        return delay
+
+    def stopped(self):
+        if self.state != "given_up":
+            self._set("idle")
+
+
+def session_mode(session: WyzeIOTCSession) -> str:
+    """Report how a TUTK session is routed: lan, p2p or relay"""
+    try:
+        return SESSION_MODES.get(session.session_check().mode, "unknown")
+    except Exception:
+        return "unknown"
+
+
+def stream_mode_by_mac() -> Dict[str, str]:
+    """Connection mode of each running stream, keyed by camera MAC"""
+    return {s["mac"]: s["connection_mode"] for s in list_active_streams() if s.get("connection_mode")}
+
+
+class StreamBackend:
+    """Produces a camera's raw video on stdout for go2rtc and the plugin's own ffmpeg captures
+
+    Backends run `<command> stream <mac>`, read config.json and register in
+    RUN_DIR like the bridge stream, so stream state, stats and drift work the
+    same whichever produced the stream.
+    """
+
+    name = ""
+
+    def unavailable(self) -> str:
+        """Why this backend can't be used, or an empty string"""
+        return ""
+
+    def command(self, mac: str) -> List[str]:
+        raise NotImplementedError
+
+    def stream_url(self, mac: str, codec: str) -> str:
+        return f"exec:{' '.join(self.command(mac))}#video={codec}"
+
+    def stop(self, mac: str):
+        """Stop the camera's running stream; go2rtc reconnects using the current URL"""
+        for stream in list_active_streams():
+            if stream["mac"] == mac:
+                kill_process_tree(int(stream["pid"]))
+
+
+def stream_python() -> str:
+    """Interpreter bridge streams run with: the venv's, else this one, else python3 on PATH"""
+    for candidate in (VENV_PYTHON, sys.executable, shutil.which("python3") or ""):
+        if candidate and os.path.isfile(candidate) and os.access(candidate, os.X_OK):
+            return candidate
+    return ""
+
+
+class BridgeStreamBackend(StreamBackend):
+    """wyze-bridge's Python TUTK stack, run by this script"""
+
+    name = "bridge"
+
+    def __init__(self):
+        self.python = stream_python()
+
+    def unavailable(self) -> str:
+        if not self.python:
+            return f"no Python interpreter for stream processes ({VENV_PYTHON} is missing)"
+        return ""
+
+    def command(self, mac: str) -> List[str]:
+        return [sys.executable or self.python, os.path.abspath(__file__), "stream", mac]
+
+    def stream_url(self, mac: str, codec: str) -> str:
+        # go2rtc runs outside our interpreter, so point it at the venv python
+        return f"exec:{self.python or VENV_PYTHON} {os.path.abspath(__file__)} stream {mac}#video={codec}"
+
+
+class NativeStreamBackend(StreamBackend):
+    """A native TUTK stream binary"""
+
+    name = "native"
+
+    def __init__(self, path: str):
+        self.path = path
+
+    def unavailable(self) -> str:
+        if not self.path:
+            return "native_backend_path is not set"
+        if not os.access(self.path, os.X_OK):
+            return f"{self.path} is not an executable file"
+        return ""
+
+    def command(self, mac: str) -> List[str]:
+        return [self.path, "stream", mac]
+
+
+def stream_video_format(mac: str) -> str:
+    """ffmpeg input format of a stream process's video: the camera's codec, or h264 when it is filtered"""
+    settings = CameraSettingsStore().effective(load_config(), mac)
+    # Rotation, masks, overlays and the stream watermark re-encode to H.264 (see stream_camera)
+    filtered = video_filter(settings, settings.get("name") or mac) or (settings.get("watermark") or {}).get("stream")
+    codec = "h264" if filtered else (load_connection_history(mac).get("video") or {}).get("codec", "h264")
+    return FFMPEG_INPUT_FORMATS.get(codec, "h264")
+
+
+def run_stream_ffmpeg(mac: str, output_args: List[str], timeout: int, command: Optional[List[str]] = None):
+    """Pipe the camera's live P2P stream through ffmpeg with the given output arguments"""
+    stream = spawn_child(
+        command or [sys.executable, os.path.abspath(__file__), "stream", mac],
+        stdout=subprocess.PIPE, env=dict(os.environ, **{VIDEO_ONLY_ENV: "1"}),
+    )
+    ffmpeg = None
+    try:
+        ffmpeg = spawn_child(
+            [
+                "ffmpeg",
+                "-hide_banner",
+                "-loglevel", "error",
+                "-f", stream_video_format(mac),
+                "-i", "pipe:0",
+            ] + output_args,
+            stdin=stream.stdout,
+        )
+        if ffmpeg.wait(timeout=timeout) != 0:
+            raise RuntimeError(f"ffmpeg exited with code {ffmpeg.returncode}")
+    finally:
+        stream.stdout.close()
+        if ffmpeg:
+            stop_child(ffmpeg)
+        stop_child(stream)
+
+
+def capture_stream_snapshot(mac: str, path: str, timeout: int = 45, command: Optional[List[str]] = None):
+    """Grab a single frame from the camera's live P2P stream to path
+
+    A camera that is already streaming hands over its latest keyframe;
+    otherwise a stream is started just for the snapshot.
+    """
+    try:
+        keyframe = stream_control(mac, {"op": "keyframe"})
+    except Exception as e:
+        log(f"Keyframe from running stream failed, opening a new one: {e}")
+        keyframe = None
+    if not keyframe:
+        run_stream_ffmpeg(mac, ["-frames:v", "1", "-y", path], timeout, command)
+        return
+
+    ffmpeg = spawn_child(
+        ["ffmpeg", "-hide_banner", "-loglevel", "error",
+         "-f", FFMPEG_INPUT_FORMATS.get(keyframe["codec"], "h264"), "-i", "pipe:0",
+         "-frames:v", "1", "-y", path],
+        stdin=subprocess.PIPE,
+    )
+    try:
+        ffmpeg.communicate(base64.b64decode(keyframe["keyframe"]), timeout=timeout)
+        if ffmpeg.returncode != 0:
+            raise RuntimeError(f"ffmpeg exited with code {ffmpeg.returncode}")
+    finally:
+        stop_child(ffmpeg)
+
+
+class PersonDetector:
+    """Runs a YOLO-style ONNX model over keyframes and returns person boxes
+
+    The model takes one NCHW float32 RGB image scaled to 0-1 and class 0 is
+    person (COCO order), as exported by the ultralytics tools. Boxes are
+    returned normalized to the frame as [x, y, width, height].
+    """
+
+    def __init__(self, model_path: str, model_format: str = "yolov8", threshold: float = DEFAULT_DETECTION_THRESHOLD):
+        import numpy
+        import onnxruntime
+        self.np = numpy
+        self.session = onnxruntime.InferenceSession(model_path, providers=["CPUExecutionProvider"])
+        shape = self.session.get_inputs()[0].shape
+        self.height = shape[2] if isinstance(shape[2], int) else DETECTION_INPUT_SIZE
+        self.width = shape[3] if isinstance(shape[3], int) else DETECTION_INPUT_SIZE
+        self.input_name = self.session.get_inputs()[0].name
+        self.model_format = model_format
+        self.threshold = threshold
+        self.frames = 0
+        self.inference_ms = 0.0
+
+    def decode(self, keyframe: bytes, codec: str) -> Any:
+        """Decode a keyframe into the model's input tensor"""
+        proc = subprocess.run(
+            ["ffmpeg", "-hide_banner", "-loglevel", "error",
+             "-f", FFMPEG_INPUT_FORMATS.get(codec, "h264"), "-i", "pipe:0", "-frames:v", "1",
+             "-vf", f"scale={self.width}:{self.height}", "-pix_fmt", "rgb24", "-f", "rawvideo", "pipe:1"],
+            input=keyframe, capture_output=True, timeout=10, check=True,
+        )
+        pixels = self.np.frombuffer(proc.stdout, dtype=self.np.uint8)[:self.width * self.height * 3]
+        image = pixels.reshape(self.height, self.width, 3).transpose(2, 0, 1)
+        return (image[None].astype(self.np.float32) / 255.0)
+
+    def detect(self, keyframe: bytes, codec: str) -> List[Dict[str, Any]]:
+        """Person detections (score, box) in a keyframe, best first"""
+        np = self.np
+        tensor = self.decode(keyframe, codec)
+        started = time.monotonic()
+        out = self.session.run(None, {self.input_name: tensor})[0][0]
+        self.inference_ms = (time.monotonic() - started) * 1000
+        self.frames += 1
+
+        if self.model_format == "yolov8":
+            # (4 + classes, anchors): cx, cy, w, h then per-class scores
+            out = out.T if out.shape[0] < out.shape[1] else out
+            scores = out[:, 4]
+        else:
+            # (anchors, 5 + classes): cx, cy, w, h, objectness, per-class scores
+            scores = out[:, 4] * out[:, 5]
+        keep = scores >= self.threshold
+        boxes, scores = out[keep, :4], scores[keep]
+
+        detections = []
+        for i in np.argsort(-scores):
+            cx, cy, w, h = (float(v) for v in boxes[i])
+            box = [(cx - w / 2) / self.width, (cy - h / 2) / self.height, w / self.width, h / self.height]
+            if all(box_iou(box, d["box"]) < DETECTION_NMS_IOU for d in detections):
+                detections.append({"score": round(float(scores[i]), 3), "box": [round(max(v, 0.0), 4) for v in box]})
+            if len(detections) >= MAX_DETECTION_BOXES:
+                break
+        return detections
+
+
+def box_iou(a: List[float], b: List[float]) -> float:
+    """Intersection over union of two [x, y, w, h] boxes"""
+    iw = max(0.0, min(a[0] + a[2], b[0] + b[2]) - max(a[0], b[0]))
+    ih = max(0.0, min(a[1] + a[3], b[1] + b[3]) - max(a[1], b[1]))
+    inter = iw * ih
+    union = a[2] * a[3] + b[2] * b[3] - inter
+    return inter / union if union > 0 else 0.0
+
+
+def capture_stream_preview(mac: str, path: str, fmt: str, duration: int, timeout: int = 60,
+                           command: Optional[List[str]] = None):
+    """Record a short low-fps preview clip (mp4 or animated webp) from the live stream"""
+    args = ["-t", str(duration), "-an", "-vf", f"fps={PREVIEW_FPS},scale={PREVIEW_WIDTH}:-2"]
+    if fmt == "webp":
+        args += ["-c:v", "libwebp", "-loop", "0", "-f", "webp"]
+    else:
+        args += ["-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+                 "-movflags", "+faststart", "-f", "mp4"]
+    tmp_path = path + ".tmp"
+    run_stream_ffmpeg(mac, args + ["-y", tmp_path], timeout + duration, command)
+    os.replace(tmp_path, path)
+
+
+def audio_enabled(config: Dict[str, Any], settings: Dict[str, Any], model: str) -> bool:
+    """Whether a camera's bridge stream carries audio (needs a FIFO, so not on Windows)"""
+    if IS_WINDOWS or not settings.get("audio", config.get("audio", False)):
+        return False
+    return model not in CAMERA_MODELS or "audio" in CAMERA_MODELS[model][2]
+
+
+class AudioMuxer:
+    """Muxes the camera's audio with its video into MPEG-TS on the stream's stdout
+
+    ffmpeg starts with the first session, once the camera has reported its
+    audio codec. Audio reaches it through a FIFO that stays open across
+    reconnects; video is written to it (or comes from the rotation transcoder).
+    """
+
+    def __init__(self, out: Any, video_format: str, video_pipe: Any = None):
+        self.out = out
+        self.video_format = video_format
+        self.video_pipe = video_pipe
+        self.ffmpeg: Optional[subprocess.Popen] = None
+        self.fifo = os.path.join(RUN_DIR, f"audio-{os.getpid()}.pipe")
+        self.fifo_fd: Optional[int] = None
+        self.codec = ""
+
+    def attach(self, session: WyzeIOTCSession):
+        """Start ffmpeg on the first session, then feed it this session's audio"""
+        try:
+            codec, rate = session.get_audio_codec()
+        except Exception as e:
+            log(f"Camera reported no audio codec: {e}")
+            codec, rate = "", 0
+        if self.ffmpeg is None:
+            self._start(codec, rate)
+        elif codec != self.codec:
+            log(f"Audio codec changed from {self.codec} to {codec}; restart the stream to pick it up")
+            return
+        if self.fifo_fd is not None:
+            threading.Thread(target=self._pump, args=(session,), daemon=True).start()
+
+    def _start(self, codec: str, rate: int):
+        self.codec = codec
+        fmt = AUDIO_INPUT_FORMATS.get(codec)
+        audio_input = ["-f", "lavfi", "-i", "anullsrc=channel_layout=mono:sample_rate=16000"]
+        if fmt:
+            os.makedirs(RUN_DIR, exist_ok=True)
+            os.mkfifo(self.fifo)
+            # Read-write so opening doesn't wait for ffmpeg, which reads the video input first
+            self.fifo_fd = os.open(self.fifo, os.O_RDWR)
+            raw = ["-ar", str(rate), "-ac", "1"] if fmt != "aac" else []
+            audio_input = ["-f", fmt] + raw + ["-use_wallclock_as_timestamps", "1", "-i", self.fifo]
+            log(f"Muxing {codec} audio into the stream")
+        else:
+            log(f"Audio codec {codec or 'unknown'} is not supported, sending silence")
+        self.ffmpeg = spawn_child(
+            ["ffmpeg", "-hide_banner", "-loglevel", "error",
+             "-use_wallclock_as_timestamps", "1", "-f", self.video_format, "-i", "pipe:0"] + audio_input +
+            ["-map", "0:v", "-map", "1:a", "-c:v", "copy", "-c:a", "aac",
+             "-max_interleave_delta", "500000", "-f", "mpegts", "pipe:1"],
+            stdin=self.video_pipe or subprocess.PIPE, stdout=self.out,
+        )
+
+    def _pump(self, session: WyzeIOTCSession):
+        try:
+            for frame in session.recv_audio_data():
+                if isinstance(frame, tuple):
+                    frame = frame[0]
+                if frame:
+                    os.write(self.fifo_fd, frame)
+        except Exception as e:
+            log(f"Audio from the session stopped: {e}", "debug")
+
+    def write(self, data: bytes):
+        if self.ffmpeg and self.ffmpeg.stdin:
+            self.ffmpeg.stdin.write(data)
+
+    def flush(self):
+        if self.ffmpeg and self.ffmpeg.stdin:
+            self.ffmpeg.stdin.flush()
+
+    def close(self):
+        if self.ffmpeg:
+            try:
+                if self.ffmpeg.stdin:
+                    self.ffmpeg.stdin.close()
+            except OSError:
+                pass
+            stop_child(self.ffmpeg)
+        if self.fifo_fd is not None:
+            os.close(self.fifo_fd)
+            try:
+                os.remove(self.fifo)
+            except OSError:
+                pass
+
+
+class KeepaliveWriter:
+    """A stream's output that repeats the last keyframe while the camera sends nothing
+
+    Consumers that drop a silent source (RTSP servers timing out during a
+    camera reconnect) see one continuous stream; the first keyframe of the
+    new session splices the live video back in.
+    """
+
+    def __init__(self, out: Any, control: StreamControlServer):
+        self.out = out
+        self.control = control
+        self.lock = threading.Lock()
+        self.last_write = time.monotonic()
+        self.repeating = False
+        threading.Thread(target=self._run, daemon=True).start()
+
+    def write(self, data: bytes):
+        with self.lock:
+            self.out.write(data)
+            self.last_write = time.monotonic()
+            if self.repeating:
+                self.repeating = False
+                log("Camera video resumed, keepalive stopped")
+
+    def flush(self):
+        with self.lock:
+            self.out.flush()
+
+    def _run(self):
+        while True:
+            time.sleep(KEEPALIVE_INTERVAL)
+            keyframe = self.control.keyframe
+            with self.lock:
+                if not keyframe or time.monotonic() - self.last_write < KEEPALIVE_IDLE:
+                    continue
+                if not self.repeating:
+                    self.repeating = True
+                    log("No video from the camera, repeating the last keyframe")
+                try:
+                    self.out.write(keyframe)
+                    self.out.flush()
+                except (OSError, ValueError):
+                    return
+
+
+def stream_session(iotc: WyzeIOTC, auth: WyzeAuth, camera: wyzecam.WyzeCamera, frame_size: int,
+                   bitrate: int, net_mode: str, attempts: int, stats: StreamStats,
+                   policy: ReconnectPolicy, control: StreamControlServer, out: Any,
+                   audio: Optional[AudioMuxer] = None) -> str:
+    """Run one TUTK session, writing frames to out until it ends
+
+    Returns the failure class that ended it, for the reconnect policy.
+    """
+    for attempt in range(1, attempts + 1):
+        log(f"Starting TUTK P2P connection (timeout=30s, net_mode={net_mode}, attempt {attempt}/{attempts})...")
+        connect_started = time.monotonic()
+        with WyzeIOTCSession(
+            iotc.tutk_platform_lib,
+            auth.account,
+            camera,
+            frame_size=frame_size,
+            bitrate=bitrate,
+            connect_timeout=30,  # Increase timeout from default 20s
+        ) as session:
+            mode = session_mode(session)
+            allowed = NET_MODE_ALLOWED[net_mode]
+            if mode not in allowed and net_mode != "any":
+                if net_mode == "prefer_lan" and attempt == attempts:
+                    log(f"No LAN route to {camera.nickname}, falling back to {mode}")
+                else:
+                    log(f"Connected to {camera.nickname} via {mode}, net_mode={net_mode} requires {'/'.join(allowed)}")
+                    continue
+
+            log(f"Connected to {camera.nickname} via {mode}, starting stream...")
+            stats.connected(mode, round((time.monotonic() - connect_started) * 1000, 1))
+            policy.connected()
+            # Camera commands and stream snapshots from the plugin share this session
+            control.attach(session)
+            if audio:
+                audio.attach(session)
+            try:
+                # Stream video frames to stdout
+                # recv_video_data yields raw H264 NAL units, with frame info on newer wyzecam
+                for frame in session.recv_video_data():
+                    frame_info = None
+                    if isinstance(frame, tuple):
+                        frame, frame_info = frame
+                    if frame:
+                        if stats.video is None or getattr(frame_info, "is_keyframe", False):
+                            stats.video_info(frame_info, frame_size)
+                        if getattr(frame_info, "is_keyframe", False):
+                            control.keyframe = frame
+                            control.codec = stats.video["codec"]
+                        stats.frame(len(frame), getattr(frame_info, "frame_no", None))
+                        # Output raw H264 data to stdout
+                        out.write(frame)
+                        out.flush()
+            finally:
+                control.detach()
+            log(f"Session with {camera.nickname} ended")
+            return "disconnected"
+
+    log(f"No connection to {camera.nickname} satisfied net_mode={net_mode}")
+    stats.failed(f"no route allowed by net_mode={net_mode}")
+    return "network_unreachable"
+
+
+def stream_supervised(config: Dict[str, Any]) -> bool:
+    """Whether this stream process should supervise a worker instead of streaming itself"""
+    return bool(config.get("stream_supervisor", True)) and not IS_WINDOWS \
+        and not os.environ.get(STREAM_WORKER_ENV) and not os.environ.get(VIDEO_ONLY_ENV)
 
-        # Get cameras
-        camera_list = wyzecam.get_camera_list(self.auth_info)
-        for camera in camera_list:
-            self.cameras[camera.mac] = camera
-            log(f"Found camera: {camera.nickname} ({camera.mac}) - {camera.product_model}")
 
-        # Save to cache
-        save_auth_cache(self.auth_info, self.account, self.cameras)
+def supervise_stream(mac: str, config: Dict[str, Any]) -> int:
+    """Run the stream in a worker process, restarting it when it dies unexpectedly
 
-        return self
+    The worker inherits stdout, so go2rtc's pipe stays open across restarts.
+    A worker that exits on its own (gave up, consumer gone) or is stopped with
+    SIGTERM (stream restarts, backend migration) ends the supervisor too, and
+    go2rtc reconnects as before. One that crashed on an unhandled error or was
+    killed by another signal is restarted with exponential backoff and jitter.
+    Kills are recorded as crashes in the camera's history, which the plugin
+    reports as camera.stream_crashed.
+    """
+    stopping = threading.Event()
+    worker: Optional[subprocess.Popen] = None
 
-    def get_camera(self, mac: str) -> Optional[wyzecam.WyzeCamera]:
-        """Get a camera by MAC address"""
-        return self.cameras.get(mac)
+    def stop(signum, frame):
+        stopping.set()
+        if worker and worker.poll() is None:
+            worker.terminate()
+
+    signal.signal(signal.SIGTERM, stop)
+    signal.signal(signal.SIGINT, stop)
+    delay = SUPERVISOR_BACKOFF[0]
+    while True:
+        crashes = load_connection_history(mac).get("crashes", 0)
+        started = time.monotonic()
+        worker = subprocess.Popen([sys.executable, os.path.abspath(__file__), "stream", mac],
+                                  env=dict(os.environ, **{STREAM_WORKER_ENV: "1"}))
+        code = worker.wait()
+        if stopping.is_set():
+            return 0
+        history = load_connection_history(mac)
+        if code < 0 and -code not in (signal.SIGTERM, signal.SIGINT):
+            name = signal.Signals(-code).name
+            reason = f"killed by {name}" + (" (out of memory?)" if -code == signal.SIGKILL else "")
+            update_connection_history(mac, crashes=1, last_crash=reason, last_crash_at=time.time())
+        elif history.get("crashes", 0) > crashes:
+            reason = f"crashed with {history.get('last_crash') or f'exit code {code}'}"
+        else:
+            return max(code, 0)
+
+        if time.monotonic() - started >= SUPERVISOR_STABLE_SECONDS:
+            delay = SUPERVISOR_BACKOFF[0]
+        wait = jittered(delay, config)
+        delay = min(delay * 2, SUPERVISOR_BACKOFF[1])
+        log(f"Stream worker for {mac} {reason}, restarting in {wait:.1f}s")
+        update_connection_history(mac, restarts=1, last_restart_at=time.time())
+        if stopping.wait(wait):
+            return 0
 
 
 def stream_camera(mac: str):
@@ -210,6 +4594,7 @@ def stream_camera(mac: str):
     if not config:
         log("No configuration found. Initialize the plugin first.")
         sys.exit(1)
+    configure_dns(config)
 
     auth = WyzeAuth(config)
     try:
@@ -224,21 +4609,50 @@ def stream_camera(mac: str):
         log(f"Available cameras: {list(auth.cameras.keys())}")
         sys.exit(1)
 
+    if config.get("cloud_only", False):
+        log("Streaming is disabled in cloud-only mode")
+        sys.exit(1)
+
+    low_resource = bool(config.get("low_resource", False))
+
     log(f"Connecting to {camera.nickname}...")
-    log(f"Camera p2p_id={getattr(camera, 'p2p_id', 'N/A')}, model={camera.product_model}")
-    log(f"Camera dtls={getattr(camera, 'dtls', 'N/A')}, parent_dtls={getattr(camera, 'parent_dtls', 'N/A')}")
-    log(f"Camera enr={getattr(camera, 'enr', 'N/A')[:8] if hasattr(camera, 'enr') and camera.enr else 'N/A'}...")
+    if not low_resource:
+        log(f"Camera p2p_id={getattr(camera, 'p2p_id', 'N/A')}, model={camera.product_model}", "debug", "bridge")
+        log(f"Camera dtls={getattr(camera, 'dtls', 'N/A')}, parent_dtls={getattr(camera, 'parent_dtls', 'N/A')}",
+            "debug", "bridge")
+        log(f"Camera enr={getattr(camera, 'enr', 'N/A')[:8] if hasattr(camera, 'enr') and camera.enr else 'N/A'}...",
+            "debug", "bridge")
 
     # Check required camera fields
     if not getattr(camera, 'p2p_id', None):
-        log(f"ERROR: Camera {camera.nickname} missing p2p_id - cannot connect via P2P")
+        log(f"Camera {camera.nickname} missing p2p_id - cannot connect via P2P", "error", "bridge")
         sys.exit(1)
     if not getattr(camera, 'enr', None):
-        log(f"ERROR: Camera {camera.nickname} missing enr - cannot authenticate")
+        log(f"Camera {camera.nickname} missing enr - cannot authenticate", "error", "bridge")
+        sys.exit(1)
+
+    settings = CameraSettingsStore().effective(config, mac)
+    ingestion = settings.get("ingestion", config.get("ingestion", "continuous"))
+    if ingestion == "disabled":
+        log(f"Ingestion is disabled for {camera.nickname}")
         sys.exit(1)
+    if ingestion == "event_only" and (read_wake(mac) or 0) < time.time():
+        log(f"{camera.nickname} is event_only and no motion/doorbell event is active")
+        sys.exit(1)
+
+    state = {"pid": os.getpid(), "mac": mac, "started_at": time.time(),
+             "priority": int(settings.get("priority", 0)), "config_hash": config_hash(config, settings)}
+
+    # Cap concurrent camera connections, queueing by priority
+    max_streams = int(config.get("max_concurrent_streams", LOW_RESOURCE_MAX_STREAMS if low_resource else 0))
+    if max_streams > 0:
+        timeout = int(config.get("stream_queue_timeout", DEFAULT_STREAM_QUEUE_TIMEOUT))
+        if not acquire_stream_slot(state, max_streams, timeout):
+            log(f"Stream limit reached ({max_streams}), {camera.nickname} gave up after queueing {timeout}s")
+            sys.exit(1)
 
     # Get TUTK library
-    tutk_lib = get_tutk_library()
+    tutk_lib = get_tutk_library(config)
     if not tutk_lib:
         log("Failed to get TUTK library")
         sys.exit(1)
@@ -255,13 +4669,23 @@ def stream_camera(mac: str):
     iotc.initialize()
 
     # Determine quality settings
+    quality = settings.get("quality", "auto")
+    fallback = load_quality_fallbacks().get(mac)
+    if fallback and quality != "sd":
+        log(f"Adaptive quality fallback active ({fallback.get('reason', 'poor connection')}), using SD")
+        quality = "sd"
     frame_size = FRAME_SIZE_1080P
     bitrate = 120
-    if camera.product_model in ("WYZECP1", "HL_CAM3P", "WYZE_CAKP2JFUS"):
-        # Pan cameras and newer models support 2K
-        if hasattr(camera, 'is_2k') and camera.is_2k:
-            frame_size = FRAME_SIZE_2K
-            bitrate = 180
+    if low_resource or quality == "sd":
+        # Substream quality
+        frame_size = FRAME_SIZE_360P
+        bitrate = SD_BITRATE
+    elif quality == "hd":
+        pass
+    elif camera.product_model in HIGH_RES_MODELS or getattr(camera, 'is_2k', False):
+        # 2K/2.5K models (and anything the API reports as 2K) get the high-res stream
+        frame_size = FRAME_SIZE_2K
+        bitrate = 180
 
     log(f"Using frame_size={frame_size}, bitrate={bitrate}")
 
@@ -283,116 +4707,2911 @@ def stream_camera(mac: str):
     # Let's output raw H264 directly - go2rtc can handle h264 raw streams
     # via exec:ffmpeg ... -f h264 pipe: format
 
+    net_mode = settings.get("net_mode") or config.get("net_mode", "any")
+    if net_mode not in NET_MODES:
+        log(f"Unknown net_mode {net_mode}, using any")
+        net_mode = "any"
+    attempts = PREFER_LAN_ATTEMPTS if net_mode == "prefer_lan" else 1
+
+    state["net_mode"] = net_mode
+    state["status"] = "active"
+    vf = video_filter(settings, settings.get("name") or camera.nickname)
+    if (settings.get("watermark") or {}).get("stream"):
+        vf = ",".join(f for f in (vf, watermark_filter(settings)) if f)
+    # Raw keyframes would skip the rotation/overlay filter, so filtered streams don't share them
+    control = StreamControlServer(state, share_keyframes=not vf)
+    write_stream_state(state)
+    stats = StreamStats(mac, state)
+
+    # Rotated/flipped cameras are re-encoded by ffmpeg writing to our stdout (or to the audio muxer)
+    out = sys.stdout.buffer
+    transcoder = None
+    audio = None
+    codec = (load_connection_history(mac).get("video") or {}).get("codec", "h264")
+    with_audio = audio_enabled(config, settings, camera.product_model) and not os.environ.get(VIDEO_ONLY_ENV)
+    if vf:
+        log(f"Applying video filter {vf}")
+        try:
+            transcoder = spawn_child(
+                [
+                    "ffmpeg", "-hide_banner", "-loglevel", "error",
+                    "-f", FFMPEG_INPUT_FORMATS.get(codec, "h264"), "-i", "pipe:0",
+                    "-vf", vf,
+                    "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+                    "-f", "h264", "pipe:1",
+                ],
+                stdin=subprocess.PIPE,
+                stdout=subprocess.PIPE if with_audio else None,
+            )
+        except OSError as e:
+            log(f"Failed to start ffmpeg for rotation: {e}")
+            clear_stream_state()
+            sys.exit(1)
+        out = transcoder.stdin
+    if with_audio:
+        audio = AudioMuxer(sys.stdout.buffer, "h264" if transcoder else FFMPEG_INPUT_FORMATS.get(codec, "h264"),
+                           transcoder.stdout if transcoder else None)
+        if not transcoder:
+            out = audio
+    if settings.get("keepalive", config.get("stream_keepalive", False)):
+        out = KeepaliveWriter(out, control)
+
+    policy = ReconnectPolicy(stats, int(config.get("reconnect_window", DEFAULT_RECONNECT_WINDOW)),
+                             int(config.get("reconnect_max_delay", DEFAULT_RECONNECT_MAX_DELAY)))
+    relogin = False
     try:
-        log("Starting TUTK P2P connection (timeout=30s)...")
-        with WyzeIOTCSession(
-            iotc.tutk_platform_lib,
-            auth.account,
-            camera,
-            frame_size=frame_size,
-            bitrate=bitrate,
-            connect_timeout=30,  # Increase timeout from default 20s
-        ) as session:
-            log(f"Connected to {camera.nickname}, starting stream...")
+        while True:
+            policy.connecting()
+            try:
+                if relogin:
+                    log("Refreshing Wyze credentials before reconnecting")
+                    auth.login(use_cache=False)
+                    camera = auth.get_camera(mac) or camera
+                    relogin = False
+                failure = stream_session(iotc, auth, camera, frame_size, bitrate, net_mode, attempts,
+                                         stats, policy, control, out, audio)
+            except (BrokenPipeError, KeyboardInterrupt):
+                raise
+            except Exception as e:
+                failure = classify_failure(e)
+                stats.failed(f"{type(e).__name__}: {e}")
+                # Log error details on separate lines to avoid truncation
+                log(f"Stream error type: {type(e).__name__}")
+                log(f"Stream error message: {str(e)}")
+                # Log traceback lines individually
+                for line in traceback.format_exception(e):
+                    for subline in line.strip().split('\n'):
+                        if subline.strip():
+                            log(f"  {subline}")
+
+            delay = policy.failed(failure)
+            if delay is None:
+                log(f"Giving up on {camera.nickname} after {policy.attempt} attempts ({failure})")
+                break
+            relogin = failure == "auth_expired"
+            log(f"Reconnecting to {camera.nickname} in {delay:.0f}s ({failure}, attempt {policy.attempt})")
+            time.sleep(delay)
+
+    except BrokenPipeError:
+        log("Stream consumer went away")
+    except KeyboardInterrupt:
+        log("Stream interrupted")
+    except Exception as e:
+        stats.crashed(f"{type(e).__name__}: {e}")
+        raise
+    finally:
+        control.close()
+        policy.stopped()
+        stats.finish()
+        clear_stream_state()
+        if transcoder:
+            try:
+                transcoder.stdin.close()
+            except OSError:
+                pass
+            stop_child(transcoder)
+        if audio:
+            audio.close()
+        try:
+            iotc.deinitialize()
+        except:
+            pass
+
+    log("Stream ended")
+
+
+# JSON Schema definitions shared by method params and results
+_CAMERA_ID = {"type": "string", "description": "Camera MAC address"}
+_TIMESTAMP = {"type": "string", "format": "date-time"}
+_LOCAL_TIME_NOTE = "Times without an offset are in the configured timezone"
+
+API_SCHEMA_COMPONENTS: Dict[str, Any] = {
+    "PluginCamera": {
+        "type": "object",
+        "properties": {
+            "id": _CAMERA_ID,
+            "plugin_id": {"type": "string"},
+            "name": {"type": "string"},
+            "model": {"type": "string"},
+            "manufacturer": {"type": "string"},
+            "host": {"type": "string"},
+            "main_stream": {"type": "string"},
+            "sub_stream": {"type": "string"},
+            "snapshot_url": {"type": "string"},
+            "snapshot_mode": {"type": "string", "enum": list(SNAPSHOT_MODES)},
+            "video_codec": {"type": "string", "enum": sorted(set(VIDEO_CODECS.values()))},
+            "width": {"type": "integer", "description": "0 until the camera has been streamed once"},
+            "height": {"type": "integer"},
+            "fps": {"type": "integer"},
+            "audio_codec": {"type": "string", "description": "Empty when the stream has no audio"},
+            "capabilities": {"type": "array", "items": {"type": "string"}},
+            "online": {"type": "boolean"},
+            "removed_from_account": {"type": "boolean"},
+            "connection_mode": {"type": "string", "enum": ["", "lan", "p2p", "relay", "unknown"],
+                                "description": "Route of the active stream, empty when not streaming"},
+            "ingestion": {"type": "string", "enum": list(INGESTION_PROFILES)},
+            "stream_backend": {"type": "string", "enum": list(STREAM_BACKENDS), "description": "Backend producing main_stream"},
+            "armed": {"type": "boolean", "description": "NVR arm state from set_arm_state"},
+            "subscription": {"type": "string", "enum": [p for p in SUBSCRIPTION_PLANS if p != "auto"] + ["unknown"],
+                             "description": "Wyze plan, see get_subscriptions"},
+            "tags": {"type": "array", "items": {"type": "string"}, "description": "User-defined, from the camera settings"},
+            "metadata": {"type": "object", "description": "User-defined key/value pairs, from the camera settings"},
+            "last_seen": _TIMESTAMP,
+        },
+    },
+    "DiscoveredCamera": {
+        "type": "object",
+        "properties": {
+            "id": _CAMERA_ID,
+            "name": {"type": "string"},
+            "model": {"type": "string"},
+            "model_name": {"type": "string"},
+            "model_known": {"type": "boolean", "description": "False for models this plugin has not been verified with"},
+            "max_resolution": {"type": "string", "enum": ["", "1080p", "2k", "2.5k"]},
+            "manufacturer": {"type": "string"},
+            "host": {"type": "string"},
+            "capabilities": {"type": "array", "items": {"type": "string"}},
+            "firmware_version": {"type": "string"},
+            "serial": {"type": "string"},
+            "ping": {"type": "object", "description": "start_discovery with probe only",
+                     "properties": {"reachable": {"type": "boolean"}, "rtt_ms": {"type": ["number", "null"]}}},
+        },
+    },
+    "LogLevels": {
+        "type": "object",
+        "properties": {
+            "levels": {"type": "object", "description": "default plus per-component overrides",
+                       "additionalProperties": {"type": "string", "enum": list(LOG_LEVELS)}},
+            "revert_at": {"type": ["string", "null"], "format": "date-time"},
+        },
+    },
+    "CameraSetupOutcome": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "name": {"type": "string"},
+            "reason": {"type": "string", "enum": ["not_in_camera_list", "excluded_by_filter", "removed",
+                                                  "invalid_settings", "missing_p2p_credentials", "not_in_account"]},
+            "message": {"type": "string"},
+        },
+    },
+    "RemovedCamera": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "name": {"type": "string"},
+            "model": {"type": "string"},
+            "reason": {"type": "string", "enum": ["removed", "removed_from_account"],
+                       "description": "remove_camera, or auto_remove_cameras after it left the Wyze account"},
+            "removed_at": _TIMESTAMP,
+            "expires_at": dict(_TIMESTAMP, description="When its settings and history are purged"),
+            "on_account": {"type": "boolean", "description": "Still on the Wyze account, so it can be restored"},
+            "settings": {"$ref": "#/components/schemas/CameraSettings"},
+        },
+    },
+    "CameraSettings": {
+        "type": "object",
+        "properties": {
+            "name": {"type": "string"},
+            "snapshot_mode": {"type": "string", "enum": list(SNAPSHOT_MODES)},
+            "snapshot_interval": {"type": "integer", "minimum": 0},
+            "quality": {"type": "string", "enum": list(STREAM_QUALITIES)},
+            "net_mode": {"type": "string", "enum": list(NET_MODES)},
+            "adaptive_quality": {"type": "boolean"},
+            "priority": {"type": "integer", "description": "Higher connects first when streams are capped"},
+            "rotate": {"type": "integer", "enum": list(ROTATIONS), "description": "Clockwise degrees"},
+            "flip": {"type": "string", "enum": list(FLIPS)},
+            "watermark": {"type": "object", "description": "Label and UTC time burned into snapshots and optionally the restream",
+                          "properties": {
+                              "label": {"type": "string", "maxLength": MAX_WATERMARK_LABEL},
+                              "snapshots": {"type": "boolean", "default": True},
+                              "stream": {"type": "boolean", "default": False},
+                          }},
+            "privacy_masks": {"type": "array", "maxItems": MAX_PRIVACY_MASKS,
+                              "description": "Blacked-out rectangles in fractions of the unrotated frame",
+                              "items": {"type": "object", "required": ["x", "y", "w", "h"], "properties": {
+                                  "x": {"type": "number", "minimum": 0, "maximum": 1},
+                                  "y": {"type": "number", "minimum": 0, "maximum": 1},
+                                  "w": {"type": "number", "minimum": 0, "maximum": 1},
+                                  "h": {"type": "number", "minimum": 0, "maximum": 1},
+                              }}},
+            "osd_name": {"type": "boolean", "description": "Burn the camera name into the restream"},
+            "audio": {"type": "boolean", "description": "Mux the camera's audio into the stream as AAC in MPEG-TS "
+                                                        "(default audio config)"},
+            "keepalive": {"type": "boolean", "description": "Repeat the last keyframe while the camera reconnects "
+                                                            "(default stream_keepalive)"},
+            "ingestion": {"type": "string", "enum": list(INGESTION_PROFILES)},
+            "subscription": {"type": "string", "enum": list(SUBSCRIPTION_PLANS),
+                             "description": "The camera's Wyze plan; auto infers it from AI-tagged events"},
+            "stream_backend": {"type": "string", "enum": list(STREAM_BACKENDS),
+                               "description": "Overrides the deployment's stream_backend; prefer migrate_stream_backend"},
+            "ingestion_cooldown": {"type": "integer", "minimum": 1, "description": "Seconds an event_only camera streams after an event"},
+            "event_polling": {"type": "boolean", "description": "Poll this camera's Wyze cloud events "
+                                                                "(default event_polling; event_only is always polled)"},
+            "event_poll_interval": {"type": "integer", "minimum": INTERVAL_BOUNDS["event_poll_interval"][0],
+                                    "maximum": INTERVAL_BOUNDS["event_poll_interval"][1],
+                                    "description": "Seconds between event polls (default event_poll_interval)"},
+            "local_detection": {"type": "boolean", "description": "Run local person detection on this camera (default true when enabled globally)"},
+            "event_merge_window": {"oneOf": [
+                {"type": "integer", "minimum": 0, "maximum": MAX_EVENT_MERGE_WINDOW},
+                {"type": "object", "additionalProperties": {"type": "integer", "minimum": 0, "maximum": MAX_EVENT_MERGE_WINDOW}},
+            ], "description": "Seconds for merging overlapping events, or per event type (with a default key)"},
+            "correlate": {"type": "boolean", "description": "Include this camera's events in cross-camera incidents (default true)"},
+            "event_rate_limit": {"type": "integer", "minimum": 0, "maximum": MAX_EVENT_RATE_LIMIT,
+                                 "description": "camera.events per minute before the rest are summarized (0 = no limit)"},
+            "tags": {"type": "array", "maxItems": MAX_CAMERA_TAGS,
+                     "items": {"type": "string", "minLength": 1, "maxLength": MAX_TAG_LENGTH}},
+            "metadata": {"type": "object", "maxProperties": MAX_CAMERA_METADATA,
+                         "additionalProperties": {"type": ["string", "number", "boolean"]}},
+        },
+        "additionalProperties": True,
+    },
+    "CameraConfig": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "overrides": {"$ref": "#/components/schemas/CameraSettings"},
+            "effective": {"$ref": "#/components/schemas/CameraSettings"},
+        },
+    },
+    "ConnectionStats": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "streaming": {"type": "boolean"},
+            "queued": {"type": "boolean", "description": "Waiting for a slot under max_concurrent_streams"},
+            "connection_mode": {"type": "string"},
+            "connect_latency_ms": {"type": ["number", "null"]},
+            "avg_connect_latency_ms": {"type": ["number", "null"]},
+            "connects": {"type": "integer"},
+            "reconnects": {"type": "integer"},
+            "failures": {"type": "integer"},
+            "last_error": {"type": "string"},
+            "last_error_at": {"type": ["string", "null"], "format": "date-time"},
+            "crashes": {"type": "integer", "description": "Stream processes that crashed or were killed"},
+            "restarts": {"type": "integer", "description": "Crashed stream workers restarted by the supervisor"},
+            "last_crash": {"type": "string"},
+            "fps": {"type": "number"},
+            "uptime_seconds": {"type": "integer"},
+            "frames": {"type": "integer"},
+            "dropped_frames": {"type": "integer"},
+            "drop_rate": {"type": "number"},
+            "quality_fallback": {"type": ["object", "null"], "properties": {
+                "quality": {"type": "string"},
+                "reason": {"type": "string"},
+                "since": _TIMESTAMP,
+                "retry_at": _TIMESTAMP,
+            }},
+            "reconnect": {"type": "object", "properties": {
+                "state": {"type": "string", "enum": ["idle", "connecting", "streaming", "backoff", "given_up"]},
+                "attempt": {"type": "integer"},
+                "failure": {"type": "string", "enum": [""] + list(RECONNECT_POLICIES)},
+                "failing_since": {"type": ["string", "null"], "format": "date-time"},
+                "retry_at": {"type": ["string", "null"], "format": "date-time"},
+            }},
+        },
+    },
+    "ConfigDrift": {
+        "type": "object",
+        "properties": {
+            "drifted": {"type": "boolean"},
+            "config_file": {"type": "boolean", "description": "config.json differs from the applied configuration"},
+            "streams": {"type": "array", "items": _CAMERA_ID, "description": "Streams started with an older configuration"},
+            "expected_hash": {"type": "string"},
+        },
+    },
+    "OSDState": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "timestamp": {"type": "boolean", "description": "Camera-rendered date/time overlay"},
+            "logo": {"type": "boolean", "description": "Camera-rendered Wyze watermark"},
+            "name_overlay": {"type": "boolean", "description": "Camera name burned into the restream by ffmpeg"},
+        },
+    },
+    "DailySummary": {
+        "type": "object",
+        "properties": {
+            "date": {"type": "string", "format": "date"},
+            "timezone": {"type": "string"},
+            "final": {"type": "boolean", "description": "false while the day is still running"},
+            "sampled_seconds": {"type": "integer", "description": "How long the plugin was running that day"},
+            "cameras": {"type": "array", "items": {"type": "object", "properties": {
+                "camera_id": {"type": "string"},
+                "name": {"type": "string"},
+                "streaming_seconds": {"type": "integer"},
+                "uptime_percent": {"type": ["number", "null"], "description": "Of sampled_seconds"},
+                "disconnects": {"type": "integer", "description": "Stream failures"},
+                "events": {"type": "object", "additionalProperties": {"type": "integer"},
+                           "description": "camera.event count by type"},
+                "events_total": {"type": "integer"},
+                "bytes_streamed": {"type": "integer"},
+                "average_bitrate_kbps": {"type": ["number", "null"]},
+            }}},
+        },
+    },
+    "ArmState": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "armed": {"type": "boolean"},
+            "synced": {"type": "boolean", "description": "The camera's detection was switched by this call, "
+                                                         "without errors"},
+            "camera_detection": {"type": "object", "properties": {
+                "motion_detection": {"type": ["boolean", "null"], "description": "null when unreadable"},
+                "notifications": {"type": ["boolean", "null"]},
+                "errors": {"type": "array", "items": {"type": "string"}},
+            }},
+            "restore": {"type": "object", "description": "Camera switches that were on when disarmed, "
+                                                         "turned back on when armed",
+                        "properties": {"motion_detection": {"type": "boolean"},
+                                       "notifications": {"type": "boolean"}}},
+            "sync_errors": {"type": "array", "items": {"type": "string"}},
+        },
+    },
+    "Capabilities": {
+        "type": "object",
+        "properties": {
+            "protocol_version": {"type": "string"},
+            "version": {"type": "string"},
+            "compatible": {"type": ["boolean", "null"],
+                           "description": "Whether the host's protocol_version is compatible; null when not given"},
+            "methods": {"type": "object", "additionalProperties": {"type": "object", "properties": {
+                "scope": {"type": ["string", "null"], "enum": list(SCOPES) + [None]},
+                "capability": {"type": "string", "description": "Camera capability the method needs"},
+            }}},
+            "notifications": {"type": "array", "items": {"type": "string"}},
+            "camera_capabilities": {"type": "array", "items": {"type": "string"},
+                                    "description": "Capabilities any supported camera model can report"},
+            "camera_models": {"type": "array", "items": {"type": "string"}},
+            "stream_backends": {"type": "array", "items": {"type": "string", "enum": list(STREAM_BACKENDS)}},
+            "features": {"type": "object", "additionalProperties": {"type": "boolean"},
+                         "description": "Optional features this build has, and whether each is enabled"},
+        },
+    },
+    "PluginInfo": {
+        "type": "object",
+        "properties": {
+            "version": {"type": "string", "description": "From manifest.yaml"},
+            "protocol_version": {"type": "string"},
+            "git_commit": {"type": "string", "description": "Empty unless installed from a git checkout"},
+            "build_date": {"type": "string", "format": "date-time",
+                           "description": "When wyze_plugin.py was installed or updated; there is no build step"},
+            "runtime": {"type": "object", "properties": {
+                "python": {"type": "string"},
+                "implementation": {"type": "string"},
+                "executable": {"type": "string"},
+                "stream_python": {"type": "string", "description": "Interpreter go2rtc runs bridge streams with"},
+            }},
+            "os": {"type": "string"},
+            "os_release": {"type": "string"},
+            "arch": {"type": "string"},
+            "bridge": {"type": "object", "properties": {
+                "source": {"type": "string", "description": "bridge_repo@bridge_ref assets are downloaded from"},
+                "wyzecam_source": {"type": "string"},
+                "commit": {"type": "string", "description": "Checked-out wyze-bridge submodule, if any"},
+            }},
+            "ffmpeg": {"type": "string", "description": "Empty when ffmpeg is not on the PATH"},
+            "tutk_library": {"type": "string", "description": "Path of the loaded TUTK library"},
+            "stream_backends": {"type": "object", "additionalProperties": {"type": "boolean"},
+                                "description": "Backend -> available"},
+        },
+    },
+    "PortManifest": {
+        "type": "object",
+        "properties": {
+            "plugin": {"type": "string"},
+            "pid": {"type": "integer"},
+            "path": {"type": "string", "description": "Where the manifest is written"},
+            "updated_at": _TIMESTAMP,
+            "listeners": {"type": "array", "items": {"type": "object", "properties": {
+                "name": {"type": "string", "enum": ["rest_api", "healthz", "stream_control"]},
+                "kind": {"type": "string", "enum": ["web", "metrics", "control"]},
+                "protocol": {"type": "string"},
+                "host": {"type": "string"},
+                "port": {"type": "integer"},
+                "ephemeral": {"type": "boolean", "description": "Picked by the OS and changes with each stream"},
+                "camera_id": _CAMERA_ID,
+                "pid": {"type": "integer"},
+                "purpose": {"type": "string"},
+            }}},
+            "media": {"type": "object", "description": "rtsp, webrtc, hls: who serves them (go2rtc)"},
+            "outbound": {"type": "array", "items": {"type": "object"}},
+        },
+    },
+    "Subscriptions": {
+        "type": "object",
+        "properties": {
+            "account": {"type": "object", "properties": {
+                "authenticated": {"type": "boolean"},
+                "auth": {"type": "object", "description": "Token refresh state, as in health"},
+                "subscription": {"type": "string", "enum": list(SUBSCRIPTION_PLANS)},
+            }},
+            "cameras": {"type": "array", "items": {"type": "object", "properties": {
+                "camera_id": _CAMERA_ID,
+                "plan": {"type": "string", "enum": [p for p in SUBSCRIPTION_PLANS if p != "auto"] + ["unknown"]},
+                "source": {"type": "string", "enum": ["camera_settings", "config", "events", "none"]},
+                "features": {"type": "array", "items": {"type": "string"}, "description": "Empty when unknown"},
+                "last_ai_event": {"type": ["string", "null"], "format": "date-time"},
+                "missing_features": {"type": "array", "items": {"type": "string"},
+                                     "description": "Event features in use that the plan lacks"},
+            }}},
+        },
+    },
+    "Event": {
+        "type": "object",
+        "properties": {
+            "id": {"type": "integer"},
+            "timestamp": _TIMESTAMP,
+            "camera_id": {"type": ["string", "null"]},
+            "type": {"type": "string"},
+            "data": {"type": "object", "description": "The notification's params"},
+        },
+    },
+    "ApiUsage": {
+        "type": "object",
+        "properties": {
+            "windows": {
+                "type": "object",
+                "description": "Keyed by window (1m, 5m, 1h, 24h)",
+                "additionalProperties": {
+                    "type": "object",
+                    "properties": {
+                        "total": {"type": "integer"},
+                        "throttled": {"type": "integer", "description": "Calls rejected with HTTP 429"},
+                        "endpoints": {"type": "object", "additionalProperties": {"type": "integer"}},
+                        "cameras": {"type": "object", "additionalProperties": {"type": "integer"}},
+                    },
+                },
+            },
+            "limits": {
+                "type": "object",
+                "additionalProperties": {
+                    "type": "object",
+                    "properties": {
+                        "limit": {"type": "integer"},
+                        "used": {"type": "integer"},
+                        "fraction": {"type": "number"},
+                    },
+                },
+            },
+            "warnings": {"type": "array", "items": {"type": "string"}},
+        },
+    },
+    "HealthStatus": {
+        "type": "object",
+        "properties": {
+            "state": {"type": "string", "enum": ["healthy", "degraded", "unhealthy"]},
+            "message": {"type": "string"},
+            "last_check": _TIMESTAMP,
+            "details": {"type": "object"},
+        },
+    },
+    "Media": {
+        "type": "object",
+        "properties": {
+            "camera_id": _CAMERA_ID,
+            "content_type": {"type": "string"},
+            "timestamp": _TIMESTAMP,
+            "url": {"type": "string", "description": "Object storage URL, when export is configured"},
+        },
+    },
+    "SpilledResult": {
+        "type": "object",
+        "properties": {
+            "spilled": {"const": True},
+            "file_id": {"type": "string"},
+            "path": {"type": "string"},
+            "size": {"type": "integer"},
+            "sha256": {"type": "string"},
+            "content_type": {"type": "string"},
+            "expires_at": _TIMESTAMP,
+            "url": {"type": "string", "description": "Object storage URL, when export is configured"},
+        },
+    },
+}
+
+
+def _ref(name: str) -> Dict[str, Any]:
+    return {"$ref": f"#/components/schemas/{name}"}
+
+
+_CAMERA_PARAM = {"camera_id": _CAMERA_ID}
+_STATUS = {"type": "object", "properties": {"status": {"type": "string"}}}
+
+# Method name -> summary, params (name -> schema), required params, result schema
+API_METHODS: Dict[str, Dict[str, Any]] = {
+    "initialize": {
+        "summary": "Initialize with Wyze credentials; also accepts any option from the manifest config_schema",
+        "params": {
+            "email": {"type": "string"},
+            "password": {"type": "string"},
+            "key_id": {"type": "string"},
+            "api_key": {"type": "string"},
+            "password_file": {"type": "string", "description": "File path or fd:N holding the password"},
+            "access_token": {"type": "string", "description": "Pre-obtained token, instead of email/password"},
+            "refresh_token": {"type": "string"},
+            "max_request_bytes": {"type": "integer", "minimum": MAX_REQUEST_BYTES_BOUNDS[0],
+                                  "maximum": MAX_REQUEST_BYTES_BOUNDS[1], "default": DEFAULT_MAX_REQUEST_BYTES},
+            "notification_queue_size": {"type": "integer", "minimum": NOTIFICATION_QUEUE_BOUNDS[0],
+                                        "maximum": NOTIFICATION_QUEUE_BOUNDS[1],
+                                        "default": DEFAULT_NOTIFICATION_QUEUE_SIZE},
+            "nvr_max_line_bytes": {"type": "integer", "description": "Longest line the NVR reads; larger results are spilled"},
+            "scopes": {"type": "array", "items": {"type": "string", "enum": list(SCOPES)},
+                       "description": "Restrict this session; admin > control > view (default: all)"},
+        },
+        "result": {"type": "object", "properties": {
+            "status": {"type": "string", "enum": ["ok", "partial"],
+                       "description": "partial when a camera or component failed to set up"},
+            "cameras": {"type": "integer"},
+            "enumerating": {"type": "boolean"},
+            "added": {"type": "array", "items": _CAMERA_ID},
+            "skipped": {"type": "array", "items": {"$ref": "#/components/schemas/CameraSetupOutcome"}},
+            "failed": {"type": "array", "items": {"$ref": "#/components/schemas/CameraSetupOutcome"}},
+            "components": {"type": "object", "description": "tutk_library, native_stream_backend, rest_api, healthz, timeline, local_detection states",
+                           "additionalProperties": {"type": "string"}},
+            "warnings": {"type": "array", "items": {"type": "string"}},
+            "limits": {"type": "object", "properties": {
+                "max_request_bytes": {"type": "integer"},
+                "max_inline_bytes": {"type": "integer"},
+                "fetch_chunk_bytes": {"type": "integer"},
+                "notification_queue_size": {"type": "integer"},
+            }},
+            "scopes": {"type": "array", "items": {"type": "string"}},
+            "upgrade": {"type": "object", "description": "Present when state was restored from prepare_upgrade",
+                        "properties": {
+                            "from_version": {"type": "string"},
+                            "checkpoint_age_seconds": {"type": "integer"},
+                            "cameras": {"type": "integer"},
+                            "streams_running": {"type": "array", "items": _CAMERA_ID},
+                            "streams_lost": {"type": "array", "items": _CAMERA_ID},
+                        }},
+            "migration": {"type": "object", "description": "Present when config or state files were migrated, "
+                                                          "or migration failed",
+                          "properties": {
+                              "from_version": {"type": "integer"},
+                              "to_version": {"type": "integer"},
+                              "applied": {"type": "array", "items": {"type": "string"}},
+                              "backup": {"type": "string", "description": "Directory holding the original files"},
+                              "error": {"type": "string"},
+                          }},
+        }},
+    },
+    "verify_credentials": {
+        "summary": "Test a Wyze login without initializing the plugin",
+        "params": {
+            "email": {"type": "string"},
+            "password": {"type": "string"},
+            "key_id": {"type": "string"},
+            "api_key": {"type": "string"},
+        },
+        "result": {"type": "object", "properties": {
+            "success": {"type": "boolean"},
+            "mfa_required": {"type": "boolean"},
+            "reason": {"type": "string", "enum": [
+                "", "missing_credentials", "invalid_credentials", "invalid_api_key",
+                "rate_limited", "network_error", "mfa_required", "login_failed",
+            ]},
+            "message": {"type": "string"},
+            "account": {"type": "string"},
+        }},
+    },
+    "shutdown": {"summary": "Stop background work and child processes", "result": _STATUS},
+    "health": {"summary": "Get plugin health status", "result": _ref("HealthStatus")},
+    "ping": {
+        "summary": "Keepalive from the NVR",
+        "result": {"type": "object", "properties": {
+            "seq": {"type": "integer"},
+            "uptime": {"type": "integer"},
+            "protocol_version": {"type": "string"},
+            "version": {"type": "string"},
+        }},
+    },
+    "discover_cameras": {
+        "summary": "List all cameras on the Wyze account",
+        "result": {"type": "array", "items": _ref("DiscoveredCamera")},
+    },
+    "start_discovery": {
+        "summary": "Fetch the account's cameras in the background with discovery.progress notifications",
+        "params": {"probe": {"type": "boolean", "default": True, "description": "LAN search and ping each camera"}},
+        "result": {"type": "object", "properties": {
+            "discovery_id": {"type": "string"},
+            "status": {"type": "string", "enum": ["running"]},
+        }},
+    },
+    "cancel_discovery": {
+        "summary": "Stop a running discovery",
+        "params": {"discovery_id": {"type": "string"}},
+        "required": ["discovery_id"],
+        "result": {"type": "object", "properties": {
+            "discovery_id": {"type": "string"},
+            "status": {"type": "string", "enum": ["cancelling", "completed", "cancelled", "failed"]},
+        }},
+    },
+    "list_cameras": {
+        "summary": "List configured cameras with stream URLs",
+        "result": {"type": "array", "items": _ref("PluginCamera")},
+    },
+    "get_camera": {
+        "summary": "Get one camera",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("PluginCamera"),
+    },
+    "add_camera": {
+        "summary": "Add a camera by MAC address",
+        "params": {
+            "mac": _CAMERA_ID,
+            "name": {"type": "string"},
+            "extra": {"type": "object", "description": "Per-camera settings overrides"},
+        },
+        "required": ["mac"],
+        "result": _ref("PluginCamera"),
+    },
+    "remove_camera": {
+        "summary": "Remove a camera from the roster, keeping its settings for restore_camera",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("RemovedCamera"),
+    },
+    "list_removed_cameras": {
+        "summary": "Removed cameras that can still be restored",
+        "result": {"type": "array", "items": _ref("RemovedCamera")},
+    },
+    "restore_camera": {
+        "summary": "Bring back a removed camera with its settings",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("PluginCamera"),
+    },
+    "probe_camera": {
+        "summary": "Network diagnostics: LAN address and ping reachability",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": {"type": "object", "properties": {
+            "camera_id": _CAMERA_ID,
+            "host": {"type": "string"},
+            "host_source": {"type": "string", "enum": ["lan", "cloud"]},
+            "lan_port": {"type": "integer"},
+            "lan_seen": _TIMESTAMP,
+            "ping": {"type": "object", "properties": {
+                "reachable": {"type": "boolean"},
+                "rtt_ms": {"type": ["number", "null"]},
+            }},
+        }},
+    },
+    "run_selfcheck": {
+        "summary": "Check auth, cloud properties, network, TUTK commands, stream, snapshot and events for one camera",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": {"type": "object", "properties": {
+            "camera_id": _CAMERA_ID,
+            "passed": {"type": "boolean", "description": "No step failed"},
+            "failed_step": {"type": ["string", "null"], "description": "First failed step"},
+            "steps": {"type": "array", "items": {"type": "object", "properties": {
+                "step": {"type": "string", "enum": ["auth", "account", "properties", "network", "command",
+                                                    "stream", "snapshot", "events"]},
+                "status": {"type": "string", "enum": ["pass", "fail", "skipped"]},
+                "message": {"type": "string"},
+                "duration_ms": {"type": "integer"},
+                "reason": {"type": "string", "description": "Error reason of a failed step"},
+            }}},
+            "duration_ms": {"type": "integer"},
+        }},
+    },
+    "get_daily_summary": {
+        "summary": "Per-camera daily summary (streaming uptime, disconnects, events by type, bytes streamed, "
+                   "average bitrate) for today so far or a finished day",
+        "params": {
+            "date": {"type": "string", "format": "date", "description": "Day in the configured timezone; "
+                                                                       "defaults to today"},
+            "camera_id": _CAMERA_ID,
+        },
+        "result": _ref("DailySummary"),
+    },
+    "get_connection_stats": {
+        "summary": "Per-camera connection latency, reconnects and frame drops",
+        "params": {"camera_id": dict(_CAMERA_ID, description="Limit to one camera")},
+        "result": {"type": "array", "items": _ref("ConnectionStats")},
+    },
+    "get_api_usage": {
+        "summary": "Wyze cloud calls per endpoint and camera over rolling windows",
+        "params": {"camera_id": dict(_CAMERA_ID, description="Limit the per-camera counts to one camera")},
+        "result": _ref("ApiUsage"),
+    },
+    "query_events": {
+        "summary": "Page through recorded events by time range, camera and type",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "from": {"oneOf": [_TIMESTAMP, {"type": "number"}], "description": _LOCAL_TIME_NOTE},
+            "to": {"oneOf": [_TIMESTAMP, {"type": "number"}], "description": _LOCAL_TIME_NOTE},
+            "types": {"type": "array", "items": {"type": "string"}, "description": "Notification methods, e.g. camera.discovered"},
+            "limit": {"type": "integer", "minimum": 1, "maximum": MAX_EVENT_QUERY_LIMIT, "default": DEFAULT_EVENT_QUERY_LIMIT},
+            "cursor": {"type": "string", "description": "next_cursor from the previous page"},
+        },
+        "result": {"type": "object", "properties": {
+            "events": {"type": "array", "items": _ref("Event")},
+            "next_cursor": {"type": ["string", "null"]},
+        }},
+    },
+    "export_diagnostics": {
+        "summary": "Write a diagnostics bundle (health, scrubbed config, connection stats)",
+        "result": {"type": "object", "properties": {
+            "path": {"type": "string"},
+            "size": {"type": "integer"},
+            "content_type": {"type": "string"},
+            "url": {"type": "string", "description": "Object storage URL, when export is configured"},
+        }},
+    },
+    "wake_camera": {
+        "summary": "Open an event_only camera's streaming window, e.g. for live view",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "duration": {"type": "integer", "minimum": 1, "description": "Seconds (default ingestion_cooldown)"},
+        },
+        "required": ["camera_id"],
+        "result": {"type": "object", "properties": {"camera_id": _CAMERA_ID, "until": _TIMESTAMP}},
+    },
+    "reconcile_bridge": {
+        "summary": "Rewrite config.json and restart streams whose configuration has drifted",
+        "result": {"type": "object", "properties": {
+            "config_file_rewritten": {"type": "boolean"},
+            "restarted": {"type": "array", "items": _CAMERA_ID},
+            "drift": _ref("ConfigDrift"),
+        }},
+    },
+    "migrate_stream_backend": {
+        "summary": "Move cameras to another stream backend without removing them from the roster",
+        "params": {
+            "camera_ids": {"type": "array", "items": _CAMERA_ID, "description": "Cameras to move (default all)"},
+            "backend": {"type": "string", "enum": list(STREAM_BACKENDS)},
+        },
+        "required": ["backend"],
+        "result": {"type": "object", "properties": {
+            "backend": {"type": "string"},
+            "migrated": {"type": "array", "items": {"type": "object", "properties": {
+                "camera_id": _CAMERA_ID,
+                "from": {"type": "string"},
+            }}},
+            "unchanged": {"type": "array", "items": _CAMERA_ID},
+        }},
+    },
+    "prepare_upgrade": {
+        "summary": "Checkpoint tokens, roster and running streams so a replacement plugin process starts without re-login",
+        "result": {"type": "object", "properties": {
+            "checkpoint": {"type": "string", "description": "Checkpoint file in the plugin directory"},
+            "expires_at": _TIMESTAMP,
+            "cameras": {"type": "array", "items": _CAMERA_ID},
+            "streams": {"type": "array", "items": _CAMERA_ID, "description": "Cameras streaming now; go2rtc keeps them running"},
+        }},
+    },
+    "take_photo": {
+        "summary": "Have the camera save a full-resolution still to its SD card (TUTK K10058); the image is not "
+                   "returned and get_snapshot does not use it",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": {"type": "object", "properties": {
+            "camera_id": _CAMERA_ID,
+            "saved_to": {"const": "sd_card"},
+            "timestamp": _TIMESTAMP,
+        }},
+    },
+    "ptz": {
+        "summary": "Pan/tilt a Cam Pan: move left/right/up/down until stop or duration, or rotate by degrees",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "command": {"type": "string", "enum": list(PTZ_COMMANDS)},
+            "speed": {"type": "integer", "minimum": PTZ_SPEEDS[0], "maximum": PTZ_SPEEDS[1],
+                      "default": DEFAULT_PTZ_SPEED},
+            "duration": {"type": "number", "exclusiveMinimum": 0, "maximum": PTZ_MAX_MOVE,
+                         "description": f"Seconds to move; without it the camera moves until stop "
+                                        f"(at most {PTZ_MAX_MOVE}s)"},
+            "pan": {"type": "integer", "minimum": -360, "maximum": 360, "description": "rotate: degrees right"},
+            "tilt": {"type": "integer", "minimum": -360, "maximum": 360, "description": "rotate: degrees up"},
+        },
+        "required": ["camera_id", "command"],
+        "result": {"type": "object", "properties": {
+            "camera_id": _CAMERA_ID,
+            "command": {"type": "string"},
+            "speed": {"type": "integer"},
+            "moving": {"type": "boolean", "description": "A move is in progress"},
+            "until": {"type": ["string", "null"], "format": "date-time",
+                      "description": "When the move stops by itself"},
+            "pan": {"type": "integer"},
+            "tilt": {"type": "integer"},
+        }},
+    },
+    "get_osd": {
+        "summary": "Read the camera's timestamp/logo overlays and the restream name overlay",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("OSDState"),
+    },
+    "set_osd": {
+        "summary": "Toggle the camera's timestamp/logo overlays or burn the camera name into the restream",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "timestamp": {"type": "boolean"},
+            "logo": {"type": "boolean"},
+            "name_overlay": {"type": "boolean"},
+        },
+        "required": ["camera_id"],
+        "result": _ref("OSDState"),
+    },
+    "get_arm_state": {
+        "summary": "Get the NVR arm state and the camera's own motion detection and notification switches",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("ArmState"),
+    },
+    "set_arm_state": {
+        "summary": "Arm or disarm a camera, optionally switching its own motion detection and notifications to match",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "armed": {"type": "boolean"},
+            "sync_camera": {"type": "boolean", "description": "Defaults to the sync_camera_detection config"},
+        },
+        "required": ["camera_id", "armed"],
+        "result": _ref("ArmState"),
+    },
+    "get_subscriptions": {
+        "summary": "Get Wyze account health and each camera's subscription plan (Cam Plus) and missing event features",
+        "params": {"camera_id": _CAMERA_ID},
+        "result": _ref("Subscriptions"),
+    },
+    "subscribe_events": {
+        "summary": "Choose which notifications are sent on stdout, by name or * pattern (\"*\" = all, the default)",
+        "params": {"types": {"type": "array", "items": {"type": "string"}}},
+        "required": ["types"],
+        "result": {"type": "object", "properties": {
+            "types": {"type": "array", "items": {"type": "string"}},
+            "subscribed": {"type": "array", "items": {"type": "string"}, "description": "Notifications now sent"},
+        }},
+    },
+    "get_camera_config": {
+        "summary": "Get a camera's stored setting overrides and effective settings",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": _ref("CameraConfig"),
+    },
+    "set_camera_config": {
+        "summary": "Update a camera's stored setting overrides (null values remove a key)",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "settings": _ref("CameraSettings"),
+            "replace": {"type": "boolean", "default": False},
+        },
+        "required": ["camera_id", "settings"],
+        "result": _ref("CameraConfig"),
+    },
+    "get_snapshot": {
+        "summary": "Get a JPEG snapshot using the camera's snapshot mode; `stream` is a fresh frame from the device "
+                   "(K10058 photos only go to the SD card, see take_photo)",
+        "params": _CAMERA_PARAM,
+        "required": ["camera_id"],
+        "result": {"allOf": [_ref("Media"), {"type": "object", "properties": {
+            "mode": {"type": "string"},
+            "image": {"type": "string", "contentEncoding": "base64"},
+            "throttled": {"type": "boolean", "description": "Over the snapshot rate limit, so the last cached "
+                                                            "snapshot was returned"},
+        }}]},
+    },
+    "get_snapshots": {
+        "summary": "Capture snapshots from several cameras at (nearly) the same instant",
+        "params": {
+            "camera_ids": {"type": "array", "items": _CAMERA_ID, "minItems": 1, "maxItems": MAX_SYNC_SNAPSHOT_CAMERAS},
+            "timeout": {"type": "integer", "minimum": 1, "maximum": MAX_SYNC_SNAPSHOT_TIMEOUT,
+                        "default": DEFAULT_SYNC_SNAPSHOT_TIMEOUT, "description": "Shared deadline in seconds"},
+            "live": {"type": "boolean", "default": True,
+                     "description": "Grab live stream frames even for api snapshot mode cameras"},
+        },
+        "required": ["camera_ids"],
+        "result": {"type": "object", "properties": {
+            "requested_at": _TIMESTAMP,
+            "spread_ms": {"type": ["integer", "null"], "description": "Time between the first and last capture"},
+            "captured": {"type": "integer"},
+            "snapshots": {"type": "object", "description": "Keyed by camera_id; failed cameras carry error instead of image",
+                          "additionalProperties": {"type": "object", "properties": {
+                              "camera_id": _CAMERA_ID,
+                              "mode": {"type": "string"},
+                              "content_type": {"type": "string"},
+                              "image": {"type": "string", "contentEncoding": "base64"},
+                              "timestamp": _TIMESTAMP,
+                              "error": {"type": "object"},
+                          }}},
+        }},
+    },
+    "get_preview": {
+        "summary": "Get a short low-fps preview clip",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "format": {"type": "string", "enum": list(PREVIEW_FORMATS), "default": "mp4"},
+            "duration": {"type": "integer", "minimum": PREVIEW_MIN_DURATION, "maximum": PREVIEW_MAX_DURATION},
+        },
+        "required": ["camera_id"],
+        "result": {"allOf": [_ref("Media"), {"type": "object", "properties": {
+            "data": {"type": "string", "contentEncoding": "base64"},
+        }}]},
+    },
+    "get_timeline_thumbnails": {
+        "summary": "Get interval thumbnails for scrubbing",
+        "params": {
+            "camera_id": _CAMERA_ID,
+            "from": dict(_TIMESTAMP, description=_LOCAL_TIME_NOTE),
+            "to": dict(_TIMESTAMP, description=_LOCAL_TIME_NOTE),
+            "limit": {"type": "integer", "minimum": 0},
+        },
+        "required": ["camera_id"],
+        "result": {"type": "object", "properties": {
+            "camera_id": _CAMERA_ID,
+            "interval": {"type": "integer"},
+            "content_type": {"type": "string"},
+            "thumbnails": {"type": "array", "items": {"type": "object", "properties": {
+                "timestamp": _TIMESTAMP,
+                "image": {"type": "string", "contentEncoding": "base64"},
+            }}},
+        }},
+    },
+    "fetch_file": {
+        "summary": "Read a chunk of a result that was spilled to disk",
+        "params": {
+            "file_id": {"type": "string"},
+            "offset": {"type": "integer", "minimum": 0},
+            "length": {"type": "integer", "minimum": 1, "maximum": FETCH_CHUNK_SIZE},
+        },
+        "required": ["file_id"],
+        "result": {"type": "object", "properties": {
+            "file_id": {"type": "string"},
+            "offset": {"type": "integer"},
+            "size": {"type": "integer"},
+            "data": {"type": "string", "contentEncoding": "base64"},
+            "eof": {"type": "boolean"},
+        }},
+    },
+    "set_log_level": {
+        "summary": "Change the log level immediately, for the whole plugin or one component",
+        "params": {
+            "level": {"type": ["string", "null"], "enum": list(LOG_LEVELS) + [None],
+                      "description": "null clears a component override"},
+            "component": {"type": "string", "enum": list(LOG_COMPONENTS), "description": "Omit for the default level"},
+            "duration": {"type": "integer", "minimum": 1, "maximum": MAX_LOG_LEVEL_DURATION,
+                         "description": "Revert to the previous levels after this many seconds"},
+        },
+        "required": ["level"],
+        "result": {"$ref": "#/components/schemas/LogLevels"},
+    },
+    "get_api_schema": {
+        "summary": "Get the OpenRPC description of this API",
+        "result": {"type": "object", "description": "OpenRPC document"},
+    },
+    "get_plugin_info": {
+        "summary": "Get the deployed plugin version, source commit and runtime environment (for About pages)",
+        "result": {"$ref": "#/components/schemas/PluginInfo"},
+    },
+    "capabilities": {
+        "summary": "Negotiate with the host: protocol version, supported methods and notifications, camera "
+                   "capabilities and feature flags",
+        "params": {
+            "protocol_version": {"type": "string", "description": "The host's protocol version to check"},
+        },
+        "result": {"$ref": "#/components/schemas/Capabilities"},
+    },
+    "get_ports": {
+        "summary": "Get the port manifest written to ports.json (listening ports, media owner, outbound traffic)",
+        "result": {"$ref": "#/components/schemas/PortManifest"},
+    },
+}
+
+
+def build_api_schema() -> Dict[str, Any]:
+    """Build an OpenRPC document for every RPC method"""
+    methods = []
+    for name, spec in API_METHODS.items():
+        required = spec.get("required", [])
+        method = {
+            "name": name,
+            "summary": spec["summary"],
+            "paramStructure": "by-name",
+            "params": [
+                {"name": param, "required": param in required, "schema": schema}
+                for param, schema in spec.get("params", {}).items()
+            ],
+            "result": {"name": "result", "schema": spec["result"]},
+            "x-scope": METHOD_SCOPES.get(name, "admin"),
+        }
+        if name in METHOD_CAPABILITIES:
+            method["x-capability"] = METHOD_CAPABILITIES[name]
+        methods.append(method)
+
+    return {
+        "openrpc": "1.2.6",
+        "info": {
+            "title": "Wyze Plugin for SpatialNVR",
+            "version": get_plugin_version(),
+            "x-protocol-version": PROTOCOL_VERSION,
+        },
+        "methods": methods,
+        "components": {"schemas": API_SCHEMA_COMPONENTS},
+    }
+
+
+class WyzePlugin:
+    """Main plugin class for JSON-RPC communication"""
+
+    def __init__(self):
+        self.config: Dict[str, Any] = {}
+        self.auth: Optional[WyzeAuth] = None
+        self.tutk_lib: Optional[str] = None
+        self.janitor: Optional[StorageJanitor] = None
+        self.telemetry: Optional[Telemetry] = None
+        self.camera_store = CameraSettingsStore()
+        self.refresh_thread: Optional[threading.Thread] = None
+        self.missing_counts: Dict[str, int] = {}
+        self.preview_locks: Dict[str, threading.Lock] = {}
+        self.timeline_thread: Optional[threading.Thread] = None
+        self.lan_hosts: Dict[str, Dict[str, Any]] = {}
+        self.s3: Optional[S3Uploader] = None
+        self.s3_urls: Dict[str, tuple] = {}
+        self.failure_counts: Dict[str, int] = {}
+        self.failure_marks: Dict[str, List[float]] = {}
+        self.downgrade_counts: Dict[str, int] = {}
+        self.rest_api: Optional[RestAPIServer] = None
+        self.healthz: Optional[HealthzServer] = None
+        self.reauth_lock = threading.Lock()
+        self.auth_status: Dict[str, Any] = {"state": "ok", "refreshes": 0, "last_refresh_ts": 0.0, "last_method": "",
+                                            "last_failure_ts": 0.0, "last_error": ""}
+        self.started_at = time.monotonic()
+        self.last_ping = time.monotonic()
+        self.ping_seq = 0
+        self.removed_from_account: set = set()
+        self.inflight: Dict[object, tuple] = {}
+        self.inflight_cond = threading.Condition()
+        self.draining = False
+        self.drain_expired = False
+        self.ready = False
+        self.event_cursors: Dict[str, int] = {}
+        self.event_schedule: Dict[str, float] = {}
+        self.camera_properties: Dict[str, Dict[str, str]] = {}
+        self.ptz_moves: Dict[str, threading.Event] = {}
+        self.seen_events: List[str] = []
+        self.event_merger = EventMerger()
+        self.event_limiter = EventRateLimiter()
+        self.event_limiter_lock = threading.RLock()
+        self.incidents = IncidentCorrelator()
+        self.incident_lock = threading.Lock()
+        self.detector: Optional[PersonDetector] = None
+        self.detection_thread: Optional[threading.Thread] = None
+        self.detection_status: Dict[str, Any] = {"enabled": False}
+        self.components: Dict[str, str] = {}
+        self.upgrade: Optional[Dict[str, Any]] = None
+        self.migration: Dict[str, Any] = {}
+        self.discovery: Optional[Dict[str, Any]] = None
+        self.discovery_lock = threading.Lock()
+        self.upgrade_roster: set = set()
+        self.stream_backends: Dict[str, StreamBackend] = {"bridge": BridgeStreamBackend()}
+        self.python_status: Dict[str, Any] = {"interpreter": VENV_PYTHON, "fallback": None, "remediation": ""}
+        self.last_detections: Dict[str, float] = {}
+        self.published = load_published_urls()
+        self.removed_cameras = load_removed_cameras()
+        self.arm_states = load_arm_states()
+        self.daily = DailyStats()
+        self.last_daily_sample = 0.0
+        self.snapshot_limiter = SnapshotLimiter()
+        self.snapshot_fetches: Dict[str, Dict[str, Any]] = {}
+        self.snapshot_fetch_lock = threading.Lock()
+        self.camera_filter = CameraFilter({})
+        self.firmware_caps = FirmwareCapabilities({})
+        self.camera_groups: Dict[str, List[str]] = {}
+        self.filter_verdicts: Dict[str, Optional[str]] = {}
+        self.ai_events: Dict[str, float] = {}
+        self.reconnect_states: Dict[str, tuple] = {}
+        self.offline_cameras: set = set()
+        self.ports_written: Optional[Dict[str, Any]] = None
+        self.dropped_notifications = 0
+        self.crash_counts: Dict[str, int] = {}
+        self.last_drift: tuple = (False, ())
+        self.parse_errors: Dict[str, Any] = {"invalid_json": 0, "oversized": 0, "last_at": None}
+        self.max_request_bytes = DEFAULT_MAX_REQUEST_BYTES
+        self.scopes: Optional[set] = None
+        self.rest_scopes: set = set(DEFAULT_REST_API_SCOPES)
+        self.command_sessions: Optional[CameraSessionManager] = None
+        self.command_sessions_lock = threading.Lock()
+        self.max_inline_bytes = DEFAULT_MAX_INLINE_BYTES
+        self.stream_modes: Dict[str, str] = {}
+        self.stream_modes_at = 0.0
+        self.stream_modes_lock = threading.Lock()
+        self.running = True
+
+    def initialize(self, config: Dict[str, Any]) -> Dict[str, Any]:
+        """Initialize the plugin with configuration"""
+        config, self.migration = migrate_state(config)
+        if self.migration["applied"]:
+            # Pick up state files rewritten by the migration
+            self.camera_store = CameraSettingsStore()
+            self.published = load_published_urls()
+            self.removed_cameras = load_removed_cameras()
+            self.arm_states = load_arm_states()
+            self.daily = DailyStats()
+        config = normalize_intervals(resolve_secrets(config))
+        self.camera_filter = CameraFilter(config)
+        self.firmware_caps = FirmwareCapabilities(config)
+        watched = config.get("watched_properties")
+        if watched is not None and not (isinstance(watched, dict) and all(
+                isinstance(k, str) and isinstance(v, str) and v for k, v in watched.items())):
+            raise PluginError("invalid_params", "watched_properties must map Wyze property IDs (P3) to names")
+        self.snapshot_limiter = SnapshotLimiter(
+            int(config.get("snapshot_rate_limit", DEFAULT_SNAPSHOT_RATE_LIMIT)),
+            int(config.get("snapshot_global_rate_limit", DEFAULT_SNAPSHOT_GLOBAL_RATE_LIMIT)))
+        self._apply_scopes(config)
+        self._apply_limits(config)
+        self._apply_log_levels(config)
+        config = self._check_python(config)
+        self.config = config
+        log(f"Initializing with config: {json.dumps(scrub_config(config))}")
+
+        # Save config for streaming subprocess
+        save_config(config)
+
+        self.telemetry = Telemetry(config)
+        self.s3 = S3Uploader.from_config(config)
+        configure_event_delivery(config)
+        configure_dns(config)
+        configure_timezone(config)
+        global _event_store
+        if not _event_store:
+            _event_store = EventStore(os.path.join(PLUGIN_DIR, "events.db"))
+        _event_store.prune(int(config.get("event_retention_days", DEFAULT_EVENT_RETENTION_DAYS)))
+        self.ai_events = _event_store.last_tagged(time.time() - SUBSCRIPTION_EVIDENCE_DAYS * 86400)
+
+        # Prune old data before we start adding to it
+        self.janitor = StorageJanitor(config)
+        self.janitor.run()
+        self.janitor.check_disk()
+
+        # Get TUTK library (not needed when we never stream)
+        self.components = {"tutk_library": "not_needed", "rest_api": "disabled", "timeline": "disabled",
+                           "python": self.python_status["fallback"] or ("ok" if self.python_status["interpreter"]
+                                                                          else "not_needed")}
+        if not config.get("cloud_only", False):
+            self.tutk_lib = get_tutk_library(config)
+            if not self.tutk_lib:
+                raise PluginError("tutk_library_unavailable", "Failed to get TUTK library (see plugin logs)")
+            self.components["tutk_library"] = "ok"
+        self._apply_stream_backends(config)
+
+        # Authenticate and get cameras
+        global _reauth_handler
+        _reauth_handler = self._on_token_invalid
+        self.auth = WyzeAuth(config)
+        self.ready = False
+        try:
+            # Camera enumeration can take a long time on a slow API; finish it in the background
+            if not self._restore_upgrade(config):
+                self.auth.login(with_cameras=False)
+        except ValueError as e:
+            raise PluginError("invalid_params", str(e))
+        except WyzeApiError:
+            raise
+        except Exception as e:
+            raise PluginError("auth_failed", f"Wyze login failed: {e}")
+
+        cameras = len(self.auth.cameras)
+
+        # Start background discovery and housekeeping
+        if not self.refresh_thread:
+            self.refresh_thread = threading.Thread(target=self._refresh_loop, daemon=True)
+            self.refresh_thread.start()
+
+        if config.get("rest_api_enabled", False) and not self.rest_api:
+            if not config.get("rest_api_token"):
+                raise PluginError("invalid_params", "rest_api_token is required when rest_api_enabled is set")
+            self.rest_api = RestAPIServer(self, config.get("rest_api_bind", DEFAULT_REST_API_BIND),
+                                          config["rest_api_token"])
+            self.rest_api.start()
+        if self.rest_api:
+            self.components["rest_api"] = "running"
+
+        self.components["healthz"] = "disabled"
+        if config.get("healthz_enabled", False) and not self.healthz:
+            try:
+                self.healthz = HealthzServer(self, config.get("healthz_bind", DEFAULT_HEALTHZ_BIND))
+                self.healthz.start()
+            except (OSError, ValueError) as e:
+                log(f"Health endpoints not started: {e}")
+                self.components["healthz"] = "failed"
+        if self.healthz:
+            self.components["healthz"] = "running"
+
+        if int(config.get("timeline_interval", 0)) > 0 and not self.timeline_thread:
+            self.timeline_thread = threading.Thread(target=self._timeline_loop, daemon=True)
+            self.timeline_thread.start()
+        if self.timeline_thread:
+            self.components["timeline"] = "running"
+
+        self._start_detection(config)
+        # Started last so the ready notification sees every component
+        threading.Thread(target=self._finish_startup, daemon=True).start()
+
+        self._write_ports()
+        result = {"status": "ok", "cameras": cameras, "enumerating": cameras == 0, "limits": self._limits(),
+                  "scopes": sorted(self.scopes)}
+        result.update(self._setup_summary())
+        if self.upgrade:
+            result["upgrade"] = self.upgrade
+        if self.migration.get("applied") or self.migration.get("error"):
+            result["migration"] = self.migration
+        if self.python_status["remediation"]:
+            result["python"] = self.python_status
+        return result
+
+    def prepare_upgrade(self) -> Dict[str, Any]:
+        """Checkpoint tokens, roster and running streams for the plugin process replacing this one
+
+        Streams belong to go2rtc, so they keep running across the restart; the
+        new process restores the checkpoint instead of logging in and
+        re-announcing cameras.
+        """
+        if not self.auth or not self.auth.auth_info:
+            raise PluginError("not_initialized")
+        streams = list_active_streams()
+        created = time.time()
+        save_upgrade_checkpoint({
+            "version": get_plugin_version(),
+            "created_at": created,
+            "credentials": credentials_fingerprint(self.config),
+            "auth": self.auth.dump(),
+            "roster": sorted(self.published),
+            "removed_from_account": sorted(self.removed_from_account),
+            "event_cursors": self.event_cursors,
+            "seen_events": self.seen_events,
+            "streams": [{"camera_id": s["mac"], "pid": s["pid"]} for s in streams],
+        })
+        log(f"Upgrade checkpoint written: {len(self.published)} cameras, {len(streams)} running streams")
+        return {
+            "checkpoint": UPGRADE_CHECKPOINT_FILE,
+            "expires_at": format_time(created + UPGRADE_CHECKPOINT_TTL),
+            "cameras": sorted(self.published),
+            "streams": sorted(s["mac"] for s in streams),
+        }
+
+    def _restore_upgrade(self, config: Dict[str, Any]) -> bool:
+        """Pick up where the previous plugin process left off after prepare_upgrade"""
+        self.upgrade = None
+        self.upgrade_roster = set()
+        checkpoint = take_upgrade_checkpoint()
+        if not checkpoint:
+            return False
+        if checkpoint.get("credentials") != credentials_fingerprint(config):
+            log("Upgrade checkpoint was taken with other credentials, logging in instead")
+            return False
+        try:
+            self.auth.restore(checkpoint["auth"])
+        except Exception as e:
+            log(f"Upgrade checkpoint unusable, logging in instead: {e}")
+            self.auth = WyzeAuth(config)
+            return False
+
+        self.upgrade_roster = set(checkpoint.get("roster") or [])
+        self.removed_from_account = set(checkpoint.get("removed_from_account") or [])
+        self.event_cursors = dict(checkpoint.get("event_cursors") or {})
+        self.seen_events = list(checkpoint.get("seen_events") or [])
+        running = [s["camera_id"] for s in checkpoint.get("streams") or [] if _pid_alive(int(s["pid"]))]
+        lost = [s["camera_id"] for s in checkpoint.get("streams") or [] if s["camera_id"] not in running]
+        self.upgrade = {
+            "from_version": checkpoint.get("version", ""),
+            "checkpoint_age_seconds": int(time.time() - checkpoint["created_at"]),
+            "cameras": len(self.auth.cameras),
+            "streams_running": running,
+            "streams_lost": lost,
+        }
+        log(f"Restored upgrade checkpoint from {self.upgrade['from_version']}: {len(self.auth.cameras)} cameras, "
+            f"{len(running)} streams still running")
+        return True
+
+    def _setup_summary(self) -> Dict[str, Any]:
+        """Per-camera setup outcome, background component states and warnings
+
+        Before the camera list is known (enumerating) only the components and
+        warnings are meaningful; the ready notification repeats the summary
+        once enumeration has finished.
+        """
+        configured: Dict[str, Dict[str, Any]] = {}
+        failed: List[Dict[str, Any]] = []
+        warnings: List[str] = []
+        for entry in self.config.get("cameras") or []:
+            if isinstance(entry, dict) and entry.get("mac"):
+                configured[entry["mac"]] = entry
+
+        added, skipped = [], []
+        for camera in list(self.auth.cameras.values()) if self.auth else []:
+            excluded = self._filter_reason(camera)
+            if excluded:
+                skipped.append({"camera_id": camera.mac, "name": camera.nickname, "reason": excluded})
+                continue
+            if camera.mac in self.removed_cameras:
+                skipped.append({"camera_id": camera.mac, "name": camera.nickname, "reason": "removed"})
+                continue
+            try:
+                validate_camera_settings({k: v for k, v in configured.get(camera.mac, {}).items() if k != "mac"})
+            except PluginError as e:
+                failed.append({"camera_id": camera.mac, "name": camera.nickname, "reason": "invalid_settings",
+                               "message": str(e)})
+                continue
+            if not self.config.get("cloud_only", False) and not (getattr(camera, "p2p_id", None)
+                                                                 and getattr(camera, "enr", None)):
+                failed.append({"camera_id": camera.mac, "name": camera.nickname, "reason": "missing_p2p_credentials",
+                               "message": "Wyze returned no p2p_id/enr, so the camera cannot stream"})
+                continue
+            added.append(camera.mac)
+            if camera.product_model not in CAMERA_MODELS:
+                warnings.append(warn("unverified_model", f"{camera.nickname} ({camera.mac}): unverified model "
+                                     f"{camera.product_model}", camera.mac))
+            if self._ingestion(camera.mac) == "disabled":
+                warnings.append(f"{camera.nickname} ({camera.mac}): ingestion disabled, no stream URL")
+            selected, backend = self._selected_backend(camera.mac), self._stream_backend(camera.mac).name
+            if backend != selected:
+                warnings.append(warn("stream_backend_unavailable", f"{camera.nickname} ({camera.mac}): {selected} "
+                                     f"stream backend unavailable, using {backend}", camera.mac))
+
+        enumerating = not self.auth or not self.auth.cameras
+        if not enumerating:
+            for mac in configured:
+                if mac not in self.auth.cameras:
+                    failed.append({"camera_id": mac, "name": configured[mac].get("name", ""), "reason": "not_in_account",
+                                   "message": "Configured camera is not on this Wyze account"})
+        for entry in failed:
+            warn(entry["reason"], f"{entry['name'] or entry['camera_id']}: {entry['message']}", entry["camera_id"])
+
+        components = dict(self.components)
+        if components.get("healthz") == "failed":
+            warnings.append(warn("healthz_bind_failed", "Health endpoints could not bind healthz_bind"))
+        components["local_detection"] = "running" if self.detector else (
+            "failed" if self.detection_status.get("error") else "disabled")
+        if self.detection_status.get("error"):
+            warnings.append(warn("local_detection_failed", f"Local detection: {self.detection_status['error']}"))
+        if self.migration.get("error"):
+            warnings.append(self.migration["error"])
+        if self.config.get("cloud_only", False):
+            warnings.append("cloud_only is set: no live streams")
+        if enumerating:
+            warnings.append("Camera list is still being fetched; see the ready notification")
+        return {
+            "status": "partial" if failed or components["local_detection"] == "failed" else "ok",
+            "added": added,
+            "skipped": skipped,
+            "failed": failed,
+            "components": components,
+            "warnings": warnings,
+        }
+
+    def _check_python(self, config: Dict[str, Any]) -> Dict[str, Any]:
+        """Find the interpreter for bridge streams; without one, fall back to the native backend or,
+        with cloud_only_fallback, to cloud-only mode. Returns the config to apply."""
+        python = stream_python()
+        status: Dict[str, Any] = {"interpreter": python, "fallback": None, "remediation": ""}
+        self.python_status = status
+        if python == VENV_PYTHON or config.get("cloud_only", False):
+            return config
+        if python:
+            status["remediation"] = PYTHON_REMEDIATION
+            warn("python_fallback", f"{VENV_PYTHON} is missing, streams run with {python}", component="bridge")
+            return config
+        if not NativeStreamBackend(str(config.get("native_backend_path") or "")).unavailable():
+            status["fallback"] = "native"
+        elif config.get("cloud_only_fallback", False):
+            status["fallback"] = "cloud_only"
+            config = dict(config, cloud_only=True)
+        else:
+            raise PluginError("python_unavailable", f"No Python interpreter for stream processes. {PYTHON_REMEDIATION}",
+                              data={"venv_python": VENV_PYTHON})
+        status["remediation"] = PYTHON_REMEDIATION
+        warn("python_unavailable", f"No Python interpreter for stream processes, falling back to "
+             f"{status['fallback']}. {PYTHON_REMEDIATION}", component="bridge")
+        return config
+
+    def _apply_stream_backends(self, config: Dict[str, Any]):
+        """Set up the stream backends and check the deployment default"""
+        default = config.get("stream_backend", DEFAULT_STREAM_BACKEND)
+        if default not in STREAM_BACKENDS:
+            raise PluginError("invalid_params", f"stream_backend must be one of {', '.join(STREAM_BACKENDS)}")
+        self.stream_backends = {
+            "bridge": BridgeStreamBackend(),
+            "native": NativeStreamBackend(str(config.get("native_backend_path") or "")),
+        }
+        reason = self.stream_backends["native"].unavailable()
+        self.components["native_stream_backend"] = "unavailable" if reason else "ok"
+        if default == "native" and reason:
+            warn("stream_backend_unavailable", f"Native stream backend unavailable ({reason}), streaming through the bridge",
+                 component="bridge")
+
+    def _selected_backend(self, mac: str) -> str:
+        """Stream backend chosen for the camera, before falling back"""
+        return (self._camera_settings(mac).get("stream_backend") or self.config.get("stream_backend")
+                or DEFAULT_STREAM_BACKEND)
+
+    def _stream_backend(self, mac: str) -> StreamBackend:
+        """Backend that streams the camera; the bridge stands in for an unavailable one, and the
+        native backend for the bridge when there is no Python for stream processes"""
+        selected = self.stream_backends.get(self._selected_backend(mac), self.stream_backends["bridge"])
+        for backend in (selected, self.stream_backends["bridge"], self.stream_backends["native"]):
+            if not backend.unavailable():
+                return backend
+        return self.stream_backends["bridge"]
+
+    def _stream_backend_summary(self) -> Dict[str, Any]:
+        summary = {name: {"available": not backend.unavailable(), "reason": backend.unavailable(), "cameras": []}
+                   for name, backend in self.stream_backends.items()}
+        for mac in self.auth.cameras if self.auth else []:
+            summary[self._stream_backend(mac).name]["cameras"].append(mac)
+        return summary
+
+    def migrate_stream_backend(self, camera_ids: Optional[List[str]], backend: str) -> Dict[str, Any]:
+        """Move cameras to another stream backend, keeping them in the roster
+
+        The NVR gets camera.updated with the new stream URL before the old
+        stream is stopped, so go2rtc reconnects through the new backend.
+        """
+        if not self.auth:
+            raise PluginError("not_initialized")
+        if backend not in STREAM_BACKENDS:
+            raise PluginError("invalid_params", f"backend must be one of {', '.join(STREAM_BACKENDS)}")
+        reason = self.stream_backends[backend].unavailable()
+        if reason:
+            raise PluginError("stream_backend_unavailable", f"{backend} stream backend: {reason}",
+                              data={"backend": backend})
+        cameras = [self._require_camera(c) for c in camera_ids] if camera_ids else list(self.auth.cameras.values())
+
+        previous = {camera.mac: self._stream_backend(camera.mac) for camera in cameras}
+        for camera in cameras:
+            self.camera_store.update(camera.mac, {"stream_backend": backend})
+        self._check_published()
+
+        migrated, unchanged = [], []
+        for camera in cameras:
+            old = previous[camera.mac]
+            if old.name == backend:
+                unchanged.append(camera.mac)
+                continue
+            log(f"Moving {camera.mac} from the {old.name} to the {backend} stream backend", component="bridge")
+            try:
+                old.stop(camera.mac)
+            except (OSError, subprocess.SubprocessError) as e:
+                log(f"Failed to stop the {old.name} stream for {camera.mac}: {e}")
+            migrated.append({"camera_id": camera.mac, "from": old.name})
+        return {"backend": backend, "migrated": migrated, "unchanged": unchanged}
+
+    def _apply_scopes(self, config: Dict[str, Any]):
+        """Expand the scopes granted at initialize (all of them when none are declared) and the REST API's"""
+        declared = config.get("scopes")
+        self.scopes = set(SCOPES) if declared is None else expand_scopes(declared, "scopes")
+        if declared is not None:
+            log(f"Granted scopes: {', '.join(sorted(self.scopes))}")
+        rest = expand_scopes(config.get("rest_api_scopes", DEFAULT_REST_API_SCOPES), "rest_api_scopes")
+        self.rest_scopes = rest & self.scopes
+
+    def _check_scope(self, method: str, params: Dict[str, Any], scopes: Optional[set] = None):
+        """Reject methods outside the caller's scopes (the NVR's unless given)"""
+        scopes = self.scopes if scopes is None else scopes
+        # Until the first initialize nothing has been restricted
+        if scopes is None:
+            return
+        scope = METHOD_SCOPES.get(method, "admin")
+        if scope and scope not in scopes:
+            raise PluginError("forbidden", f"{method} requires the {scope} scope",
+                              params.get("camera_id") or params.get("mac"))
+
+    def _apply_limits(self, config: Dict[str, Any]):
+        """Set the request line limit and fit inline results under the NVR's line limit"""
+        low, high = MAX_REQUEST_BYTES_BOUNDS
+        try:
+            requested = int(config.get("max_request_bytes", DEFAULT_MAX_REQUEST_BYTES))
+        except (TypeError, ValueError):
+            raise PluginError("invalid_params", "max_request_bytes must be an integer")
+        self.max_request_bytes = min(max(requested, low), high)
+        low, high = NOTIFICATION_QUEUE_BOUNDS
+        try:
+            queue_size = int(config.get("notification_queue_size", DEFAULT_NOTIFICATION_QUEUE_SIZE))
+        except (TypeError, ValueError):
+            raise PluginError("invalid_params", "notification_queue_size must be an integer")
+        _stdout.limit = min(max(queue_size, low), high)
+
+        self.max_inline_bytes = int(config.get("max_inline_bytes", DEFAULT_MAX_INLINE_BYTES))
+        nvr_limit = config.get("nvr_max_line_bytes")
+        if nvr_limit:
+            # Anything bigger than the NVR can read in one line gets spilled
+            fit = max(int(nvr_limit) - MESSAGE_ENVELOPE_BYTES, 0)
+            if self.max_inline_bytes <= 0 or self.max_inline_bytes > fit:
+                log(f"Capping inline results at {fit} bytes for the NVR's {nvr_limit} byte line limit")
+                self.max_inline_bytes = fit
+
+    def _apply_log_levels(self, config: Dict[str, Any]):
+        """Start from the configured log_level and per-component log_levels"""
+        if "log_level" not in config and "log_levels" not in config:
+            return
+        levels = {"default": config.get("log_level", "info")}
+        levels.update(config.get("log_levels") or {})
+        for component, level in levels.items():
+            if component != "default" and component not in LOG_COMPONENTS:
+                raise PluginError("invalid_params", f"log_levels keys must be among {', '.join(LOG_COMPONENTS)}")
+            if level not in LOG_LEVELS:
+                raise PluginError("invalid_params", f"log level must be one of {', '.join(LOG_LEVELS)}")
+        save_log_levels(levels)
+
+    def set_log_level(self, level: Optional[str], component: Optional[str] = None,
+                      duration: Optional[int] = None) -> Dict[str, Any]:
+        """Change the default or one component's log level now, optionally reverting after duration seconds
+
+        level null clears a component override (back to the default level).
+        """
+        if component is not None and component not in LOG_COMPONENTS:
+            raise PluginError("invalid_params", f"component must be one of {', '.join(LOG_COMPONENTS)}")
+        if level is None and component is None:
+            raise PluginError("invalid_params", "level is required for the default log level")
+        if level is not None and level not in LOG_LEVELS:
+            raise PluginError("invalid_params", f"level must be one of {', '.join(LOG_LEVELS)}")
+        if duration is not None and (not isinstance(duration, int) or isinstance(duration, bool)
+                                     or not 0 < duration <= MAX_LOG_LEVEL_DURATION):
+            raise PluginError("invalid_params", f"duration must be 1-{MAX_LOG_LEVEL_DURATION} seconds")
+
+        current = current_log_levels()
+        levels = dict(current["levels"])
+        if level is None:
+            levels.pop(component, None)
+        else:
+            levels[component or "default"] = level
+        # A temporary change reverts to the levels in force before any pending temporary change
+        previous = dict(_log_state.get("previous") or current["levels"]) if current["revert_at"] else current["levels"]
+        revert_at = time.time() + duration if duration else None
+        save_log_levels(levels, revert_at, previous if duration else None)
+        log(f"Log levels now {levels}" + (f" for {duration}s" if duration else ""))
+        return self._log_levels()
+
+    def _log_levels(self) -> Dict[str, Any]:
+        current = current_log_levels()
+        return {
+            "levels": current["levels"],
+            "revert_at": format_time(current["revert_at"]) if current["revert_at"] else None,
+        }
+
+    def _limits(self) -> Dict[str, int]:
+        return {
+            "max_request_bytes": self.max_request_bytes,
+            "max_inline_bytes": self.max_inline_bytes,
+            "fetch_chunk_bytes": FETCH_CHUNK_SIZE,
+            "notification_queue_size": _stdout.limit,
+        }
+
+    def _finish_startup(self):
+        """Enumerate cameras (unless the auth cache had them), register them, then announce ready"""
+        delay = ENUMERATION_RETRY_MIN
+        while self.running and not self.auth.cameras:
+            try:
+                self.auth.enumerate_cameras()
+                break
+            except Exception as e:
+                log(f"Camera enumeration failed, retrying in {delay}s: {e}")
+                time.sleep(delay)
+                delay = min(delay * 2, ENUMERATION_RETRY_MAX)
+        if not self.running:
+            return
+
+        self._refresh_groups()
+        self.filter_verdicts = {mac: self._filter_reason(camera) for mac, camera in self.auth.cameras.items()}
+        # Cameras the filter now leaves out are withdrawn from the NVR
+        for mac, excluded in self.filter_verdicts.items():
+            if excluded and mac in self.published:
+                self._unpublish(mac, excluded)
+        # URLs may have moved since the last run (new venv path, cloud-only toggled, ...)
+        self._check_published()
+        summary = self._setup_summary()
+        for mac in summary["added"]:
+            # The NVR already has cameras from before an upgrade; _check_published covered changes
+            if mac not in self.upgrade_roster:
+                self._publish("camera.added", self.auth.cameras[mac])
+        for failure in summary["failed"]:
+            log(f"Camera {failure['camera_id']} not set up: {failure['message']}")
+        for mac in summary["added"]:
+            self._check_subscription(mac)
+        self.ready = True
+        notify("ready", dict(summary, cameras=len(self.auth.cameras)))
+
+        # Find LAN addresses; the cloud IPs are used until then
+        self._refresh_lan_hosts()
+
+    def verify_credentials(self, params: Dict[str, Any]) -> Dict[str, Any]:
+        """Try a Wyze login without touching plugin state (for "Test connection")"""
+        creds = resolve_secrets(params)
+        email = creds.get("email")
+        password = creds.get("password")
+        if not email or not password:
+            return {"success": False, "mfa_required": False, "reason": "missing_credentials",
+                    "message": "email and password are required"}
+
+        try:
+            auth_info = wyze_api("login", wyzecam.login, email, password, api_key=creds.get("api_key"),
+                                 key_id=creds.get("key_id"), idempotent=False)
+        except WyzeApiError as e:
+            status = e.status
+            e = e.cause
+            if status == 429:
+                reason = "rate_limited"
+            elif status in (400, 401, 403):
+                reason = "invalid_api_key" if creds.get("api_key") and "key" in str(e).lower() else "invalid_credentials"
+            elif isinstance(e, (OSError, urllib.error.URLError)) or type(e).__name__ in ("ConnectionError", "Timeout"):
+                reason = "network_error"
+            else:
+                reason = "login_failed"
+            return {"success": False, "mfa_required": False, "reason": reason, "message": str(e)}
+
+        if not getattr(auth_info, "access_token", None) and getattr(auth_info, "mfa_options", None):
+            return {"success": False, "mfa_required": True, "reason": "mfa_required",
+                    "message": "Two-factor authentication is required",
+                    "mfa_options": list(auth_info.mfa_options)}
+
+        result = {"success": True, "mfa_required": False, "reason": "", "message": "Login succeeded",
+                  "api_key": bool(creds.get("api_key"))}
+        try:
+            result["account"] = wyze_api("get_user_info", wyzecam.get_user_info, auth_info).nickname
+        except Exception as e:
+            log(f"verify_credentials: user info lookup failed: {e}")
+        return result
+
+    def _refresh_loop(self):
+        """Periodically re-run discovery and housekeeping"""
+        # Start at a random point in the schedule so restarted plugins don't align
+        next_discovery = time.time() + jittered(self._interval("discovery_interval"), self.config)
+        next_health = time.time() + jittered(self._interval("health_interval"), self.config)
+        next_properties = time.time() + jittered(self._interval("property_watch_interval"), self.config)
+        while self.running:
+            time.sleep(1)
+            self._check_liveness()
+            self._stream_modes()
+            if self.auth and self.ready:
+                self._expire_wakes()
+                self._flush_event_overflow(time.time())
+                self._flush_incidents(time.time())
+                due = self._due_event_polls(time.time())
+                if due:
+                    try:
+                        self._poll_events(due)
+                    except Exception as e:
+                        log(f"Event poll failed: {e}")
+                watch = self._interval("property_watch_interval")
+                if watch and time.time() >= next_properties:
+                    next_properties = time.time() + jittered(watch, self.config)
+                    try:
+                        self._watch_properties()
+                    except Exception as e:
+                        log(f"Property watch failed: {e}")
+            if self.janitor:
+                self.janitor.maybe_run()
+                if time.time() - self.janitor.last_disk_check >= DISK_CHECK_INTERVAL:
+                    self._check_disk()
+            if self.telemetry and self.auth:
+                self.telemetry.maybe_report(list(self.auth.cameras.values()))
+            if self.auth and time.time() >= next_health:
+                next_health = time.time() + jittered(self._interval("health_interval"), self.config)
+                try:
+                    self._check_quality()
+                except Exception as e:
+                    log(f"Adaptive quality check failed: {e}")
+                if self.ready:
+                    self._check_published()
+                    self._check_reconnects()
+                    self._check_crashes()
+                    self._check_dropped_notifications()
+                    self._write_ports()
+                    self._check_drift()
+                    self._purge_removed_cameras()
+                    self._sample_daily()
+
+            if not self.auth or not self.ready or time.time() < next_discovery:
+                continue
+            next_discovery = time.time() + jittered(self._interval("discovery_interval"), self.config)
+
+            try:
+                self._refresh_devices()
+            except Exception as e:
+                log(f"Device refresh failed: {e}")
+                if self.telemetry:
+                    self.telemetry.record_error(f"refresh:{type(e).__name__}")
+
+    def _on_token_invalid(self, stale: Any) -> Optional[Any]:
+        """Re-authenticate after Wyze rejected an access token mid-session (wyze_api retries with the result)"""
+        if not self.auth:
+            return None
+        with self.reauth_lock:
+            if self.auth.auth_info is not None and self.auth.auth_info is not stale:
+                # Another call already replaced it
+                return self.auth.auth_info
+            if time.time() - self.auth_status["last_failure_ts"] < REAUTH_BACKOFF:
+                return None
+            log("Wyze rejected the access token, re-authenticating")
+            try:
+                method = self.auth.reauthenticate()
+            except Exception as e:
+                error = e if isinstance(e, PluginError) else PluginError("auth_failed", f"Re-authentication failed: {e}")
+                self.auth_status.update(state="failed", last_failure_ts=time.time(), last_error=error.message)
+                log(f"Re-authentication failed: {error.message}")
+                notify("auth.failed", {"timestamp": format_time(time.time()), "reason": error.reason,
+                                       "message": error.message, "retry_after": REAUTH_BACKOFF})
+                return None
+            self.auth_status.update(state="ok", refreshes=self.auth_status["refreshes"] + 1,
+                                    last_refresh_ts=time.time(), last_method=method, last_error="")
+            notify("auth.refreshed", {"timestamp": format_time(time.time()), "method": method})
+            return self.auth.auth_info
+
+    def _auth_summary(self) -> Dict[str, Any]:
+        status = self.auth_status
+        return {
+            "state": status["state"],
+            "refreshes": status["refreshes"],
+            "last_refresh": format_time(status["last_refresh_ts"]) if status["last_refresh_ts"] else None,
+            "last_method": status["last_method"],
+            "last_failure": format_time(status["last_failure_ts"]) if status["last_failure_ts"] else None,
+            "last_error": status["last_error"],
+        }
+
+    def get_api_usage(self, camera_id: Optional[str] = None) -> Dict[str, Any]:
+        """Wyze cloud calls per endpoint and camera over rolling windows, with throttling warnings"""
+        windows = _api_usage.snapshot()
+        if camera_id:
+            mac = self._require_camera(camera_id).mac
+            for entry in windows.values():
+                entry["cameras"] = {mac: entry["cameras"].get(mac, 0)}
+
+        limits = dict(API_USAGE_LIMITS)
+        configured = self.config.get("api_usage_limits")
+        if isinstance(configured, dict):
+            limits.update({w: int(n) for w, n in configured.items()
+                           if w in API_USAGE_WINDOWS and isinstance(n, int) and n > 0})
+        usage, warnings = {}, []
+        for window, limit in limits.items():
+            used = windows[window]["total"]
+            usage[window] = {"limit": limit, "used": used, "fraction": round(used / limit, 3)}
+            if used >= limit * API_USAGE_WARN_FRACTION:
+                warnings.append(f"{used} Wyze API calls in the last {window} "
+                                f"({int(used * 100 / limit)}% of the informal limit of {limit})")
+        throttled = windows["1h"]["throttled"]
+        if throttled:
+            warnings.append(f"Wyze throttled {throttled} call(s) (HTTP 429) in the last 1h")
+        return {"windows": windows, "limits": usage, "warnings": warnings}
+
+    def _interval(self, key: str) -> int:
+        """Configured background interval, falling back to its default"""
+        defaults = {
+            "discovery_interval": DEFAULT_DISCOVERY_INTERVAL,
+            "health_interval": DEFAULT_HEALTH_INTERVAL,
+            "event_poll_interval": DEFAULT_EVENT_POLL_INTERVAL,
+            "property_watch_interval": 0,
+        }
+        return int(self.config.get(key, defaults[key]))
+
+    def _ingestion(self, mac: str) -> str:
+        """Effective ingestion profile for a camera"""
+        profile = self._camera_settings(mac).get("ingestion", self.config.get("ingestion", "continuous"))
+        return profile if profile in INGESTION_PROFILES else "continuous"
+
+    def _watch_properties(self):
+        """Send camera.property_changed for properties and firmware changed outside the NVR (Wyze app)
+
+        The first read of a camera only records its values.
+        """
+        watched = self.config.get("watched_properties") or WATCHED_PROPERTIES
+        for mac in list(self.auth.cameras):
+            camera = self.auth.get_camera(mac)
+            if not camera or mac in self.removed_cameras:
+                continue
+            values = {"firmware": getattr(camera, "firmware_ver", None) or ""}
+            try:
+                resp = wyze_api("get_property_list", post_device, self.auth.auth_info, "get_property_list", {
+                    "device_mac": mac,
+                    "device_model": camera.product_model,
+                    "target_pid_list": list(watched),
+                }, cameras=[mac])
+            except WyzeApiError as e:
+                log(f"Property watch of {mac} failed: {e}", "debug", "api")
+                resp = {}
+            pids = {name: pid for pid, name in watched.items()}
+            for prop in resp.get("property_list") or []:
+                if prop.get("pid") in watched:
+                    values[watched[prop["pid"]]] = str(prop.get("value"))
+
+            previous = self.camera_properties.get(mac)
+            self.camera_properties[mac] = dict(previous or {}, **values)
+            if previous is None:
+                continue
+            for name, value in values.items():
+                if name in previous and previous[name] != value:
+                    log(f"{camera.nickname} {name} changed: {previous[name]} -> {value}")
+                    notify("camera.property_changed", {
+                        "camera_id": mac,
+                        "property": name,
+                        "pid": pids.get(name),
+                        "old": previous[name],
+                        "new": value,
+                        "timestamp": format_time(time.time()),
+                    })
+
+    def _event_polling(self, mac: str) -> bool:
+        """Whether a camera's Wyze cloud events are polled"""
+        if self._ingestion(mac) == "event_only":
+            return True
+        return bool(self._camera_settings(mac).get("event_polling", self.config.get("event_polling", False)))
+
+    def _event_poll_interval(self, mac: str) -> int:
+        """Seconds between a camera's event polls"""
+        return int(self._camera_settings(mac).get("event_poll_interval", self._interval("event_poll_interval")))
+
+    def _polled_cameras(self) -> List[str]:
+        """Cameras whose events are polled"""
+        return [mac for mac in list(self.auth.cameras if self.auth else {})
+                if mac not in self.removed_cameras and self._event_polling(mac)]
+
+    def _due_event_polls(self, now: float) -> List[str]:
+        """Cameras to poll now; the plan follows per-camera settings as they change
+
+        A camera new to the plan is first polled one jittered interval later.
+        Cameras almost due are polled along with the due ones.
+        """
+        polled = self._polled_cameras()
+        for mac in set(self.event_schedule) - set(polled):
+            del self.event_schedule[mac]
+        for mac in polled:
+            self.event_schedule.setdefault(mac, now + jittered(self._event_poll_interval(mac), self.config))
+        if not any(self.event_schedule[mac] <= now for mac in polled):
+            return []
+        due = [mac for mac in polled
+               if self.event_schedule[mac] <= now + self._event_poll_interval(mac) * EVENT_POLL_COALESCE]
+        for mac in due:
+            self.event_schedule[mac] = now + jittered(self._event_poll_interval(mac), self.config)
+        return due
+
+    def _check_dropped_notifications(self):
+        """Warn once the NVR reads stdout again after notifications were dropped"""
+        status = _stdout.status()
+        dropped = status["dropped_total"] - self.dropped_notifications
+        if dropped > 0 and status["notifications_queued"] < _stdout.limit:
+            self.dropped_notifications = status["dropped_total"]
+            counts = ", ".join(f"{method} {count}" for method, count in sorted(status["dropped"].items()))
+            warn("notifications_dropped", f"Dropped {dropped} notification(s) while the NVR was not reading stdout "
+                 f"(total: {counts}); query_events has the camera.events", component="rpc")
+
+    def _event_poll_plan(self) -> Dict[str, Any]:
+        """Health annotation: polled cameras with their interval and next poll"""
+        return {mac: {"interval": self._event_poll_interval(mac),
+                      "next_poll": format_time(self.event_schedule[mac]) if mac in self.event_schedule else None}
+                for mac in self._polled_cameras()}
+
+    def _poll_events(self, macs: Optional[List[str]] = None):
+        """Fetch new Wyze cloud events, notify them and wake event_only cameras"""
+        if macs is None:
+            macs = self._polled_cameras()
+        if not macs:
+            return
+
+        now_ms = int(time.time() * 1000)
+        begin = min(self.event_cursors.get(mac, now_ms - self._event_poll_interval(mac) * 1000) for mac in macs)
+        resp = wyze_api("get_event_list", post_device, self.auth.auth_info, "get_event_list", {
+            "device_mac_list": macs,
+            "begin_time": begin,
+            "end_time": now_ms,
+            "count": EVENT_POLL_COUNT,
+            "order_by": 1,
+        }, cameras=macs)
+
+        for raw in sorted(resp.get("event_list") or [], key=lambda e: e.get("event_ts", 0)):
+            mac = raw.get("device_mac")
+            event_id = str(raw.get("event_id", ""))
+            if mac not in macs or event_id in self.seen_events:
+                continue
+            self.seen_events = (self.seen_events + [event_id])[-EVENT_SEEN_MAX:]
+            self.event_cursors[mac] = max(self.event_cursors.get(mac, 0), int(raw.get("event_ts", 0)))
+
+            event = self._to_camera_event(raw)
+            if event["tags"]:
+                self.ai_events[mac] = int(raw.get("event_ts", 0)) / 1000
+            if self._camera_settings(mac).get("privacy_masks"):
+                event["thumbnail_url"] = ""
+            # Wake right away; only the notification waits for the merge window
+            if self._ingestion(mac) == "event_only" and event["type"] in WAKE_EVENT_TYPES:
+                self._wake(mac, event)
+            window = self._event_merge_window(mac, event["type"])
+            for merged in self.event_merger.add(event, int(raw.get("event_ts", 0)) / 1000, window):
+                self._emit_event(merged)
+
+        for merged in self.event_merger.flush(now_ms / 1000):
+            self._emit_event(merged)
+        for mac in macs:
+            self.event_cursors.setdefault(mac, now_ms)
+
+    def _subscription(self, mac: str) -> Dict[str, Any]:
+        """A camera's Wyze plan: configured, or inferred from recent AI-tagged events"""
+        last_ai = self.ai_events.get(mac)
+        plan, source = self._camera_settings(mac).get("subscription", "auto"), "camera_settings"
+        if plan not in SUBSCRIPTION_FEATURES:
+            plan, source = self.config.get("subscription", "auto"), "config"
+        if plan not in SUBSCRIPTION_FEATURES:
+            # Only Cam Plus tags events; without tags we can't tell no plan from a quiet camera
+            recent = last_ai is not None and last_ai >= time.time() - SUBSCRIPTION_EVIDENCE_DAYS * 86400
+            plan, source = ("cam_plus", "events") if recent else ("unknown", "none")
+        return {
+            "camera_id": mac,
+            "plan": plan,
+            "source": source,
+            "features": list(SUBSCRIPTION_FEATURES.get(plan, [])),
+            "last_ai_event": format_time(last_ai) if last_ai else None,
+        }
+
+    def _check_subscription(self, mac: str) -> List[str]:
+        """Warn when a camera uses event features its Wyze plan doesn't include; returns the missing ones"""
+        subscription = self._subscription(mac)
+        if subscription["plan"] == "unknown":
+            return []
+        wanted = []
+        if self._event_polling(mac):
+            wanted.append("ai_tags")
+        if self._ingestion(mac) == "event_only":
+            wanted.append("no_event_cooldown")
+        missing = [feature for feature in wanted if feature not in subscription["features"]]
+        if missing:
+            limits = "; ".join(SUBSCRIPTION_FEATURE_LIMITS[feature] for feature in missing)
+            warn("subscription_required", f"{mac} uses Wyze events without Cam Plus "
+                 f"(plan {subscription['plan']}): {limits}", mac, "camera")
+        return missing
+
+    def get_subscriptions(self, camera_id: Optional[str] = None) -> Dict[str, Any]:
+        """Account health and each camera's Wyze plan, with event features it lacks"""
+        macs = [self._require_camera(camera_id).mac] if camera_id else \
+            [mac for mac in (self.auth.cameras if self.auth else {}) if mac not in self.removed_cameras]
+        cameras = []
+        for mac in macs:
+            entry = self._subscription(mac)
+            entry["missing_features"] = self._check_subscription(mac)
+            cameras.append(entry)
+        return {
+            "account": {
+                "authenticated": bool(self.auth and self.auth.auth_info),
+                "auth": self._auth_summary(),
+                "subscription": self.config.get("subscription", "auto"),
+            },
+            "cameras": cameras,
+        }
+
+    def _subscription_summary(self) -> Dict[str, int]:
+        """Health annotation: cameras per Wyze plan"""
+        counts: Dict[str, int] = {}
+        for mac in list(self.auth.cameras):
+            if mac not in self.removed_cameras:
+                plan = self._subscription(mac)["plan"]
+                counts[plan] = counts.get(plan, 0) + 1
+        return counts
+
+    def _event_merge_window(self, mac: str, event_type: str) -> int:
+        """Seconds within which further events on this camera join the same incident (0 = no merging)"""
+        window = self._camera_settings(mac).get("event_merge_window", self.config.get("event_merge_window", 0))
+        if isinstance(window, dict):
+            window = window.get(event_type, window.get("default", self.config.get("event_merge_window", 0)))
+        return int(window or 0)
+
+    def _emit_event(self, event: Dict[str, Any]):
+        """Send a camera.event unless the camera is over its event_rate_limit"""
+        mac = event["camera_id"]
+        limit = int(self._camera_settings(mac).get("event_rate_limit", self.config.get("event_rate_limit", 0)) or 0)
+        now = time.time()
+        with self.event_limiter_lock:
+            self._flush_event_overflow(now)
+            allowed = self.event_limiter.allow(event, limit, now)
+        if allowed:
+            notify("camera.event", event)
+            self._correlate(event)
+        else:
+            log(f"Event {event['event_id']} on {mac} over the rate limit of {limit}/min, summarizing", "debug", "camera")
+
+    def _correlate(self, event: Dict[str, Any]):
+        """Add a sent camera.event to the cross-camera incident it belongs to"""
+        window = min(int(self.config.get("incident_window", 0) or 0), MAX_INCIDENT_WINDOW)
+        if window <= 0 or self._camera_settings(event["camera_id"]).get("correlate", True) is False:
+            return
+        try:
+            ts = parse_time(event.get("start") or event["timestamp"])
+        except (KeyError, ValueError):
+            ts = time.time()
+        with self.incident_lock:
+            for incident in self.incidents.add(event, ts, window):
+                notify("incident", incident)
+
+    def _flush_incidents(self, until: Optional[float] = None):
+        """Send incidents whose window ended; polled events arrive up to one poll interval late"""
+        polled = self._polled_cameras()
+        grace = max(self._event_poll_interval(mac) for mac in polled) if polled and until is not None else 0
+        with self.incident_lock:
+            for incident in self.incidents.flush(None if until is None else until - grace):
+                notify("incident", incident)
+
+    def _flush_event_overflow(self, until: Optional[float] = None):
+        """Send the overflow summaries of rate limit windows that have ended"""
+        with self.event_limiter_lock:
+            for overflow in self.event_limiter.flush(until):
+                notify("camera.event", overflow)
+
+    def _to_camera_event(self, raw: Dict[str, Any]) -> Dict[str, Any]:
+        """Build the camera.event payload from a get_event_list entry"""
+        tags = [EVENT_TAG_TYPES.get(tag, f"tag_{tag}") for tag in raw.get("tag_list") or []]
+        value = str(raw.get("event_value", ""))
+        event_type = tags[0] if tags else EVENT_VALUE_TYPES.get(value, "motion")
+        thumbnail = next((f.get("url") for f in raw.get("file_list") or [] if f.get("type") == 1), "")
+        return {
+            "camera_id": raw.get("device_mac"),
+            "event_id": str(raw.get("event_id", "")),
+            "type": event_type,
+            "tags": tags,
+            "timestamp": format_time(int(raw.get("event_ts", 0)) / 1000),
+            "thumbnail_url": thumbnail or "",
+        }
+
+    def _wake(self, mac: str, trigger: Dict[str, Any], duration: Optional[int] = None):
+        """Open (or extend) an event_only camera's streaming window"""
+        if duration is None:
+            duration = int(self._camera_settings(mac).get(
+                "ingestion_cooldown", self.config.get("ingestion_cooldown", DEFAULT_INGESTION_COOLDOWN)))
+        was_awake = (read_wake(mac) or 0) >= time.time()
+        until = time.time() + duration
+        write_wake(mac, until)
+        if not was_awake:
+            log(f"Waking {mac} for {duration}s ({trigger.get('type')})")
+            notify("camera.ingestion_started", {"camera_id": mac, "until": format_time(until), "trigger": trigger})
+
+    def _expire_wakes(self):
+        """Stop event_only streams whose cooldown has run out"""
+        for mac in list(self.auth.cameras):
+            until = read_wake(mac)
+            if until is None or until >= time.time():
+                continue
+            clear_wake(mac)
+            log(f"Cooldown over for {mac}, stopping stream")
+            self._restart_stream(next((s for s in list_active_streams() if s["mac"] == mac), None))
+            notify("camera.ingestion_stopped", {"camera_id": mac})
+
+    def wake_camera(self, camera_id: str, duration: Optional[int] = None) -> Dict[str, Any]:
+        """Manually open an event_only camera's streaming window (e.g. for live view)"""
+        camera = self._require_camera(camera_id)
+        if self._ingestion(camera.mac) != "event_only":
+            raise PluginError("invalid_params", f"{camera.mac} is not an event_only camera", camera.mac)
+        if duration is not None and (not isinstance(duration, int) or duration <= 0):
+            raise PluginError("invalid_params", "duration must be a positive integer")
+        self._wake(camera.mac, {"type": "manual"}, duration)
+        return {"camera_id": camera.mac, "until": format_time(read_wake(camera.mac))}
+
+    def _check_quality(self):
+        """Step cameras with repeated failures or heavy frame loss down to SD, and retry later"""
+        if self.config.get("low_resource", False):
+            return  # already SD everywhere
+
+        now = time.time()
+        live = {s["mac"]: s for s in list_active_streams()}
+        fallbacks = load_quality_fallbacks()
+        changed = False
+        for mac in list(self.auth.cameras):
+            settings = self._camera_settings(mac)
+            if not settings.get("adaptive_quality", self.config.get("adaptive_quality", False)):
+                continue
+            if settings.get("quality") == "sd":
+                continue
+
+            # Count connection failures seen since the last check
+            history = load_connection_history(mac)
+            failures = history.get("failures", 0)
+            new_failures = failures - self.failure_counts.get(mac, failures)
+            self.failure_counts[mac] = failures
+            marks = [t for t in self.failure_marks.get(mac, []) if now - t < ADAPTIVE_WINDOW]
+            # An offline camera or expired login isn't something SD would fix
+            if (history.get("reconnect") or {}).get("failure") not in ("device_offline", "auth_expired"):
+                marks.extend([now] * max(new_failures, 0))
+            self.failure_marks[mac] = marks
+
+            stream = live.get(mac)
+            fallback = fallbacks.get(mac)
+            if fallback:
+                if now >= fallback["retry_at"]:
+                    del fallbacks[mac]
+                    changed = True
+                    self.failure_marks[mac] = []
+                    log(f"Retrying {settings.get('quality', 'auto')} quality for {mac}")
+                    notify("camera.quality_changed", {"camera_id": mac, "quality": settings.get("quality", "auto"),
+                                                      "previous": "sd", "reason": "retry"})
+                    self._restart_stream(stream)
+                continue
+
+            reason = None
+            if len(marks) >= ADAPTIVE_FAILURES:
+                reason = f"{len(marks)} connection failures in {ADAPTIVE_WINDOW // 60} minutes"
+            elif stream:
+                frames = stream.get("frames", 0)
+                dropped = stream.get("dropped_frames", 0)
+                if frames + dropped >= ADAPTIVE_MIN_FRAMES and dropped / (frames + dropped) >= ADAPTIVE_DROP_RATE:
+                    reason = f"{dropped * 100 // (frames + dropped)}% frames dropped"
+            if not reason:
+                continue
+
+            # Back off further each time the upgrade fails again
+            count = self.downgrade_counts.get(mac, 0)
+            self.downgrade_counts[mac] = count + 1
+            retry = int(self.config.get("adaptive_quality_retry", DEFAULT_ADAPTIVE_RETRY))
+            retry = min(retry * (2 ** count), ADAPTIVE_MAX_RETRY)
+            fallbacks[mac] = {"quality": "sd", "reason": reason, "since": now, "retry_at": now + retry}
+            changed = True
+            self.failure_marks[mac] = []
+            log(f"Stepping {mac} down to SD: {reason} (retry in {retry}s)")
+            notify("camera.quality_changed", {"camera_id": mac, "quality": "sd",
+                                              "previous": settings.get("quality", "auto"), "reason": reason})
+            self._restart_stream(stream)
+
+        if changed:
+            save_quality_fallbacks(fallbacks)
+
+    def _check_reconnects(self):
+        """Tell the NVR when a camera's stream starts retrying, recovers or is given up on (offline/online)"""
+        for stats in self.get_connection_stats():
+            mac = stats["camera_id"]
+            reconnect = stats["reconnect"]
+            key = (reconnect["state"], reconnect["failure"])
+            previous = self.reconnect_states.get(mac, ("idle", ""))
+            if reconnect["state"] == "connecting" or key == previous:
+                continue
+            self.reconnect_states[mac] = key
+            if reconnect["state"] == "idle" and previous[0] != "given_up":
+                continue
+            notify("camera.connection_state", {"camera_id": mac, **reconnect})
+            if reconnect["state"] == "given_up" and mac not in self.offline_cameras:
+                self.offline_cameras.add(mac)
+                notify("camera.offline", {"camera_id": mac, "failure": reconnect["failure"],
+                                          "since": reconnect["failing_since"]})
+            elif reconnect["state"] == "streaming" and mac in self.offline_cameras:
+                self.offline_cameras.discard(mac)
+                notify("camera.online", {"camera_id": mac})
+
+    def _check_crashes(self):
+        """Tell the NVR about stream processes that died on an unhandled error"""
+        for mac in list(self.auth.cameras):
+            history = load_connection_history(mac)
+            crashes = history.get("crashes", 0)
+            # The first look only takes the count, so crashes from before startup aren't reported
+            seen = self.crash_counts.setdefault(mac, crashes)
+            if crashes == seen:
+                continue
+            self.crash_counts[mac] = crashes
+            if crashes > seen:
+                notify("camera.stream_crashed", {
+                    "camera_id": mac,
+                    "error": history.get("last_crash", ""),
+                    "at": format_time(history.get("last_crash_at") or time.time()),
+                    "crashes": crashes,
+                    "restarts": history.get("restarts", 0),
+                })
+
+    def subscribe_events(self, types: Any) -> Dict[str, Any]:
+        """Choose which notifications are sent on stdout (webhook delivery and the event store get all)"""
+        global _stdout_subscriptions
+        if not isinstance(types, list) or not all(isinstance(t, str) and t for t in types):
+            raise PluginError("invalid_params", "types must be a list of notification names or * patterns")
+        unknown = [t for t in types if not fnmatch.filter(NOTIFICATION_TYPES, t)]
+        if unknown:
+            raise PluginError("invalid_params", f"No notification matches {', '.join(unknown)}")
+        _stdout_subscriptions = None if "*" in types else list(types)
+        return {
+            "types": list(types) if _stdout_subscriptions is not None else ["*"],
+            "subscribed": [t for t in NOTIFICATION_TYPES if stdout_subscribed(t)],
+        }
+
+    def _config_drift(self) -> Dict[str, Any]:
+        """Compare config.json and running streams with the configuration that should be applied"""
+        expected = config_hash(self.config)
+        streams = [s["mac"] for s in list_active_streams()
+                   if s.get("config_hash") and s["config_hash"] != config_hash(self.config, self._camera_settings(s["mac"]))]
+        config_file = config_hash(load_config()) != expected
+        return {
+            "drifted": config_file or bool(streams),
+            "config_file": config_file,
+            "streams": sorted(streams),
+            "expected_hash": expected,
+        }
+
+    def _check_drift(self):
+        """Log when drift appears or clears"""
+        drift = self._config_drift()
+        key = (drift["config_file"], tuple(drift["streams"]))
+        if key == self.last_drift:
+            return
+        self.last_drift = key
+        if drift["drifted"]:
+            log(f"Configuration drift: config file {'stale' if drift['config_file'] else 'ok'}, "
+                f"streams on old config: {', '.join(drift['streams']) or 'none'}")
+        else:
+            log("Configuration drift cleared")
+
+    def reconcile_bridge(self) -> Dict[str, Any]:
+        """Rewrite config.json and restart streams running with an outdated configuration"""
+        if not self.auth:
+            raise PluginError("not_initialized")
+        drift = self._config_drift()
+        if drift["config_file"]:
+            log("Rewriting config.json")
+            save_config(self.config)
+        live = {s["mac"]: s for s in list_active_streams()}
+        for mac in drift["streams"]:
+            log(f"Restarting stream for {mac} to apply the current configuration")
+            self._restart_stream(live.get(mac))
+        return {
+            "config_file_rewritten": drift["config_file"],
+            "restarted": drift["streams"],
+            "drift": self._config_drift(),
+        }
+
+    def _restart_stream(self, stream: Optional[Dict[str, Any]]):
+        """Stop a running stream process; go2rtc reconnects with the new settings"""
+        if not stream:
+            return
+        try:
+            kill_process_tree(int(stream["pid"]))
+        except (OSError, subprocess.SubprocessError) as e:
+            log(f"Failed to restart stream {stream.get('pid')}: {e}")
+
+    def _check_liveness(self):
+        """Shut down if the NVR stopped pinging us (e.g. it crashed)"""
+        timeout = int(self.config.get("ping_timeout", 0))
+        if timeout <= 0 or time.monotonic() - self.last_ping < timeout:
+            return
+
+        log(f"No ping from NVR for {timeout}s, shutting down")
+        if IS_WINDOWS:
+            # os.kill would terminate us without running shutdown
+            self.shutdown()
+            os._exit(0)
+        # Route through the signal handler so shutdown runs on the main thread
+        os.kill(os.getpid(), signal.SIGTERM)
+
+    def ping(self) -> Dict[str, Any]:
+        """Keepalive from the NVR"""
+        self.last_ping = time.monotonic()
+        self.ping_seq += 1
+        return {
+            "seq": self.ping_seq,
+            "uptime": int(time.monotonic() - self.started_at),
+            "protocol_version": PROTOCOL_VERSION,
+            "version": get_plugin_version(),
+        }
+
+    def _refresh_lan_hosts(self):
+        """Find camera IPs on the LAN with a TUTK LAN search"""
+        if not self.tutk_lib or not self.auth:
+            return
+        try:
+            found = lan_search(self._command_sessions())
+        except Exception as e:
+            log(f"LAN search failed: {e}")
+            return
+
+        now = time.time()
+        for camera in list(self.auth.cameras.values()):
+            uid = getattr(camera, 'p2p_id', None)
+            if uid and uid in found:
+                self.lan_hosts[camera.mac] = dict(found[uid], seen=now)
+        log(f"LAN search found {len(found)} devices")
+
+    def _stream_modes(self) -> Dict[str, str]:
+        """Connection mode per streaming camera, rescanned at most every STREAM_STATE_TTL seconds
+
+        Building a camera payload used to scan every stream state file, so
+        list_cameras read the run directory once per camera.
+        """
+        with self.stream_modes_lock:
+            if time.monotonic() - self.stream_modes_at >= STREAM_STATE_TTL:
+                self.stream_modes = stream_mode_by_mac()
+                self.stream_modes_at = time.monotonic()
+            return self.stream_modes
+
+    def _camera_host(self, camera: wyzecam.WyzeCamera) -> tuple:
+        """Get (host, source) preferring the LAN search result over the cloud-reported IP"""
+        lan = self.lan_hosts.get(camera.mac)
+        if lan:
+            return lan["ip"], "lan"
+        return getattr(camera, 'ip', '') or "", "cloud"
+
+    def probe_camera(self, camera_id: str) -> Dict[str, Any]:
+        """Network diagnostics for a camera"""
+        camera = self._require_camera(camera_id)
+        host, source = self._camera_host(camera)
+        result: Dict[str, Any] = {"camera_id": camera.mac, "host": host, "host_source": source}
+        lan = self.lan_hosts.get(camera.mac)
+        if lan:
+            result["lan_port"] = lan["port"]
+            result["lan_seen"] = format_time(lan["seen"])
+        result["ping"] = ping_host(host) if host else {"reachable": False, "rtt_ms": None}
+        return result
+
+    def run_selfcheck(self, camera_id: str) -> Dict[str, Any]:
+        """Walk one camera through every path the NVR depends on and report each step
+
+        Steps that depend on a failed one are skipped, so the first failure
+        points at where the camera breaks.
+        """
+        camera = self._require_camera(camera_id)
+        cloud_only = bool(self.config.get("cloud_only", False))
+        scratch = os.path.join(RUN_DIR, f"selfcheck-{camera.mac}.jpg")
+        started = time.monotonic()
+        steps: List[Dict[str, Any]] = []
+
+        def check_auth():
+            account = wyze_api("get_user_info", wyzecam.get_user_info, self.auth.auth_info)
+            return "pass", f"Signed in as {account.nickname}", {}
+
+        def check_account():
+            if camera.mac in self.removed_from_account:
+                return "fail", "Camera is missing from the Wyze account", {}
+            if not cloud_only and not (getattr(camera, "p2p_id", None) and getattr(camera, "enr", None)):
+                return "fail", "Wyze returned no p2p_id/enr, so the camera cannot stream", {}
+            return "pass", f"On the account as {camera.product_model}", {
+                "model": camera.product_model, "firmware": getattr(camera, "firmware_ver", None) or ""}
+
+        def check_properties():
+            resp = wyze_api("get_property_list", post_device, self.auth.auth_info, "get_property_list", {
+                "device_mac": camera.mac,
+                "device_model": camera.product_model,
+                "target_pid_list": [],
+            }, cameras=[camera.mac])
+            count = len(resp.get("property_list") or [])
+            return "pass", f"Read {count} properties from the Wyze cloud", {"properties": count}
+
+        def check_network():
+            host, source = self._camera_host(camera)
+            if not host:
+                return "skipped", "No camera address known", {}
+            ping = ping_host(host)
+            if not ping["reachable"]:
+                return "fail", f"{host} does not answer ping (a P2P relay may still work)", {"host": host}
+            return "pass", f"{host} ({source}) answers in {ping['rtt_ms']}ms", {"host": host, "rtt_ms": ping["rtt_ms"]}
+
+        def check_command():
+            if cloud_only:
+                return "skipped", "cloud_only mode has no TUTK connection", {}
+            enabled = self._camera_commands(camera, [_OnOffMessage(MOTION_ALARM_COMMANDS[0])])[0]
+            return "pass", "Camera answered a TUTK command", {"motion_detection": enabled}
+
+        def check_stream():
+            if cloud_only or self._ingestion(camera.mac) == "disabled":
+                return "skipped", "Camera has no live stream (cloud_only or ingestion disabled)", {}
+            backend = self._stream_backend(camera.mac)
+            capture_stream_snapshot(camera.mac, scratch, SELFCHECK_TIMEOUT, backend.command(camera.mac))
+            return "pass", f"Decoded a frame through the {backend.name} backend", {
+                "backend": backend.name, "bytes": os.path.getsize(scratch)}
+
+        def check_snapshot():
+            mode = self._snapshot_mode(camera.mac)
+            if mode == "disabled":
+                return "skipped", "Snapshots are disabled for this camera", {}
+            self._capture_snapshot(camera, mode, scratch, SELFCHECK_TIMEOUT)
+            return "pass", f"Fetched a {mode} snapshot", {"mode": mode, "bytes": os.path.getsize(scratch)}
+
+        def check_events():
+            now_ms = int(time.time() * 1000)
+            resp = wyze_api("get_event_list", post_device, self.auth.auth_info, "get_event_list", {
+                "device_mac_list": [camera.mac],
+                "begin_time": now_ms - SELFCHECK_EVENT_LOOKBACK * 1000,
+                "end_time": now_ms,
+                "count": EVENT_POLL_COUNT,
+                "order_by": 2,
+            }, cameras=[camera.mac])
+            events = resp.get("event_list") or []
+            details: Dict[str, Any] = {"events": len(events)}
+            if events:
+                details["last_event"] = format_time(max(int(e.get("event_ts", 0)) for e in events) / 1000)
+            return "pass", f"{len(events)} Wyze events in the last 24h", details
+
+        plan = [
+            ("auth", check_auth, ()),
+            ("account", check_account, ()),
+            ("properties", check_properties, ("auth", "account")),
+            ("network", check_network, ()),
+            ("command", check_command, ("account",)),
+            ("stream", check_stream, ("account",)),
+            ("snapshot", check_snapshot, ("auth", "account")),
+            ("events", check_events, ("auth",)),
+        ]
+        for name, check, needs in plan:
+            blocked = [s["step"] for s in steps if s["step"] in needs and s["status"] != "pass"]
+            if blocked:
+                steps.append({"step": name, "status": "skipped", "message": f"Needs {', '.join(blocked)}",
+                              "duration_ms": 0})
+                continue
+            step_started = time.monotonic()
+            try:
+                status, message, details = check()
+            except PluginError as e:
+                status, message, details = "fail", e.message, {"reason": e.reason}
+            except Exception as e:
+                status, message, details = "fail", str(e) or type(e).__name__, {}
+            steps.append({"step": name, "status": status, "message": message,
+                          "duration_ms": round((time.monotonic() - step_started) * 1000), **details})
+        try:
+            os.remove(scratch)
+        except OSError:
+            pass
+
+        failed = [s["step"] for s in steps if s["status"] == "fail"]
+        log(f"Self-check of {camera.mac}: " + (f"failed at {failed[0]}" if failed else "passed"), component="camera")
+        return {
+            "camera_id": camera.mac,
+            "passed": not failed,
+            "failed_step": failed[0] if failed else None,
+            "steps": steps,
+            "duration_ms": round((time.monotonic() - started) * 1000),
+        }
+
+    def _refresh_devices(self):
+        """Pick up cameras newly added to the Wyze account"""
+        new_cameras, missing = self.auth.refresh_cameras()
+        self._refresh_lan_hosts()
+        if _event_store:
+            _event_store.prune(int(self.config.get("event_retention_days", DEFAULT_EVENT_RETENTION_DAYS)))
+
+        for camera in new_cameras:
+            # Back on the account after auto-removal: it is a new camera again
+            if self.removed_cameras.get(camera.mac, {}).get("reason") == "removed_from_account":
+                self._forget_removed(camera.mac)
+            notify("camera.discovered", self._to_discovered_camera(camera))
+        self._reconcile_filter()
+
+        # Cameras that came back are no longer candidates for removal
+        for mac in list(self.missing_counts):
+            if mac not in missing:
+                self.missing_counts.pop(mac)
+                self.removed_from_account.discard(mac)
+
+        threshold = int(self.config.get("removed_camera_threshold", DEFAULT_REMOVED_CAMERA_THRESHOLD))
+        for mac in missing:
+            self.missing_counts[mac] = self.missing_counts.get(mac, 0) + 1
+            if self.missing_counts[mac] < threshold or mac in self.removed_from_account:
+                continue
 
-            # Stream video frames to stdout
-            # recv_video_data yields raw H264 NAL units
-            for frame in session.recv_video_data():
-                if frame:
-                    # Output raw H264 data to stdout
-                    sys.stdout.buffer.write(frame)
-                    sys.stdout.buffer.flush()
+            log(f"Camera {mac} missing from account for {self.missing_counts[mac]} refreshes")
+            self.removed_from_account.add(mac)
+            camera = self.auth.get_camera(mac)
+            if camera:
+                notify("camera.removed_from_account", self._to_plugin_camera(camera))
 
-    except KeyboardInterrupt:
-        log("Stream interrupted")
-    except Exception as e:
-        # Log error details on separate lines to avoid truncation
-        log(f"Stream error type: {type(e).__name__}")
-        log(f"Stream error message: {str(e)}")
-        # Log traceback lines individually
-        for line in traceback.format_exception(e):
-            for subline in line.strip().split('\n'):
-                if subline.strip():
-                    log(f"  {subline}")
-    finally:
+            if self.config.get("auto_remove_cameras", False):
+                if camera:
+                    self._soft_delete(camera, "removed_from_account")
+                self.auth.forget_camera(mac)
+                self.published.pop(mac, None)
+                self.missing_counts.pop(mac, None)
+                self.removed_from_account.discard(mac)
+                notify("camera.removed", {"id": mac})
+
+    def _filter_reason(self, camera: wyzecam.WyzeCamera) -> Optional[str]:
+        """Why the camera filter leaves a camera out, or None when it is included"""
+        return self.camera_filter.reason(camera, self.camera_groups.get(camera.mac, []),
+                                         self._camera_settings(camera.mac).get("tags") or [])
+
+    def _refresh_groups(self):
+        """Fetch Wyze device groups (rooms) when a filter rule matches on them"""
+        if not self.camera_filter.needs_groups:
+            return
         try:
-            iotc.deinitialize()
-        except:
-            pass
+            data = wyze_api("get_homepage_object_list", wyzecam.api.get_homepage_object_list, self.auth.auth_info)
+        except WyzeApiError as e:
+            warn("camera_groups_unavailable", f"Wyze device groups could not be fetched for camera_filter: {e}",
+                 component="api")
+            return
+        groups: Dict[str, List[str]] = {}
+        for group in data.get("device_group_list") or []:
+            for device in group.get("device_list") or []:
+                groups.setdefault(device.get("device_mac"), []).append(str(group.get("group_name") or ""))
+        self.camera_groups = groups
 
-    log("Stream ended")
+    def _reconcile_filter(self):
+        """Re-apply the camera filter after a refresh: groups, tags or the roster may have changed
 
+        Newly included cameras are added when auto_add_cameras is on (new
+        cameras on the account included), newly excluded ones withdrawn.
+        """
+        self._refresh_groups()
+        auto_add = self.config.get("auto_add_cameras", True)
+        for mac, camera in list(self.auth.cameras.items()):
+            if mac in self.removed_cameras or mac in self.removed_from_account:
+                continue
+            excluded = self._filter_reason(camera)
+            known = mac in self.filter_verdicts
+            previous = self.filter_verdicts.get(mac)
+            self.filter_verdicts[mac] = excluded
+            if known and excluded == previous:
+                continue
+            if excluded and mac in self.published:
+                self._unpublish(mac, excluded)
+            elif not excluded and auto_add and mac not in self.published:
+                log(f"Camera {mac} now included by the camera filter")
+                self._publish("camera.added", camera)
 
-class WyzePlugin:
-    """Main plugin class for JSON-RPC communication"""
+    def _unpublish(self, mac: str, reason: str):
+        """Withdraw a camera from the NVR without removing it (it may be included again)"""
+        log(f"Camera {mac} left out by the camera filter ({reason})")
+        self.published.pop(mac, None)
+        try:
+            save_published_urls(self.published)
+        except OSError as e:
+            log(f"Failed to save published URLs: {e}")
+        try:
+            self._stream_backend(mac).stop(mac)
+        except (OSError, subprocess.SubprocessError) as e:
+            log(f"Failed to stop the stream for {mac}: {e}")
+        notify("camera.removed", {"id": mac, "reason": reason})
 
-    def __init__(self):
-        self.config: Dict[str, Any] = {}
-        self.auth: Optional[WyzeAuth] = None
-        self.tutk_lib: Optional[str] = None
-        self.running = True
+    def _soft_delete(self, camera: wyzecam.WyzeCamera, reason: str):
+        """Remember a removed camera; its settings and history are kept until the retention period ends"""
+        self.removed_cameras[camera.mac] = {
+            "name": self._camera_settings(camera.mac).get("name") or camera.nickname,
+            "model": camera.product_model,
+            "removed_at": time.time(),
+            "reason": reason,
+        }
+        save_removed_cameras(self.removed_cameras)
 
-    def initialize(self, config: Dict[str, Any]) -> Dict[str, Any]:
-        """Initialize the plugin with configuration"""
-        self.config = config
+    def _forget_removed(self, mac: str):
+        self.removed_cameras.pop(mac, None)
+        save_removed_cameras(self.removed_cameras)
 
-        # Save config for streaming subprocess
-        save_config(config)
+    def _removed_retention(self) -> int:
+        return int(self.config.get("removed_camera_retention_days", DEFAULT_REMOVED_CAMERA_RETENTION_DAYS)) * 86400
 
-        # Get TUTK library
-        self.tutk_lib = get_tutk_library()
-        if not self.tutk_lib:
-            raise RuntimeError("Failed to download TUTK library")
+    def _purge_removed_cameras(self):
+        """Permanently drop settings and history of cameras removed longer ago than the retention period"""
+        expired = [mac for mac, entry in self.removed_cameras.items()
+                   if time.time() - entry["removed_at"] > self._removed_retention()]
+        for mac in expired:
+            log(f"Purging removed camera {mac}")
+            self.camera_store.update(mac, {}, replace=True)
+            if self.arm_states.pop(mac, None):
+                save_arm_states(self.arm_states)
+            for path in (_stats_file(mac), os.path.join(PLUGIN_DIR, "snapshots", f"{mac}.jpg")):
+                try:
+                    os.remove(path)
+                except OSError:
+                    pass
+            self._forget_removed(mac)
 
-        # Authenticate and get cameras
-        self.auth = WyzeAuth(config)
-        self.auth.login()
+    def remove_camera(self, camera_id: str) -> Dict[str, Any]:
+        """Take a camera out of the roster, keeping its settings for restore_camera"""
+        camera = self._require_camera(camera_id)
+        self._soft_delete(camera, "removed")
+        self.published.pop(camera.mac, None)
+        try:
+            save_published_urls(self.published)
+        except OSError as e:
+            log(f"Failed to save published URLs: {e}")
+        try:
+            self._stream_backend(camera.mac).stop(camera.mac)
+        except (OSError, subprocess.SubprocessError) as e:
+            log(f"Failed to stop the stream for removed camera {camera.mac}: {e}")
+        log(f"Camera {camera.mac} removed; restorable for {self._removed_retention() // 86400} days")
+        notify("camera.removed", {"id": camera.mac})
+        return self._to_removed_camera(camera.mac)
 
-        return {"status": "ok", "cameras": len(self.auth.cameras)}
+    def list_removed_cameras(self) -> List[Dict[str, Any]]:
+        """Removed cameras that can still be restored"""
+        return [self._to_removed_camera(mac) for mac in sorted(self.removed_cameras)]
+
+    def _to_removed_camera(self, mac: str) -> Dict[str, Any]:
+        entry = self.removed_cameras[mac]
+        return {
+            "camera_id": mac,
+            "name": entry["name"],
+            "model": entry["model"],
+            "reason": entry["reason"],
+            "removed_at": format_time(entry["removed_at"]),
+            "expires_at": format_time(entry["removed_at"] + self._removed_retention()),
+            "on_account": bool(self.auth and self.auth.get_camera(mac)),
+            "settings": self.camera_store.get(mac),
+        }
+
+    def restore_camera(self, camera_id: str) -> Dict[str, Any]:
+        """Bring back a removed camera with its settings and announce it again"""
+        if not self.auth:
+            raise PluginError("not_initialized")
+        if camera_id not in self.removed_cameras:
+            raise PluginError("camera_not_found", f"No removed camera {camera_id}", camera_id)
+        camera = self.auth.get_camera(camera_id)
+        if not camera:
+            raise PluginError("camera_not_found", f"Camera {camera_id} is no longer on the Wyze account", camera_id)
+        self._forget_removed(camera.mac)
+        log(f"Camera {camera.mac} restored")
+        payload = self._to_plugin_camera(camera)
+        self._publish("camera.added", camera, payload)
+        return payload
+
+    def _publish(self, event: str, camera: wyzecam.WyzeCamera, payload: Optional[Dict[str, Any]] = None):
+        """Notify the NVR about a camera and remember the endpoints it was given"""
+        payload = payload or self._to_plugin_camera(camera)
+        self.published[camera.mac] = {field: payload.get(field, "") for field in PUBLISHED_FIELDS}
+        try:
+            save_published_urls(self.published)
+        except OSError as e:
+            log(f"Failed to save published URLs: {e}")
+        notify(event, payload)
+
+    def _check_published(self):
+        """Send camera.updated for any camera whose name or URLs differ from what the NVR has"""
+        if not self.auth:
+            return
+        for mac, previous in list(self.published.items()):
+            camera = self.auth.get_camera(mac)
+            if not camera:
+                continue
+            payload = self._to_plugin_camera(camera)
+            current = {field: payload.get(field, "") for field in PUBLISHED_FIELDS}
+            if current != previous:
+                changed = [field for field in PUBLISHED_FIELDS if current[field] != previous.get(field)]
+                log(f"Camera {mac} endpoints changed: {', '.join(changed)}")
+                self._publish("camera.updated", camera, payload)
 
     def shutdown(self) -> Dict[str, Any]:
-        """Shutdown the plugin"""
+        """Shutdown the plugin, letting in-flight requests finish first"""
         log("Shutting down...")
+        self.draining = True
+        self._drain()
         self.running = False
+        for merged in self.event_merger.flush():
+            self._emit_event(merged)
+        self._flush_event_overflow()
+        self._flush_incidents()
+        if self.rest_api:
+            self.rest_api.stop()
+            self.rest_api = None
+        if self.healthz:
+            self.healthz.stop()
+            self.healthz = None
+        try:
+            os.remove(PORTS_FILE)
+        except OSError:
+            pass
+        for moving in list(self.ptz_moves.values()):
+            moving.set()
+        with self.command_sessions_lock:
+            if self.command_sessions:
+                self.command_sessions.close_all()
+                self.command_sessions = None
+        stop_all_children()
         return {"status": "ok"}
 
+    def _drain(self):
+        """Wait for requests on other threads (or interrupted by a signal) up to the drain deadline"""
+        timeout = float(self.config.get("shutdown_drain_timeout", DEFAULT_SHUTDOWN_DRAIN_TIMEOUT))
+        deadline = time.monotonic() + timeout
+        me = threading.get_ident()
+        with self.inflight_cond:
+            while True:
+                pending = [r for r in self.inflight.values() if r[1] != me]
+                remaining = deadline - time.monotonic()
+                if not pending or remaining <= 0:
+                    break
+                log(f"Draining {len(pending)} in-flight requests...")
+                self.inflight_cond.wait(remaining)
+        if pending:
+            log(f"Drain deadline passed, cancelling {len(pending)} requests")
+            self.drain_expired = True
+
+    def parse_failed(self, line: bytes, reason: str):
+        """Count and dead-letter an unparseable stdin line"""
+        self.parse_errors[reason] += 1
+        self.parse_errors["last_at"] = format_time(time.time())
+        if not (self.janitor and self.janitor.low_disk):
+            dead_letter(line, reason, len(line))
+
+    def _check_disk(self):
+        """Re-check the plugin directory's disk and announce state changes"""
+        if not self.janitor.check_disk():
+            return
+        disk = self.janitor.disk
+        if disk["state"] == "ok":
+            log("Storage recovered")
+        else:
+            log(f"Storage {disk['state']}: {'; '.join(disk['warnings'])}"
+                + (", pausing timeline thumbnails and dead-letter logs" if disk["state"] == "low" else ""), "warning")
+        notify("storage.state_changed", disk)
+
+    def interrupted_requests(self) -> List[Any]:
+        """IDs of requests on the current thread that a signal cut short"""
+        me = threading.get_ident()
+        with self.inflight_cond:
+            return [r[0] for r in self.inflight.values() if r[1] == me and r[0] is not None]
+
     def health(self) -> Dict[str, Any]:
         """Return health status"""
         if not self.auth or not self.auth.auth_info:
             return {
                 "state": "unhealthy",
                 "message": "Not authenticated to Wyze",
-                "last_check": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+                "last_check": format_time(time.time()),
                 "details": {"authenticated": False}
             }
 
+        connections = self._connection_summary()
+        state = "healthy"
+        message = f"{len(self.auth.cameras)} cameras available"
+        if connections["degraded"]:
+            state = "degraded"
+            message += f", {len(connections['degraded'])} with poor connections"
+        if connections["unreachable"]:
+            state = "degraded"
+            message += f", {len(connections['unreachable'])} unreachable"
+        drift = self._config_drift()
+        if drift["drifted"]:
+            state = "degraded"
+            message += ", configuration drift (see reconcile_bridge)"
+        if self.auth_status["state"] == "failed":
+            state = "degraded"
+            message += f", re-authentication failed: {self.auth_status['last_error']}"
+        api_usage = self.get_api_usage()
+        if api_usage["warnings"]:
+            state = "degraded"
+            message += f", {api_usage['warnings'][0]}"
+        if self.janitor and self.janitor.disk["state"] != "ok":
+            state = "degraded"
+            message += f", storage {self.janitor.disk['state']}: {self.janitor.disk['warnings'][0]}"
+
         return {
-            "state": "healthy",
-            "message": f"{len(self.auth.cameras)} cameras available",
-            "last_check": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+            "state": state,
+            "message": message,
+            "last_check": format_time(time.time()),
             "details": {
                 "cameras_total": len(self.auth.cameras),
                 "authenticated": True,
+                "ready": self.ready,
+                "cloud_only": bool(self.config.get("cloud_only", False)),
+                "wyzecam_source": get_wyzecam_source(),
+                "bridge_source": "{}@{}".format(*bridge_source(self.config)),
+                "storage": self.janitor.status() if self.janitor else {},
+                "connections": connections,
+                "wyze_api": _api_metrics.snapshot(),
+                "config_drift": drift,
+                "parse_errors": dict(self.parse_errors),
+                "command_sessions": self.command_sessions.status() if self.command_sessions else [],
+                "local_detection": self._detection_summary(),
+                "log_levels": self._log_levels(),
+                "auth": self._auth_summary(),
+                "dns": dns_status(),
+                "timezone": timezone_status(),
+                "stream_backends": self._stream_backend_summary(),
+                "api_usage": {"limits": api_usage["limits"], "warnings": api_usage["warnings"]},
+                "snapshots": self.snapshot_limiter.status(),
+                "subscriptions": self._subscription_summary(),
+                "event_polling": self._event_poll_plan(),
+                "notifications": _stdout.status(),
             }
         }
 
+    def _connection_summary(self) -> Dict[str, Any]:
+        """Health annotation: active streams by route and cameras with poor connections"""
+        stats = self.get_connection_stats()
+        by_mode: Dict[str, int] = {}
+        for s in stats:
+            if s["streaming"]:
+                mode = s["connection_mode"] or "unknown"
+                by_mode[mode] = by_mode.get(mode, 0) + 1
+        return {
+            "streaming": sum(by_mode.values()),
+            "by_mode": by_mode,
+            "degraded": [s["camera_id"] for s in stats if s["drop_rate"] >= DEGRADED_DROP_RATE],
+            "unreachable": [s["camera_id"] for s in stats if s["reconnect"]["state"] == "given_up"],
+        }
+
     def discover_cameras(self) -> List[Dict[str, Any]]:
         """Return list of discovered cameras"""
         if not self.auth:
             return []
 
-        result = []
-        for camera in self.auth.cameras.values():
-            result.append({
-                "id": camera.mac,
-                "name": camera.nickname,
-                "model": camera.product_model,
-                "manufacturer": "Wyze",
-                "capabilities": self._get_capabilities(camera),
-                "firmware_version": getattr(camera, 'firmware_ver', ''),
-                "serial": camera.mac,
-            })
-        return result
+        return [self._to_discovered_camera(camera) for camera in self.auth.cameras.values()]
+
+    def start_discovery(self, probe: bool = True) -> Dict[str, Any]:
+        """Fetch the account's cameras in the background, reporting each one as it is enriched
+
+        Returns at once; discovery.progress follows per camera and
+        discovery.completed at the end. Only one discovery runs at a time.
+        """
+        if not self.auth:
+            raise PluginError("not_initialized")
+        with self.discovery_lock:
+            if self.discovery and self.discovery["status"] == "running":
+                return {"discovery_id": self.discovery["id"], "status": "running"}
+            self.discovery = {"id": uuid.uuid4().hex[:12], "status": "running", "cancel": threading.Event()}
+            job = self.discovery
+        threading.Thread(target=self._run_discovery, args=(job, bool(probe)), daemon=True).start()
+        return {"discovery_id": job["id"], "status": "running"}
+
+    def cancel_discovery(self, discovery_id: str) -> Dict[str, Any]:
+        """Stop a running discovery; cameras already reported stay reported"""
+        job = self.discovery
+        if not job or job["id"] != discovery_id:
+            raise PluginError("invalid_params", f"Unknown discovery_id: {discovery_id}")
+        if job["status"] == "running":
+            job["cancel"].set()
+        return {"discovery_id": job["id"], "status": "cancelling" if job["status"] == "running" else job["status"]}
+
+    def _run_discovery(self, job: Dict[str, Any], probe: bool):
+        found: List[Dict[str, Any]] = []
+        status, error = "completed", None
+        try:
+            # Read-only: new and missing cameras are handled by the regular refresh
+            camera_list = wyze_api("get_camera_list", wyzecam.get_camera_list, self.auth.auth_info)
+            notify("discovery.progress", {"discovery_id": job["id"], "total": len(camera_list), "enriched": 0})
+            if probe and not job["cancel"].is_set():
+                self._refresh_lan_hosts()
+
+            def enrich(camera: wyzecam.WyzeCamera) -> Optional[Dict[str, Any]]:
+                if job["cancel"].is_set():
+                    return None
+                payload = self._to_discovered_camera(camera)
+                if probe and payload["host"]:
+                    payload["ping"] = ping_host(payload["host"])
+                return payload
+
+            with concurrent.futures.ThreadPoolExecutor(DISCOVERY_WORKERS) as pool:
+                for future in concurrent.futures.as_completed([pool.submit(enrich, c) for c in camera_list]):
+                    payload = future.result()
+                    if payload is None:
+                        continue
+                    found.append(payload)
+                    notify("discovery.progress", {"discovery_id": job["id"], "total": len(camera_list),
+                                                  "enriched": len(found), "camera": payload})
+            if job["cancel"].is_set():
+                status = "cancelled"
+        except Exception as e:
+            log(f"Discovery {job['id']} failed: {e}")
+            status = "failed"
+            error = e.to_error() if isinstance(e, PluginError) else PluginError("internal_error", str(e)).to_error()
+        job["status"] = status
+        result: Dict[str, Any] = {"discovery_id": job["id"], "status": status, "cameras": found}
+        if error:
+            result["error"] = error
+        notify("discovery.completed", result)
+
+    def _to_discovered_camera(self, camera: wyzecam.WyzeCamera) -> Dict[str, Any]:
+        """Build the discovery payload for a camera"""
+        host, _ = self._camera_host(camera)
+        model = CAMERA_MODELS.get(camera.product_model)
+        return {
+            "id": camera.mac,
+            "name": camera.nickname,
+            "model": camera.product_model,
+            "model_name": model[0] if model else camera.product_model,
+            "model_known": model is not None,
+            "max_resolution": model[1] if model else "",
+            "manufacturer": "Wyze",
+            "host": host,
+            "capabilities": self._get_capabilities(camera),
+            "firmware_version": getattr(camera, 'firmware_ver', ''),
+            "serial": camera.mac,
+        }
 
     def _get_stream_url(self, camera: wyzecam.WyzeCamera) -> str:
         """Get the stream URL for a camera using exec source"""
@@ -407,80 +7626,1223 @@ class WyzePlugin:
         # Direct exec - use venv python so dependencies are available
         return f"exec:{VENV_PYTHON} {plugin_path} stream {camera.mac}#video=h264"
 
-    def list_cameras(self) -> List[Dict[str, Any]]:
-        """Return list of configured cameras with stream URLs"""
+    def _audio_enabled(self, camera: wyzecam.WyzeCamera) -> bool:
+        """Whether the camera's stream carries audio; only the bridge backend muxes it"""
+        return (self._stream_backend(camera.mac).name == "bridge"
+                and audio_enabled(self.config, self._camera_settings(camera.mac), camera.product_model))
+
+    def _camera_settings(self, mac: str) -> Dict[str, Any]:
+        """Get per-camera settings from the cameras config list and stored overrides"""
+        return self.camera_store.effective(self.config, mac)
+
+    def _connection_stats(self, mac: str, live: Optional[Dict[str, Any]]) -> Dict[str, Any]:
+        """Merge a camera's connection history with its running stream, if any"""
+        history = load_connection_history(mac)
+        connects = history.get("connects", 0)
+        frames = history.get("frames_total", 0)
+        dropped = history.get("dropped_frames_total", 0)
+        stats: Dict[str, Any] = {
+            "camera_id": mac,
+            "streaming": live is not None and live.get("status") != "queued",
+            "queued": live is not None and live.get("status") == "queued",
+            "connection_mode": history.get("last_connection_mode", ""),
+            "connect_latency_ms": history.get("last_connect_ms"),
+            "avg_connect_latency_ms": round(history["connect_ms_total"] / connects, 1) if connects else None,
+            "connects": connects,
+            "reconnects": max(connects - 1, 0),
+            "failures": history.get("failures", 0),
+            "last_error": history.get("last_error", ""),
+            "last_error_at": format_time(history["last_error_at"]) if history.get("last_error_at") else None,
+            "crashes": history.get("crashes", 0),
+            "restarts": history.get("restarts", 0),
+            "last_crash": history.get("last_crash", ""),
+        }
+
+        reconnect = dict((live or {}).get("reconnect") or history.get("reconnect") or {})
+        if not live and reconnect.get("state") != "given_up":
+            # Left over from a stream process that was killed
+            reconnect = {}
+        stats["reconnect"] = {
+            "state": reconnect.get("state", "idle"),
+            "attempt": reconnect.get("attempt", 0),
+            "failure": reconnect.get("failure", ""),
+            "failing_since": format_time(reconnect["since"]) if reconnect.get("since") else None,
+            "retry_at": format_time(reconnect["retry_at"]) if reconnect.get("retry_at") else None,
+        }
+
+        if live:
+            stats["connection_mode"] = live.get("connection_mode", "")
+            frames += live.get("frames", 0)
+            dropped += live.get("dropped_frames", 0)
+            connected_at = live.get("connected_at")
+            last_frame_at = live.get("last_frame_at")
+            if connected_at and last_frame_at and last_frame_at > connected_at:
+                stats["fps"] = round(live.get("frames", 0) / (last_frame_at - connected_at), 1)
+            stats["uptime_seconds"] = int(time.time() - connected_at) if connected_at else 0
+
+        fallback = load_quality_fallbacks().get(mac)
+        stats["quality_fallback"] = {
+            "quality": fallback["quality"],
+            "reason": fallback.get("reason", ""),
+            "since": format_time(fallback["since"]),
+            "retry_at": format_time(fallback["retry_at"]),
+        } if fallback else None
+        stats["frames"] = frames
+        stats["dropped_frames"] = dropped
+        stats["drop_rate"] = round(dropped / (frames + dropped), 4) if frames + dropped else 0.0
+        return stats
+
+    def get_connection_stats(self, camera_id: Optional[str] = None) -> List[Dict[str, Any]]:
+        """Connection latency, reconnect and frame-drop figures per camera"""
         if not self.auth:
-            return []
+            raise PluginError("not_initialized")
+        live = {s["mac"]: s for s in list_active_streams()}
+        if camera_id:
+            mac = self._require_camera(camera_id).mac
+            return [self._connection_stats(mac, live.get(mac))]
+        return [self._connection_stats(mac, live.get(mac)) for mac in self.auth.cameras]
+
+    def _daily_counters(self) -> Tuple[Dict[str, Dict[str, int]], List[str]]:
+        """Cumulative bytes streamed and stream failures per camera, and the cameras streaming now"""
+        live = {s["mac"]: s for s in list_active_streams()}
+        counters: Dict[str, Dict[str, int]] = {}
+        streaming = []
+        for mac in list(self.auth.cameras):
+            if mac in self.removed_cameras:
+                continue
+            history = load_connection_history(mac)
+            stream = live.get(mac) or {}
+            counters[mac] = {"bytes": history.get("bytes_total", 0) + stream.get("bytes", 0),
+                             "failures": history.get("failures", 0)}
+            if (stream.get("status") != "queued" and stream.get("connected_at")
+                    and (stream.get("reconnect") or {}).get("state", "streaming") == "streaming"):
+                streaming.append(mac)
+        return counters, streaming
 
-        result = []
-        for mac, camera in self.auth.cameras.items():
-            # Use exec source for go2rtc with venv python
-            plugin_path = os.path.abspath(__file__)
-            stream_url = f"exec:{VENV_PYTHON} {plugin_path} stream {mac}#video=h264"
-
-            result.append({
-                "id": camera.mac,
-                "plugin_id": "wyze",
-                "name": camera.nickname,
-                "model": camera.product_model,
-                "host": getattr(camera, 'ip', '') or "",
-                "main_stream": stream_url,
-                "sub_stream": "",
-                "snapshot_url": "",
-                "capabilities": self._get_capabilities(camera),
-                "online": True,
-                "last_seen": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+    def _summarize_day(self, day: Dict[str, Any], end: float, counters: Dict[str, Dict[str, int]],
+                       final: bool) -> Dict[str, Any]:
+        """Per-camera summary of a day from its DailyStats state and the event history"""
+        events = _event_store.count_types(day["start"], end, "camera.event") if _event_store else {}
+        cameras = []
+        for mac, baseline in sorted(day["baseline"].items()):
+            current = counters.get(mac, baseline)
+            streamed = max(current["bytes"] - baseline["bytes"], 0)
+            seconds = day["streaming"].get(mac, 0.0)
+            by_type = events.get(mac, {})
+            camera = self.auth.get_camera(mac) if self.auth else None
+            cameras.append({
+                "camera_id": mac,
+                "name": (self._camera_settings(mac).get("name") or camera.nickname) if camera else "",
+                "streaming_seconds": int(seconds),
+                "uptime_percent": round(seconds / day["sampled"] * 100, 1) if day["sampled"] else None,
+                "disconnects": max(current["failures"] - baseline["failures"], 0),
+                "events": by_type,
+                "events_total": sum(by_type.values()),
+                "bytes_streamed": streamed,
+                "average_bitrate_kbps": round(streamed * 8 / 1000 / seconds, 1) if seconds else None,
             })
-        return result
+        return {"date": day["day"], "timezone": _timezone_name, "final": final,
+                "sampled_seconds": int(day["sampled"]), "cameras": cameras}
 
-    def get_camera(self, camera_id: str) -> Optional[Dict[str, Any]]:
-        """Get a specific camera"""
-        cameras = self.list_cameras()
-        for cam in cameras:
-            if cam["id"] == camera_id:
-                return cam
-        return None
+    def _sample_daily(self):
+        """Add up the day's streaming time and send summary.daily once the day is over"""
+        now = time.time()
+        local = datetime.datetime.fromtimestamp(now, _timezone)
+        start = local.replace(hour=0, minute=0, second=0, microsecond=0).timestamp()
+        counters, streaming = self._daily_counters()
+        # Time the plugin wasn't running is not counted as either up or down
+        elapsed = 0.0
+        if self.last_daily_sample:
+            elapsed = min(now - self.last_daily_sample, 2 * self._interval("health_interval"))
+        self.last_daily_sample = now
+        ended = self.daily.sample(local.date().isoformat(), start, counters, streaming, elapsed)
+        if ended:
+            summary = self._summarize_day(ended, start, counters, final=True)
+            self.daily.store(ended["day"], summary)
+            notify("summary.daily", summary)
 
-    def add_camera(self, mac: str, name: Optional[str] = None) -> Optional[Dict[str, Any]]:
-        """Add a camera by MAC address"""
+    def get_daily_summary(self, date: Optional[str] = None, camera_id: Optional[str] = None) -> Dict[str, Any]:
+        """Per-camera daily summary: today so far, or a finished day"""
         if not self.auth:
-            return None
+            raise PluginError("not_initialized")
+        mac = self._require_camera(camera_id).mac if camera_id else None
+        current = self.daily.current()
+        if date is None or (current and date == current["day"]):
+            if not current:
+                return {"date": datetime.datetime.now(_timezone).date().isoformat(), "timezone": _timezone_name,
+                        "final": False, "sampled_seconds": 0, "cameras": []}
+            summary = self._summarize_day(current, time.time(), self._daily_counters()[0], final=False)
+        else:
+            try:
+                datetime.date.fromisoformat(str(date))
+            except ValueError:
+                raise PluginError("invalid_params", "date must be YYYY-MM-DD")
+            summary = self.daily.get(str(date))
+            if not summary:
+                raise PluginError("invalid_params", f"No daily summary for {date} (kept for {DAILY_SUMMARY_DAYS} days)")
+        if mac:
+            summary = dict(summary, cameras=[c for c in summary["cameras"] if c["camera_id"] == mac])
+        return summary
 
-        camera = self.auth.get_camera(mac)
-        if not camera:
-            return None
+    def get_camera_config(self, camera_id: str) -> Dict[str, Any]:
+        """Get a camera's stored overrides and effective settings"""
+        camera = self._require_camera(camera_id)
+        return {
+            "camera_id": camera.mac,
+            "overrides": self.camera_store.get(camera.mac),
+            "effective": self._camera_settings(camera.mac),
+        }
 
-        plugin_path = os.path.abspath(__file__)
-        stream_url = f"exec:{VENV_PYTHON} {plugin_path} stream {mac}#video=h264"
+    def set_camera_config(self, camera_id: str, settings: Dict[str, Any], replace: bool = False) -> Dict[str, Any]:
+        """Update a camera's stored overrides"""
+        camera = self._require_camera(camera_id)
+        masks_before = self._camera_settings(camera.mac).get("privacy_masks")
+        audio_before = self._audio_enabled(camera)
+        backend_before = self._stream_backend(camera.mac)
+        polling_before = (self._event_polling(camera.mac), self._event_poll_interval(camera.mac))
+        self.camera_store.update(camera.mac, settings, replace)
+        if (self._event_polling(camera.mac), self._event_poll_interval(camera.mac)) != polling_before:
+            # Replan this camera's event polls from now with its new interval
+            self.event_schedule.pop(camera.mac, None)
+        if self._stream_backend(camera.mac) is not backend_before:
+            self._check_published()
+            try:
+                backend_before.stop(camera.mac)
+            except (OSError, subprocess.SubprocessError) as e:
+                log(f"Failed to stop the {backend_before.name} stream for {camera.mac}: {e}")
+        if self._camera_settings(camera.mac).get("privacy_masks") != masks_before:
+            # Don't let unmasked video or a cached unmasked snapshot outlive the change
+            try:
+                os.remove(os.path.join(PLUGIN_DIR, "snapshots", f"{camera.mac}.jpg"))
+            except OSError:
+                pass
+            self._restart_stream(next((s for s in list_active_streams() if s["mac"] == camera.mac), None))
+        elif self._audio_enabled(camera) != audio_before:
+            self._restart_stream(next((s for s in list_active_streams() if s["mac"] == camera.mac), None))
+        self._check_published()
+        self._check_subscription(camera.mac)
+        return self.get_camera_config(camera.mac)
+
+    def _command_sessions(self) -> CameraSessionManager:
+        """The session manager, which also owns the plugin's TUTK initialization"""
+        with self.command_sessions_lock:
+            if not self.command_sessions:
+                self.command_sessions = CameraSessionManager(self.tutk_lib)
+            return self.command_sessions
+
+    def _camera_commands(self, camera: wyzecam.WyzeCamera, messages: List[Any]) -> List[Any]:
+        """Send IOCTLs to a camera over TUTK"""
+        if self.config.get("cloud_only", False) or not self.tutk_lib:
+            raise PluginError("cloud_only_mode", "Camera commands need a TUTK connection", camera.mac)
+        for feature in dict.fromkeys(COMMAND_FEATURES[msg.code] for msg in messages if msg.code in COMMAND_FEATURES):
+            self._require_firmware(camera, feature)
+        codes = ",".join(f"K{msg.code}" for msg in messages)
+        try:
+            results = relay_camera_commands(camera.mac, messages)
+            if results is not None:
+                log(f"{camera.mac} {codes} via stream session: {results}", "debug", "camera")
+                return results
+            results = self._command_sessions().run(self.auth.account, camera, messages)
+            log(f"{camera.mac} {codes} via command session: {results}", "debug", "camera")
+            return results
+        except Exception as e:
+            raise PluginError("camera_command_failed", f"Command to {camera.nickname} failed: {e}", camera.mac)
+
+    def take_photo(self, camera_id: str) -> Dict[str, Any]:
+        """Have the camera capture a full-resolution still to its SD card"""
+        camera = self._require_camera(camera_id)
+        taken = self._camera_commands(camera, [_TakePhotoMessage()])[0]
+        if not taken:
+            raise PluginError("camera_command_failed", f"{camera.nickname} could not take a photo (no SD card?)",
+                              camera.mac)
+        return {"camera_id": camera.mac, "saved_to": "sd_card", "timestamp": format_time(time.time())}
+
+    def ptz(self, camera_id: str, command: str, speed: Optional[int] = None, duration: Optional[float] = None,
+            pan: Optional[int] = None, tilt: Optional[int] = None) -> Dict[str, Any]:
+        """Pan/tilt a Cam Pan: move in a direction until stop (or duration), or rotate by degrees"""
+        camera = self._require_camera(camera_id)
+        if command not in PTZ_COMMANDS:
+            raise PluginError("invalid_params", f"command must be one of {', '.join(PTZ_COMMANDS)}")
+        speed = DEFAULT_PTZ_SPEED if speed is None else speed
+        if not isinstance(speed, int) or isinstance(speed, bool) or not PTZ_SPEEDS[0] <= speed <= PTZ_SPEEDS[1]:
+            raise PluginError("invalid_params", f"speed must be {PTZ_SPEEDS[0]}-{PTZ_SPEEDS[1]}")
+        if duration is not None and (not isinstance(duration, (int, float)) or isinstance(duration, bool)
+                                     or not 0 < duration <= PTZ_MAX_MOVE):
+            raise PluginError("invalid_params", f"duration must be over 0 and at most {PTZ_MAX_MOVE} seconds")
+        if command == "rotate":
+            for name, value in (("pan", pan), ("tilt", tilt)):
+                if value is not None and (not isinstance(value, int) or isinstance(value, bool)
+                                          or not -360 <= value <= 360):
+                    raise PluginError("invalid_params", f"{name} must be -360 to 360 degrees")
+            if not pan and not tilt:
+                raise PluginError("invalid_params", "rotate needs pan and/or tilt degrees")
+
+        # Any command ends the move in progress
+        moving = self.ptz_moves.pop(camera.mac, None)
+        if moving:
+            moving.set()
+        result: Dict[str, Any] = {"camera_id": camera.mac, "command": command, "speed": speed, "moving": False,
+                                  "until": None}
+        if command == "stop":
+            self._camera_commands(camera, [_RotaryActionMessage(0, 0, speed)])
+        elif command == "rotate":
+            self._camera_commands(camera, [_RotaryDegreeMessage(pan or 0, tilt or 0, speed)])
+            result.update(pan=pan or 0, tilt=tilt or 0)
+        else:
+            message = _RotaryActionMessage(*PTZ_DIRECTIONS[command], speed)
+            self._camera_commands(camera, [message])
+            until = time.time() + (duration or PTZ_MAX_MOVE)
+            stop = threading.Event()
+            self.ptz_moves[camera.mac] = stop
+            threading.Thread(target=self._ptz_move, args=(camera, message, until, stop), daemon=True).start()
+            result.update(moving=True, until=format_time(until))
+        return result
+
+    def _ptz_move(self, camera: wyzecam.WyzeCamera, message: Any, until: float, stop: threading.Event):
+        """Keep a Pan camera turning until stopped or until; stops it unless another command took over"""
+        try:
+            while not stop.wait(min(PTZ_REPEAT_INTERVAL, max(until - time.time(), 0))) and time.time() < until:
+                self._camera_commands(camera, [message])
+            if not stop.is_set():
+                self._camera_commands(camera, [_RotaryActionMessage(0, 0, message.speed)])
+        except PluginError as e:
+            log(f"PTZ move on {camera.mac} ended: {e.message}", "warning", "camera")
+        finally:
+            if self.ptz_moves.get(camera.mac) is stop:
+                del self.ptz_moves[camera.mac]
+
+    def get_osd(self, camera_id: str) -> Dict[str, Any]:
+        """Read the camera's timestamp/logo overlay state and the restream name overlay"""
+        camera = self._require_camera(camera_id)
+        names = list(OSD_COMMANDS)
+        values = self._camera_commands(camera, [_OnOffMessage(OSD_COMMANDS[n][0]) for n in names])
+        result: Dict[str, Any] = {"camera_id": camera.mac}
+        result.update(zip(names, values))
+        result["name_overlay"] = bool(self._camera_settings(camera.mac).get("osd_name", False))
+        return result
+
+    def set_osd(self, camera_id: str, timestamp: Optional[bool] = None, logo: Optional[bool] = None,
+                name_overlay: Optional[bool] = None) -> Dict[str, Any]:
+        """Toggle the camera's OSD overlays and/or the burned-in name overlay"""
+        camera = self._require_camera(camera_id)
+        changes = {"timestamp": timestamp, "logo": logo}
+        for key, value in list(changes.items()) + [("name_overlay", name_overlay)]:
+            if value is not None and not isinstance(value, bool):
+                raise PluginError("invalid_params", f"{key} must be a boolean")
+
+        messages = [_OnOffMessage(OSD_COMMANDS[k][1], v) for k, v in changes.items() if v is not None]
+        if messages:
+            self._camera_commands(camera, messages)
+        if name_overlay is not None:
+            # Takes effect when the stream next (re)connects
+            self.camera_store.update(camera.mac, {"osd_name": name_overlay or None})
+            self._check_published()
+            self._restart_stream(next((s for s in list_active_streams() if s["mac"] == camera.mac), None))
+        return self.get_osd(camera.mac) if messages else {
+            "camera_id": camera.mac,
+            "name_overlay": bool(self._camera_settings(camera.mac).get("osd_name", False)),
+        }
+
+    def _camera_detection(self, camera: wyzecam.WyzeCamera) -> Dict[str, Any]:
+        """Read the camera's motion detection switch (TUTK) and notification toggle (Wyze cloud)"""
+        detection: Dict[str, Any] = {"motion_detection": None, "notifications": None}
+        errors = []
+        try:
+            detection["motion_detection"] = self._camera_commands(camera, [_OnOffMessage(MOTION_ALARM_COMMANDS[0])])[0]
+        except PluginError as e:
+            errors.append(e.message)
+        try:
+            resp = wyze_api("get_property_list", post_device, self.auth.auth_info, "get_property_list", {
+                "device_mac": camera.mac,
+                "device_model": camera.product_model,
+                "target_pid_list": [NOTIFICATION_PROPERTY],
+            }, cameras=[camera.mac])
+            for prop in resp.get("property_list") or []:
+                if prop.get("pid") == NOTIFICATION_PROPERTY:
+                    detection["notifications"] = str(prop.get("value")) == "1"
+        except WyzeApiError as e:
+            errors.append(f"Notification state unavailable: {e}")
+        if errors:
+            detection["errors"] = errors
+        return detection
+
+    def _set_camera_detection(self, camera: wyzecam.WyzeCamera, motion_detection: Optional[bool],
+                              notifications: Optional[bool]) -> List[str]:
+        """Switch camera-side detection and notifications; returns what failed"""
+        errors = []
+        if motion_detection is not None:
+            try:
+                self._camera_commands(camera, [_OnOffMessage(MOTION_ALARM_COMMANDS[1], motion_detection)])
+            except PluginError as e:
+                errors.append(e.message)
+        if notifications is not None:
+            try:
+                wyze_api("set_property", post_device, self.auth.auth_info, "set_property", {
+                    "device_mac": camera.mac,
+                    "device_model": camera.product_model,
+                    "pid": NOTIFICATION_PROPERTY,
+                    "pvalue": "1" if notifications else "0",
+                }, idempotent=False, cameras=[camera.mac])
+            except WyzeApiError as e:
+                errors.append(f"Failed to set notifications: {e}")
+        return errors
+
+    def get_arm_state(self, camera_id: str) -> Dict[str, Any]:
+        """The NVR arm state and the camera's own detection settings"""
+        camera = self._require_camera(camera_id)
+        state = self.arm_states.get(camera.mac, {})
+        result = {
+            "camera_id": camera.mac,
+            "armed": state.get("armed", True),
+            "camera_detection": self._camera_detection(camera),
+        }
+        if state.get("restore"):
+            result["restore"] = dict(state["restore"])
+        return result
+
+    def set_arm_state(self, camera_id: str, armed: bool, sync_camera: Optional[bool] = None) -> Dict[str, Any]:
+        """Record the NVR arm state and optionally mirror it onto the camera's own detection
+
+        Disarming with sync turns off the camera's motion detection and
+        notifications after remembering their state; arming restores exactly
+        that, so settings that were already off stay off.
+        """
+        camera = self._require_camera(camera_id)
+        if not isinstance(armed, bool):
+            raise PluginError("invalid_params", "armed must be a boolean", camera.mac)
+        if sync_camera is None:
+            sync_camera = bool(self.config.get("sync_camera_detection", False))
+        elif not isinstance(sync_camera, bool):
+            raise PluginError("invalid_params", "sync_camera must be a boolean", camera.mac)
+
+        state = dict(self.arm_states.get(camera.mac, {}))
+        errors: List[str] = []
+        synced = False
+        if not armed and sync_camera and not state.get("restore"):
+            synced = True
+            current = self._camera_detection(camera)
+            restore = {k: v for k, v in current.items() if k in ("motion_detection", "notifications") and v}
+            errors = list(current.get("errors") or [])
+            errors += self._set_camera_detection(camera, False if restore.get("motion_detection") else None,
+                                                 False if restore.get("notifications") else None)
+            if restore:
+                state["restore"] = restore
+        elif armed and state.get("restore"):
+            synced = True
+            restore = state.pop("restore")
+            errors = self._set_camera_detection(camera, restore.get("motion_detection"), restore.get("notifications"))
+        state["armed"] = armed
+        state["updated_at"] = time.time()
+        self.arm_states[camera.mac] = state
+        save_arm_states(self.arm_states)
+        log(f"{camera.mac} {'armed' if armed else 'disarmed'}" + (f", camera sync errors: {errors}" if errors else ""),
+            component="camera")
+
+        result: Dict[str, Any] = {"camera_id": camera.mac, "armed": armed, "synced": synced and not errors}
+        if state.get("restore"):
+            result["restore"] = dict(state["restore"])
+        if errors:
+            result["sync_errors"] = errors
+        return result
+
+    def _snapshot_mode(self, mac: str) -> str:
+        """Get the effective snapshot mode for a camera"""
+        mode = str(self._camera_settings(mac).get("snapshot_mode",
+                   self.config.get("snapshot_mode", DEFAULT_SNAPSHOT_MODE))).lower()
+        mode = SNAPSHOT_MODE_ALIASES.get(mode, mode)
+        if mode not in SNAPSHOT_MODES:
+            log(f"Unknown snapshot mode {mode!r} for {mac}, using {DEFAULT_SNAPSHOT_MODE}")
+            mode = DEFAULT_SNAPSHOT_MODE
+        if mode == "stream" and self.config.get("cloud_only", False):
+            mode = "api"
+        return mode
+
+    def _snapshot_interval(self, mac: str) -> int:
+        """Get how long a cached snapshot stays fresh for a camera"""
+        interval = int(self._camera_settings(mac).get("snapshot_interval",
+                       self.config.get("snapshot_interval", DEFAULT_SNAPSHOT_INTERVAL)))
+        if self.config.get("low_resource", False):
+            interval = max(interval, LOW_RESOURCE_SNAPSHOT_INTERVAL)
+        return interval
+
+    def _to_plugin_camera(self, camera: wyzecam.WyzeCamera, name: Optional[str] = None) -> Dict[str, Any]:
+        """Build the camera payload returned to the NVR"""
+        # Use exec source for go2rtc with venv python
+        video = dict(load_connection_history(camera.mac).get("video") or {})
+        codec = video.get("codec", "h264")
+        settings = self._camera_settings(camera.mac)
+        if video_filter(settings, camera.nickname):
+            # The restream is re-encoded to H.264 in the new orientation
+            codec = "h264"
+            if settings.get("rotate") in (90, 270):
+                video["width"], video["height"] = video.get("height", 0), video.get("width", 0)
+        stream_url = self._stream_backend(camera.mac).stream_url(camera.mac, codec)
+        audio = self._audio_enabled(camera)
+        if audio:
+            stream_url += "#audio=aac"
+        ingestion = self._ingestion(camera.mac)
+        if self.config.get("cloud_only", False) or ingestion == "disabled":
+            stream_url = ""
+
+        removed = camera.mac in self.removed_from_account
+        connection_mode = self._stream_modes().get(camera.mac, "")
+        snapshot_mode = self._snapshot_mode(camera.mac)
+        snapshot_url = ""
+        # The cloud thumbnail URL is unmasked
+        if snapshot_mode == "api" and not self._camera_settings(camera.mac).get("privacy_masks"):
+            snapshot_url = getattr(camera, 'thumbnail', '') or ""
 
         return {
             "id": camera.mac,
             "plugin_id": "wyze",
-            "name": name or camera.nickname,
+            "name": name or self._camera_settings(camera.mac).get("name") or camera.nickname,
             "model": camera.product_model,
             "manufacturer": "Wyze",
-            "host": getattr(camera, 'ip', '') or "",
+            "host": self._camera_host(camera)[0],
             "main_stream": stream_url,
             "sub_stream": "",
-            "snapshot_url": "",
+            "snapshot_url": snapshot_url,
+            "snapshot_mode": snapshot_mode,
+            "video_codec": codec,
+            "width": video.get("width", 0),
+            "height": video.get("height", 0),
+            "fps": video.get("fps", 0),
+            # Audio is muxed in only when enabled; otherwise the exec stream is raw video
+            "audio_codec": "aac" if audio else "",
             "capabilities": self._get_capabilities(camera),
-            "online": True,
-            "last_seen": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+            "online": not removed,
+            "removed_from_account": removed,
+            "connection_mode": connection_mode,
+            "ingestion": ingestion,
+            "stream_backend": self._stream_backend(camera.mac).name,
+            "armed": self.arm_states.get(camera.mac, {}).get("armed", True),
+            "subscription": self._subscription(camera.mac)["plan"],
+            "tags": list(settings.get("tags") or []),
+            "metadata": dict(settings.get("metadata") or {}),
+            "last_seen": format_time(time.time()),
         }
 
-    def _get_capabilities(self, camera: wyzecam.WyzeCamera) -> List[str]:
-        """Get camera capabilities"""
+    def list_cameras(self) -> List[Dict[str, Any]]:
+        """Return list of configured cameras with stream URLs"""
+        if not self.auth:
+            return []
+
+        return [self._to_plugin_camera(camera) for camera in self.auth.cameras.values()
+                if camera.mac not in self.removed_cameras]
+
+    def _require_camera(self, camera_id: Optional[str]) -> wyzecam.WyzeCamera:
+        """Look up a camera or raise a camera_not_found error"""
+        if not self.auth:
+            raise PluginError("not_initialized")
+        if not camera_id:
+            raise PluginError("invalid_params", "camera_id is required")
+
+        camera = self.auth.get_camera(camera_id)
+        if not camera:
+            raise PluginError("camera_not_found", f"Camera not found: {camera_id}", camera_id)
+        if camera.mac in self.removed_cameras:
+            raise PluginError("camera_not_found", f"Camera {camera_id} was removed (see restore_camera)", camera_id)
+        return camera
+
+    def get_camera(self, camera_id: str) -> Dict[str, Any]:
+        """Get a specific camera"""
+        return self._to_plugin_camera(self._require_camera(camera_id))
+
+    def add_camera(self, mac: str, name: Optional[str] = None,
+                   extra: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+        """Add a camera by MAC address"""
+        camera = self._require_camera(mac)
+
+        if extra:
+            self.camera_store.update(camera.mac, extra)
+
+        return self._to_plugin_camera(camera, name)
+
+    def _export(self, kind: str, key: str, path: str, content_type: str) -> Optional[str]:
+        """Upload a local file to object storage once per version, returning its URL"""
+        if not self.s3:
+            return None
+        mtime = os.path.getmtime(path)
+        cached = self.s3_urls.get(path)
+        if cached and cached[0] == mtime:
+            return cached[1]
+        url = self.s3.upload_file(kind, key, path, content_type)
+        if url:
+            self.s3_urls[path] = (mtime, url)
+        return url
+
+    def capabilities(self, protocol_version: Optional[str] = None) -> Dict[str, Any]:
+        """What this build supports, so the host can adapt without probing with trial calls"""
+        compatible = None
+        if protocol_version is not None:
+            compatible = str(protocol_version).split(".")[0] == PROTOCOL_VERSION.split(".")[0]
+            if not compatible:
+                log(f"Host protocol {protocol_version} is not compatible with {PROTOCOL_VERSION}")
+        methods = {}
+        for name in API_METHODS:
+            methods[name] = {"scope": METHOD_SCOPES.get(name, "admin")}
+            if name in METHOD_CAPABILITIES:
+                methods[name]["capability"] = METHOD_CAPABILITIES[name]
+        camera_capabilities = ["video"]
+        for _, _, caps in CAMERA_MODELS.values():
+            camera_capabilities += [cap for cap in caps if cap not in camera_capabilities]
+        config = self.config
+        return {
+            "protocol_version": PROTOCOL_VERSION,
+            "version": get_plugin_version(),
+            "compatible": compatible,
+            "methods": methods,
+            "notifications": list(NOTIFICATION_TYPES),
+            "camera_capabilities": camera_capabilities,
+            "camera_models": list(CAMERA_MODELS),
+            "stream_backends": list(STREAM_BACKENDS),
+            "features": {
+                "audio": bool(config.get("audio", False)),
+                "stream_keepalive": bool(config.get("stream_keepalive", False)),
+                "event_polling": bool(config.get("event_polling", False)),
+                "incidents": int(config.get("incident_window", 0) or 0) > 0,
+                "local_detection": bool(config.get("local_detection", False)),
+                "adaptive_quality": bool(config.get("adaptive_quality", False)),
+                "rest_api": self.rest_api is not None,
+                "healthz": self.healthz is not None,
+                "webhooks": bool(config.get("webhook_url")),
+                "cloud_only": bool(config.get("cloud_only", False)),
+                "read_only": bool(config.get("read_only", False)),
+            },
+        }
+
+    def get_plugin_info(self) -> Dict[str, Any]:
+        """What exactly is deployed: versions, commits and the runtime environment"""
+        plugin_file = os.path.abspath(__file__)
+        return {
+            "version": get_plugin_version(),
+            "protocol_version": PROTOCOL_VERSION,
+            "git_commit": git_commit(PLUGIN_DIR),
+            "build_date": format_time(os.path.getmtime(plugin_file)),
+            "runtime": {
+                "python": platform.python_version(),
+                "implementation": platform.python_implementation(),
+                "executable": sys.executable,
+                "stream_python": stream_python(),
+            },
+            "os": platform.system(),
+            "os_release": platform.release(),
+            "arch": platform.machine(),
+            "bridge": {
+                "source": "{}@{}".format(*bridge_source(self.config)),
+                "wyzecam_source": get_wyzecam_source(),
+                "commit": git_commit(os.path.join(PLUGIN_DIR, "wyze-bridge")),
+            },
+            "ffmpeg": ffmpeg_version(),
+            "tutk_library": self.tutk_lib or "",
+            "stream_backends": {name: not backend.unavailable() for name, backend in self.stream_backends.items()},
+        }
+
+    def _port_manifest(self) -> Dict[str, Any]:
+        """Listening sockets of this plugin and its stream processes"""
+        listeners = []
+        for name, kind, server, purpose in (
+                ("rest_api", "web", self.rest_api, "Token-authenticated REST access to the RPC methods"),
+                ("healthz", "metrics", self.healthz, "Unauthenticated /healthz and /readyz probes")):
+            if server:
+                host, port = server.server.server_address[:2]
+                listeners.append({"name": name, "kind": kind, "protocol": "tcp", "host": host, "port": port,
+                                  "purpose": purpose, "ephemeral": False})
+        for stream in list_active_streams():
+            port = (stream.get("control") or {}).get("port")
+            if port:
+                listeners.append({"name": "stream_control", "kind": "control", "protocol": "tcp",
+                                  "host": "127.0.0.1", "port": port, "camera_id": stream["mac"],
+                                  "pid": stream["pid"], "ephemeral": True,
+                                  "purpose": "Local commands into a stream's camera session"})
+        return {
+            "plugin": "wyze",
+            "pid": os.getpid(),
+            "listeners": listeners,
+            "media": {kind: {"served_by": "go2rtc"} for kind in MEDIA_PORT_KINDS},
+            "outbound": [
+                {"protocol": "tcp", "port": 443, "purpose": "Wyze cloud API and downloads"},
+                {"protocol": "udp", "port": None, "purpose": "TUTK P2P to cameras and relay servers"},
+            ],
+        }
+
+    def _write_ports(self):
+        """Rewrite PORTS_FILE when the listeners changed"""
+        manifest = self._port_manifest()
+        if manifest == self.ports_written:
+            return
+        self.ports_written = manifest
+        try:
+            with open(PORTS_FILE + ".tmp", "w") as f:
+                json.dump(dict(manifest, updated_at=format_time(time.time())), f, indent=2)
+            os.replace(PORTS_FILE + ".tmp", PORTS_FILE)
+        except OSError as e:
+            log(f"Failed to write {PORTS_FILE}: {e}")
+
+    def get_ports(self) -> Dict[str, Any]:
+        """The port manifest, as written to PORTS_FILE"""
+        self._write_ports()
+        return dict(self._port_manifest(), path=PORTS_FILE, updated_at=format_time(time.time()))
+
+    def export_diagnostics(self) -> Dict[str, Any]:
+        """Write a diagnostics bundle and upload it when object storage is configured"""
+        bundle = {
+            "generated_at": format_time(time.time()),
+            "plugin_version": get_plugin_version(),
+            "platform": f"{platform.system()} {platform.machine()} python {platform.python_version()}",
+            "config": scrub_config(self.config),
+            "health": self.health(),
+            "connections": self.get_connection_stats() if self.auth else [],
+            "streams": list_active_streams(),
+        }
+        diag_dir = os.path.join(PLUGIN_DIR, "exports", "diagnostics")
+        os.makedirs(diag_dir, exist_ok=True)
+        name = time.strftime("%Y%m%dT%H%M%SZ", time.gmtime()) + ".json"
+        path = os.path.join(diag_dir, name)
+        with open(path, "w") as f:
+            json.dump(bundle, f, indent=2)
+
+        result = {"path": path, "size": os.path.getsize(path), "content_type": "application/json"}
+        url = self._export("diagnostics", f"diagnostics/{name}", path, "application/json")
+        if url:
+            result["url"] = url
+        return result
+
+    def get_snapshot(self, camera_id: str) -> Dict[str, Any]:
+        """Get a snapshot for a camera, honoring its snapshot mode and interval"""
+        camera = self._require_camera(camera_id)
+
+        mode = self._snapshot_mode(camera.mac)
+        if mode == "disabled":
+            raise PluginError("snapshots_disabled", camera_id=camera.mac)
+
+        snapshot_dir = os.path.join(PLUGIN_DIR, "snapshots")
+        os.makedirs(snapshot_dir, exist_ok=True)
+        path = os.path.join(snapshot_dir, f"{camera.mac}.jpg")
+
+        # Serve the cached image while it is still fresh
+        try:
+            fresh = time.time() - os.path.getmtime(path) < self._snapshot_interval(camera.mac)
+        except OSError:
+            fresh = False
+
+        throttled = False
+        if not fresh:
+            try:
+                self._fetch_snapshot(camera, mode, path)
+            except PluginError as e:
+                # Over the rate limit an older snapshot beats none
+                if e.reason != "snapshot_rate_limited" or not os.path.exists(path):
+                    raise
+                throttled = True
+
+        with open(path, "rb") as f:
+            data = f.read()
+
+        mtime = os.path.getmtime(path)
+        result = {
+            "camera_id": camera.mac,
+            "mode": mode,
+            "content_type": "image/jpeg",
+            "image": base64.b64encode(data).decode("ascii"),
+            "timestamp": format_time(mtime),
+        }
+        if throttled:
+            result["throttled"] = True
+        url = self._export("snapshots", f"snapshots/{camera.mac}/{int(mtime)}.jpg", path, "image/jpeg")
+        if url:
+            result["url"] = url
+        return result
+
+    def _fetch_snapshot(self, camera: wyzecam.WyzeCamera, mode: str, path: str):
+        """Refresh a camera's cached snapshot within the rate limits
+
+        Callers arriving while a fetch for the camera is running wait for it
+        and share its result instead of fetching again.
+        """
+        with self.snapshot_fetch_lock:
+            pending = self.snapshot_fetches.get(camera.mac)
+            leader = pending is None
+            if leader:
+                pending = {"done": threading.Event(), "error": None}
+                self.snapshot_fetches[camera.mac] = pending
+        if not leader:
+            self.snapshot_limiter.coalesced += 1
+            pending["done"].wait()
+            if pending["error"]:
+                raise pending["error"]
+            return
+
+        try:
+            wait = self.snapshot_limiter.acquire(camera.mac)
+            if wait:
+                raise PluginError("snapshot_rate_limited", f"Snapshot rate limit reached for {camera.nickname}, "
+                                  f"retry in {wait:.1f}s", camera.mac, {"retry_after": round(wait, 1)})
+            self._capture_snapshot(camera, mode, path)
+        except Exception as e:
+            pending["error"] = e
+            raise
+        finally:
+            with self.snapshot_fetch_lock:
+                self.snapshot_fetches.pop(camera.mac, None)
+            pending["done"].set()
+
+    def _capture_snapshot(self, camera: wyzecam.WyzeCamera, mode: str, path: str, timeout: int = 45):
+        """Fetch a new snapshot to path using the given mode"""
+        if mode == "api":
+            fetch_api_snapshot(camera, path)
+            # Stream snapshots come from the already rotated restream
+            settings = self._camera_settings(camera.mac)
+            vf = video_filter(settings, settings.get("name") or camera.nickname)
+            if vf:
+                try:
+                    transform_image(path, vf)
+                except (OSError, subprocess.SubprocessError) as e:
+                    log(f"Failed to rotate snapshot for {camera.mac}: {e}")
+                    if settings.get("privacy_masks"):
+                        # Never hand out the unmasked cloud image
+                        os.remove(path)
+                        raise PluginError("snapshot_unavailable", f"Could not apply privacy masks: {e}", camera.mac)
+        else:
+            capture_stream_snapshot(camera.mac, path, timeout, self._stream_backend(camera.mac).command(camera.mac))
+        self._watermark_snapshot(camera, mode, path)
+
+    def _watermark_snapshot(self, camera: wyzecam.WyzeCamera, mode: str, path: str):
+        """Burn the watermark label and capture time into a fresh snapshot"""
+        settings = self._camera_settings(camera.mac)
+        mark = settings.get("watermark")
+        if not isinstance(mark, dict) or not mark.get("snapshots", True):
+            return
+        # A watermarked restream already carries the frame's own time
+        if mode == "stream" and mark.get("stream") and not self.config.get("cloud_only", False):
+            return
+        captured = time.time()
+        stamp = time.strftime("%Y-%m-%d %H:%M:%S UTC", time.gmtime(captured))
+        if mode == "api":
+            # Wyze doesn't say when the cloud thumbnail was taken, only when we fetched it
+            stamp = f"cloud thumbnail fetched {stamp}"
+        try:
+            transform_image(path, watermark_filter(settings, stamp))
+        except (OSError, subprocess.SubprocessError) as e:
+            os.remove(path)
+            raise PluginError("snapshot_unavailable", f"Could not watermark snapshot: {e}", camera.mac)
+        os.utime(path, (captured, captured))
+
+    def get_snapshots(self, camera_ids: List[str], timeout: int = DEFAULT_SYNC_SNAPSHOT_TIMEOUT,
+                      live: bool = True) -> Dict[str, Any]:
+        """Capture snapshots from several cameras in parallel, as close to the same instant as possible
+
+        Every capture starts together and shares one deadline; cameras that miss
+        it or fail get an error entry instead of an image. With live=True
+        frames come from the live stream even for api snapshot mode cameras.
+        """
+        if not isinstance(camera_ids, list) or not camera_ids:
+            raise PluginError("invalid_params", "camera_ids must be a non-empty list")
+        if len(camera_ids) > MAX_SYNC_SNAPSHOT_CAMERAS:
+            raise PluginError("invalid_params", f"At most {MAX_SYNC_SNAPSHOT_CAMERAS} cameras per call")
+        timeout = min(max(int(timeout), 1), MAX_SYNC_SNAPSHOT_TIMEOUT)
+        cameras = [self._require_camera(camera_id) for camera_id in dict.fromkeys(camera_ids)]
+
+        sync_dir = os.path.join(PLUGIN_DIR, "snapshots", "sync")
+        os.makedirs(sync_dir, exist_ok=True)
+        batch = uuid.uuid4().hex[:8]
+        start = threading.Event()
+        results: Dict[str, Dict[str, Any]] = {}
+
+        def capture(camera: wyzecam.WyzeCamera, mode: str):
+            path = os.path.join(sync_dir, f"{camera.mac}-{batch}.jpg")
+            start.wait()
+            try:
+                wait = self.snapshot_limiter.acquire(camera.mac)
+                if wait:
+                    raise PluginError("snapshot_rate_limited", f"Snapshot rate limit reached, retry in {wait:.1f}s",
+                                      camera.mac, {"retry_after": round(wait, 1)})
+                self._capture_snapshot(camera, mode, path, timeout)
+                captured = time.time()
+                with open(path, "rb") as f:
+                    data = f.read()
+                results[camera.mac] = {
+                    "camera_id": camera.mac,
+                    "mode": mode,
+                    "content_type": "image/jpeg",
+                    "image": base64.b64encode(data).decode("ascii"),
+                    "timestamp": format_time_ms(captured),
+                    "captured_at": captured,
+                }
+                # Also refreshes the camera's cached snapshot
+                os.replace(path, os.path.join(PLUGIN_DIR, "snapshots", f"{camera.mac}.jpg"))
+            except PluginError as e:
+                results[camera.mac] = {"camera_id": camera.mac, "error": e.to_error()}
+            except Exception as e:
+                results[camera.mac] = {"camera_id": camera.mac,
+                                       "error": PluginError("snapshot_unavailable", str(e), camera.mac).to_error()}
+
+        threads = []
+        for camera in cameras:
+            mode = self._snapshot_mode(camera.mac)
+            if mode == "disabled":
+                results[camera.mac] = {"camera_id": camera.mac,
+                                       "error": PluginError("snapshots_disabled", camera_id=camera.mac).to_error()}
+                continue
+            if live and not self.config.get("cloud_only", False):
+                mode = "stream"
+            thread = threading.Thread(target=capture, args=(camera, mode), daemon=True)
+            thread.start()
+            threads.append((camera, thread))
+
+        requested = time.time()
+        start.set()
+        deadline = time.monotonic() + timeout
+        for camera, thread in threads:
+            thread.join(max(deadline - time.monotonic(), 0))
+            if thread.is_alive():
+                results.setdefault(camera.mac, {"camera_id": camera.mac, "error": PluginError(
+                    "snapshot_unavailable", f"No frame within {timeout}s", camera.mac).to_error()})
+
+        snapshots = {camera.mac: dict(results[camera.mac]) for camera in cameras}
+        captured = [r.pop("captured_at") for r in snapshots.values() if "captured_at" in r]
+        return {
+            "requested_at": format_time_ms(requested),
+            "spread_ms": round((max(captured) - min(captured)) * 1000) if captured else None,
+            "captured": len(captured),
+            "snapshots": snapshots,
+        }
+
+    def _require_capability(self, camera: wyzecam.WyzeCamera, capability: str):
+        """Reject a feature the camera's model does not have, or its firmware is too old for"""
+        if camera.product_model in CAMERA_MODELS and capability not in self._model_capabilities(camera):
+            raise PluginError("capability_not_supported", f"{camera.nickname} "
+                              f"({CAMERA_MODELS[camera.product_model][0]}) does not support {capability}",
+                              camera.mac, {"capability": capability})
+        self._require_firmware(camera, capability)
+
+    def _require_firmware(self, camera: wyzecam.WyzeCamera, feature: str):
+        """Reject a feature the camera's firmware is too old for"""
+        firmware = getattr(camera, "firmware_ver", None) or ""
+        required = self.firmware_caps.missing(camera.product_model, firmware).get(feature)
+        if required:
+            raise PluginError("firmware_upgrade_required",
+                              f"{camera.nickname} needs firmware {required} or later for {feature} (has {firmware})",
+                              camera.mac, {"capability": feature, "firmware": firmware, "required_firmware": required})
+
+    def _model_capabilities(self, camera: wyzecam.WyzeCamera) -> List[str]:
+        """Capabilities of the camera's model, regardless of firmware"""
         caps = ["video"]
+        model = CAMERA_MODELS.get(camera.product_model)
         # Check for audio support
         if hasattr(camera, 'audio') and camera.audio:
             caps.append("audio")
-        # Check for PTZ
-        if camera.product_model in ("WYZECP1", "HL_PAN2", "HL_PAN3"):
-            caps.append("ptz")
+        if model:
+            caps += [cap for cap in model[2] if cap not in caps]
         return caps
 
-    def handle_request(self, request: Dict[str, Any]) -> Dict[str, Any]:
-        """Handle a JSON-RPC request"""
+    def _get_capabilities(self, camera: wyzecam.WyzeCamera) -> List[str]:
+        """Get camera capabilities, leaving out those its firmware is too old for"""
+        missing = self.firmware_caps.missing(camera.product_model, getattr(camera, "firmware_ver", None) or "")
+        return [cap for cap in self._model_capabilities(camera) if cap not in missing]
+
+    def get_preview(self, camera_id: str, fmt: str = "mp4", duration: int = PREVIEW_MIN_DURATION) -> Dict[str, Any]:
+        """Get a short preview clip for hover previews, cached and rate limited per camera"""
+        camera = self._require_camera(camera_id)
+
+        if self.config.get("cloud_only", False):
+            raise PluginError("cloud_only_mode", "Previews are not available in cloud-only mode", camera.mac)
+        if fmt not in PREVIEW_FORMATS:
+            raise PluginError("invalid_params", f"Unsupported preview format: {fmt}")
+        duration = max(PREVIEW_MIN_DURATION, min(int(duration), PREVIEW_MAX_DURATION))
+
+        preview_dir = os.path.join(PLUGIN_DIR, "snapshots", "previews")
+        os.makedirs(preview_dir, exist_ok=True)
+        path = os.path.join(preview_dir, f"{camera.mac}.{fmt}")
+
+        # One capture per camera at a time; callers within the interval share the cached clip
+        with self.preview_locks.setdefault(camera.mac, threading.Lock()):
+            interval = int(self.config.get("preview_interval", DEFAULT_PREVIEW_INTERVAL))
+            try:
+                fresh = time.time() - os.path.getmtime(path) < interval
+            except OSError:
+                fresh = False
+            if not fresh:
+                capture_stream_preview(camera.mac, path, fmt, duration,
+                                       command=self._stream_backend(camera.mac).command(camera.mac))
+
+        with open(path, "rb") as f:
+            data = f.read()
+
+        mtime = os.path.getmtime(path)
+        result = {
+            "camera_id": camera.mac,
+            "content_type": PREVIEW_FORMATS[fmt],
+            "data": base64.b64encode(data).decode("ascii"),
+            "timestamp": format_time(mtime),
+        }
+        url = self._export("clips", f"clips/{camera.mac}/{int(mtime)}.{fmt}", path, PREVIEW_FORMATS[fmt])
+        if url:
+            result["url"] = url
+        return result
+
+    def _timeline_loop(self):
+        """Capture interval thumbnails per camera for the scrubber strip"""
+        while self.running:
+            interval = int(self.config.get("timeline_interval", 0))
+            if interval <= 0:
+                return
+            started = time.time()
+
+            # Timeline history is the first thing to give up when the disk runs low
+            low_disk = bool(self.janitor and self.janitor.low_disk)
+            for camera in list(self.auth.cameras.values()) if self.auth and not low_disk else []:
+                if not self.running or self._snapshot_mode(camera.mac) == "disabled":
+                    continue
+                try:
+                    snapshot = self.get_snapshot(camera.mac)
+                    timeline_dir = os.path.join(PLUGIN_DIR, "snapshots", "timeline", camera.mac)
+                    os.makedirs(timeline_dir, exist_ok=True)
+                    with open(os.path.join(timeline_dir, f"{int(started)}.jpg"), "wb") as f:
+                        f.write(base64.b64decode(snapshot["image"]))
+                except Exception as e:
+                    log(f"Timeline thumbnail for {camera.mac} failed: {e}")
+
+            time.sleep(max(1, jittered(interval, self.config) - (time.time() - started)))
+
+    def _start_detection(self, config: Dict[str, Any]):
+        """Load the local person detection model when local_detection is on"""
+        self.detector = None
+        self.detection_status = {"enabled": bool(config.get("local_detection", False))}
+        if not self.detection_status["enabled"]:
+            return
+        if config.get("cloud_only", False):
+            self.detection_status["error"] = "local detection needs live streams (cloud_only is set)"
+            return
+        model_path = config.get("detection_model") or DEFAULT_DETECTION_MODEL
+        if not os.path.isabs(model_path):
+            model_path = os.path.join(PLUGIN_DIR, model_path)
+        model_format = config.get("detection_model_format", "yolov8")
+        self.detection_status["model"] = os.path.basename(model_path)
+        if model_format not in DETECTION_MODEL_FORMATS:
+            raise PluginError("invalid_params",
+                              f"detection_model_format must be one of {', '.join(DETECTION_MODEL_FORMATS)}")
+        try:
+            self.detector = PersonDetector(model_path, model_format,
+                                           float(config.get("detection_threshold", DEFAULT_DETECTION_THRESHOLD)))
+        except ImportError as e:
+            self.detection_status["error"] = f"onnxruntime and numpy are required ({e.name} missing)"
+        except Exception as e:
+            self.detection_status["error"] = f"failed to load {model_path}: {e}"
+        if not self.detector:
+            log(f"Local detection disabled: {self.detection_status['error']}")
+            return
+        log(f"Local detection using {model_path} ({self.detector.width}x{self.detector.height})")
+        if not self.detection_thread:
+            self.detection_thread = threading.Thread(target=self._detection_loop, daemon=True)
+            self.detection_thread.start()
+
+    def _detection_enabled(self, mac: str) -> bool:
+        return mac not in self.removed_cameras and bool(self._camera_settings(mac).get("local_detection", True))
+
+    def _detection_loop(self):
+        """Run the person model over the latest keyframe of every streaming camera"""
+        seen: Dict[str, str] = {}
+        while self.running and self.detector:
+            started = time.time()
+            detector = self.detector
+            for stream in list_active_streams():
+                mac = stream["mac"]
+                if not self.running or not stream.get("control") or not self._detection_enabled(mac):
+                    continue
+                try:
+                    keyframe = stream_control(mac, {"op": "keyframe"})
+                    if not keyframe or seen.get(mac) == keyframe["keyframe"][-64:]:
+                        continue
+                    seen[mac] = keyframe["keyframe"][-64:]
+                    detections = detector.detect(base64.b64decode(keyframe["keyframe"]), keyframe["codec"])
+                except Exception as e:
+                    log(f"Local detection on {mac} failed: {e}")
+                    continue
+                if detections:
+                    self._local_person_event(mac, detections)
+
+            interval = int(self.config.get("detection_interval", DEFAULT_DETECTION_INTERVAL))
+            time.sleep(max(0.5, interval - (time.time() - started)))
+        self.detection_thread = None
+
+    def _local_person_event(self, mac: str, detections: List[Dict[str, Any]]):
+        """Notify a local person detection, at most once per detection_cooldown per camera"""
+        now = time.time()
+        cooldown = int(self.config.get("detection_cooldown", DEFAULT_DETECTION_COOLDOWN))
+        if now - self.last_detections.get(mac, 0) < cooldown:
+            return
+        self.last_detections[mac] = now
+        event = {
+            "camera_id": mac,
+            "event_id": f"local-{uuid.uuid4().hex[:12]}",
+            "type": "person",
+            "tags": ["person"],
+            "timestamp": format_time(now),
+            "thumbnail_url": "",
+            "source": "local",
+            "score": detections[0]["score"],
+            "detections": detections,
+        }
+        self._emit_event(event)
+        if self._ingestion(mac) == "event_only":
+            self._wake(mac, event)
+
+    def _detection_summary(self) -> Dict[str, Any]:
+        status = dict(self.detection_status)
+        if self.detector:
+            status.update({"frames": self.detector.frames, "inference_ms": round(self.detector.inference_ms, 1),
+                           "last_event": {mac: format_time(ts) for mac, ts in self.last_detections.items()}})
+        return status
+
+    def query_events(self, camera_id: Optional[str] = None, start: Any = None, end: Any = None,
+                     types: Optional[List[str]] = None, limit: int = DEFAULT_EVENT_QUERY_LIMIT,
+                     cursor: Optional[str] = None) -> Dict[str, Any]:
+        """Page through recorded events, oldest first"""
+        if not _event_store:
+            raise PluginError("not_initialized")
+        if camera_id:
+            camera_id = self._require_camera(camera_id).mac
+        try:
+            start_ts = parse_time(start) if start is not None else 0
+            end_ts = parse_time(end) if end is not None else time.time()
+            after_id = int(cursor) if cursor else 0
+        except ValueError as e:
+            raise PluginError("invalid_params", f"Invalid time range or cursor: {e}")
+        if types is not None and not isinstance(types, list):
+            raise PluginError("invalid_params", "types must be an array")
+        limit = max(1, min(int(limit), MAX_EVENT_QUERY_LIMIT))
+
+        # Fetch one extra row to know whether another page exists
+        events = _event_store.query(camera_id, start_ts, end_ts, types or [], limit + 1, after_id)
+        next_cursor = None
+        if len(events) > limit:
+            events = events[:limit]
+            next_cursor = str(events[-1]["id"])
+        return {"events": events, "next_cursor": next_cursor}
+
+    def get_timeline_thumbnails(self, camera_id: str, start: Any = None, end: Any = None,
+                                limit: int = 0) -> Dict[str, Any]:
+        """Return time-indexed thumbnails captured for a camera"""
+        self._require_camera(camera_id)
+
+        start_ts = parse_time(start) if start is not None else 0
+        end_ts = parse_time(end) if end is not None else time.time()
+
+        timeline_dir = os.path.join(PLUGIN_DIR, "snapshots", "timeline", camera_id)
+        stamps = []
+        if os.path.isdir(timeline_dir):
+            for fname in os.listdir(timeline_dir):
+                name, ext = os.path.splitext(fname)
+                if ext == ".jpg" and name.isdigit() and start_ts <= int(name) <= end_ts:
+                    stamps.append(int(name))
+        stamps.sort()
+        if limit > 0:
+            stamps = stamps[-limit:]
+
+        thumbnails = []
+        for ts in stamps:
+            with open(os.path.join(timeline_dir, f"{ts}.jpg"), "rb") as f:
+                thumbnails.append({
+                    "timestamp": format_time(ts),
+                    "image": base64.b64encode(f.read()).decode("ascii"),
+                })
+
+        return {
+            "camera_id": camera_id,
+            "interval": int(self.config.get("timeline_interval", 0)),
+            "content_type": "image/jpeg",
+            "thumbnails": thumbnails,
+        }
+
+    def _maybe_spill(self, result: Any) -> Any:
+        """Write oversized results to disk and return a reference instead"""
+        limit = self.max_inline_bytes
+        if limit <= 0:
+            return result
+
+        data = json.dumps(result).encode()
+        if len(data) <= limit:
+            return result
+
+        file_id = uuid.uuid4().hex
+        os.makedirs(SPILL_DIR, exist_ok=True)
+        path = os.path.join(SPILL_DIR, f"{file_id}.json")
+        with open(path, "wb") as f:
+            f.write(data)
+
+        ttl = int(self.config.get("spill_ttl", DEFAULT_SPILL_TTL))
+        log(f"Spilled {len(data)} byte result to {path}")
+        spilled = {
+            "spilled": True,
+            "file_id": file_id,
+            "path": path,
+            "size": len(data),
+            "sha256": hashlib.sha256(data).hexdigest(),
+            "content_type": "application/json",
+            "expires_at": format_time(time.time() + ttl),
+        }
+        url = self._export("results", f"results/{file_id}.json", path, "application/json")
+        if url:
+            spilled["url"] = url
+        return spilled
+
+    def fetch_file(self, file_id: str, offset: int, length: int) -> Dict[str, Any]:
+        """Read a chunk of a spilled result"""
+        if not file_id or not all(c in "0123456789abcdef" for c in file_id):
+            raise PluginError("invalid_params", "Invalid file_id")
+
+        path = os.path.join(SPILL_DIR, f"{file_id}.json")
+        if not os.path.exists(path):
+            raise PluginError("file_not_found", f"File not found or expired: {file_id}")
+
+        ttl = int(self.config.get("spill_ttl", DEFAULT_SPILL_TTL))
+        if time.time() - os.path.getmtime(path) > ttl:
+            os.remove(path)
+            raise PluginError("file_not_found", f"File not found or expired: {file_id}")
+
+        length = max(1, min(length, FETCH_CHUNK_SIZE))
+        size = os.path.getsize(path)
+        with open(path, "rb") as f:
+            f.seek(offset)
+            data = f.read(length)
+
+        return {
+            "file_id": file_id,
+            "offset": offset,
+            "size": size,
+            "data": base64.b64encode(data).decode("ascii"),
+            "eof": offset + len(data) >= size,
+        }
+
+    def handle_request(self, request: Dict[str, Any], scopes: Optional[set] = None) -> Dict[str, Any]:
+        """Handle a JSON-RPC request, tracking it so shutdown can drain it
+
+        scopes restricts callers other than the NVR (the REST API); the NVR's
+        own requests are checked against the scopes granted at initialize.
+        """
+        method = request.get("method", "")
+        if self.draining and method != "shutdown":
+            return {"jsonrpc": "2.0", "id": request.get("id"), "error": PluginError("shutting_down").to_error()}
+
+        token = object()
+        with self.inflight_cond:
+            if method != "shutdown":
+                self.inflight[token] = (request.get("id"), threading.get_ident())
+        try:
+            response = self._dispatch(request, scopes)
+        finally:
+            with self.inflight_cond:
+                self.inflight.pop(token, None)
+                self.inflight_cond.notify_all()
+
+        if self.drain_expired and method != "shutdown":
+            # Shutdown gave up waiting; whatever we computed is no longer valid
+            return {"jsonrpc": "2.0", "id": request.get("id"), "error": PluginError("request_cancelled").to_error()}
+        return response
+
+    def _dispatch(self, request: Dict[str, Any], scopes: Optional[set] = None) -> Dict[str, Any]:
+        """Run a JSON-RPC request"""
         method = request.get("method", "")
         params = request.get("params", {})
         req_id = request.get("id")
@@ -489,39 +8851,148 @@ class WyzePlugin:
             "jsonrpc": "2.0",
             "id": req_id,
         }
+        started = time.monotonic()
+        log(f"-> {method} id={req_id} params={sorted(params) if isinstance(params, dict) else type(params).__name__}",
+            "debug", "rpc")
 
         try:
+            self._check_scope(method, params, scopes)
+            if method in MUTATING_METHODS and self.config.get("read_only", False):
+                raise PluginError("read_only", f"{method} is not allowed in read-only mode",
+                                  params.get("camera_id") or params.get("mac"))
+            if method in METHOD_CAPABILITIES:
+                self._require_capability(self._require_camera(params.get("camera_id")), METHOD_CAPABILITIES[method])
+
             if method == "initialize":
                 response["result"] = self.initialize(params)
+            elif method == "verify_credentials":
+                response["result"] = self.verify_credentials(params)
             elif method == "shutdown":
                 response["result"] = self.shutdown()
             elif method == "health":
                 response["result"] = self.health()
+            elif method == "ping":
+                response["result"] = self.ping()
             elif method == "discover_cameras":
                 response["result"] = self.discover_cameras()
             elif method == "list_cameras":
                 response["result"] = self.list_cameras()
             elif method == "get_camera":
-                camera_id = params.get("camera_id")
-                result = self.get_camera(camera_id)
-                if result:
-                    response["result"] = result
-                else:
-                    response["error"] = {"code": -32603, "message": "Camera not found"}
+                response["result"] = self.get_camera(params.get("camera_id"))
+            elif method == "start_discovery":
+                response["result"] = self.start_discovery(params.get("probe", True))
+            elif method == "cancel_discovery":
+                response["result"] = self.cancel_discovery(params.get("discovery_id"))
+            elif method == "remove_camera":
+                response["result"] = self.remove_camera(params.get("camera_id"))
+            elif method == "list_removed_cameras":
+                response["result"] = self.list_removed_cameras()
+            elif method == "restore_camera":
+                response["result"] = self.restore_camera(params.get("camera_id"))
             elif method == "add_camera":
-                mac = params.get("mac")
-                name = params.get("name")
-                result = self.add_camera(mac, name)
-                if result:
-                    response["result"] = result
-                else:
-                    response["error"] = {"code": -32603, "message": f"Camera not found: {mac}"}
+                response["result"] = self.add_camera(params.get("mac"), params.get("name"), params.get("extra"))
+            elif method == "probe_camera":
+                response["result"] = self.probe_camera(params.get("camera_id"))
+            elif method == "run_selfcheck":
+                response["result"] = self.run_selfcheck(params.get("camera_id"))
+            elif method == "get_daily_summary":
+                response["result"] = self.get_daily_summary(params.get("date"), params.get("camera_id"))
+            elif method == "get_connection_stats":
+                response["result"] = self.get_connection_stats(params.get("camera_id"))
+            elif method == "migrate_stream_backend":
+                response["result"] = self.migrate_stream_backend(params.get("camera_ids"), params.get("backend"))
+            elif method == "prepare_upgrade":
+                response["result"] = self.prepare_upgrade()
+            elif method == "get_api_usage":
+                response["result"] = self.get_api_usage(params.get("camera_id"))
+            elif method == "query_events":
+                response["result"] = self.query_events(
+                    params.get("camera_id"), params.get("from"), params.get("to"), params.get("types"),
+                    params.get("limit", DEFAULT_EVENT_QUERY_LIMIT), params.get("cursor"),
+                )
+            elif method == "export_diagnostics":
+                response["result"] = self.export_diagnostics()
+            elif method == "reconcile_bridge":
+                response["result"] = self.reconcile_bridge()
+            elif method == "wake_camera":
+                response["result"] = self.wake_camera(params.get("camera_id"), params.get("duration"))
+            elif method == "take_photo":
+                response["result"] = self.take_photo(params.get("camera_id"))
+            elif method == "ptz":
+                response["result"] = self.ptz(
+                    params.get("camera_id"), params.get("command"), params.get("speed"), params.get("duration"),
+                    params.get("pan"), params.get("tilt"),
+                )
+            elif method == "get_osd":
+                response["result"] = self.get_osd(params.get("camera_id"))
+            elif method == "set_osd":
+                response["result"] = self.set_osd(
+                    params.get("camera_id"), params.get("timestamp"), params.get("logo"), params.get("name_overlay"),
+                )
+            elif method == "get_arm_state":
+                response["result"] = self.get_arm_state(params.get("camera_id"))
+            elif method == "set_arm_state":
+                response["result"] = self.set_arm_state(
+                    params.get("camera_id"), params.get("armed"), params.get("sync_camera"),
+                )
+            elif method == "get_subscriptions":
+                response["result"] = self.get_subscriptions(params.get("camera_id"))
+            elif method == "subscribe_events":
+                response["result"] = self.subscribe_events(params.get("types"))
+            elif method == "get_camera_config":
+                response["result"] = self.get_camera_config(params.get("camera_id"))
+            elif method == "set_camera_config":
+                response["result"] = self.set_camera_config(params.get("camera_id"), params.get("settings", {}),
+                                                            bool(params.get("replace", False)))
+            elif method == "get_snapshot":
+                response["result"] = self.get_snapshot(params.get("camera_id"))
+            elif method == "get_snapshots":
+                response["result"] = self.get_snapshots(params.get("camera_ids"),
+                                                        params.get("timeout", DEFAULT_SYNC_SNAPSHOT_TIMEOUT),
+                                                        bool(params.get("live", True)))
+            elif method == "get_preview":
+                response["result"] = self.get_preview(params.get("camera_id"), params.get("format", "mp4"),
+                                                      params.get("duration", PREVIEW_MIN_DURATION))
+            elif method == "get_timeline_thumbnails":
+                response["result"] = self.get_timeline_thumbnails(
+                    params.get("camera_id"), params.get("from"), params.get("to"),
+                    int(params.get("limit", 0)),
+                )
+            elif method == "set_log_level":
+                response["result"] = self.set_log_level(params.get("level"), params.get("component"),
+                                                        params.get("duration"))
+            elif method == "get_api_schema":
+                response["result"] = build_api_schema()
+            elif method == "capabilities":
+                response["result"] = self.capabilities(params.get("protocol_version"))
+            elif method == "get_plugin_info":
+                response["result"] = self.get_plugin_info()
+            elif method == "get_ports":
+                response["result"] = self.get_ports()
+            elif method == "fetch_file":
+                response["result"] = self.fetch_file(
+                    params.get("file_id", ""),
+                    int(params.get("offset", 0)),
+                    int(params.get("length", FETCH_CHUNK_SIZE)),
+                )
             else:
-                response["error"] = {"code": -32601, "message": f"Method not found: {method}"}
+                raise PluginError("method_not_found", f"Method not found: {method}")
+
+            if "result" in response and method != "fetch_file":
+                response["result"] = self._maybe_spill(response["result"])
+        except PluginError as e:
+            log(f"Error handling {method}: {e.reason}: {e.message}")
+            if self.telemetry:
+                self.telemetry.record_error(f"{method}:{e.reason}")
+            response["error"] = e.to_error()
         except Exception as e:
             log(f"Error handling {method}: {format_exception(e)}")
-            response["error"] = {"code": -32603, "message": str(e)}
+            if self.telemetry:
+                self.telemetry.record_error(f"{method}:{type(e).__name__}")
+            response["error"] = PluginError("internal_error", str(e)).to_error()
 
+        outcome = response["error"]["data"]["reason"] if "error" in response else "ok"
+        log(f"<- {method} id={req_id} {outcome} in {(time.monotonic() - started) * 1000:.0f}ms", "debug", "rpc")
         return response
 
 
@@ -529,33 +9000,57 @@ def run_jsonrpc():
     """Run the plugin in JSON-RPC mode"""
     log("Wyze plugin starting in JSON-RPC mode...")
 
+    # Clean up after a previous instance that was killed without shutting down
+    reap_orphans()
+
     plugin = WyzePlugin()
 
     def signal_handler(signum, frame):
         log("Received signal, shutting down...")
         plugin.shutdown()
+        # The request the signal interrupted on this thread will never finish
+        for req_id in plugin.interrupted_requests():
+            send_message({"jsonrpc": "2.0", "id": req_id, "error": PluginError("request_cancelled").to_error()})
+        _stdout.drain(STDOUT_DRAIN_TIMEOUT)
         sys.exit(0)
 
     signal.signal(signal.SIGINT, signal_handler)
     signal.signal(signal.SIGTERM, signal_handler)
 
     # Read JSON-RPC requests from stdin
-    for line in sys.stdin:
+    for line, oversized in read_request_lines(sys.stdin.buffer, lambda: plugin.max_request_bytes):
+        if oversized:
+            log(f"Request line over {plugin.max_request_bytes} bytes, skipped to the next line")
+            plugin.parse_failed(line, "oversized")
+            send_message({
+                "jsonrpc": "2.0",
+                "id": salvage_request_id(line),
+                "error": PluginError("payload_too_large",
+                                     f"Request line exceeds max_request_bytes ({plugin.max_request_bytes})").to_error(),
+            })
+            continue
+
         line = line.strip()
         if not line:
             continue
 
         try:
             request = json.loads(line)
-            response = plugin.handle_request(request)
-            print(json.dumps(response), flush=True)
-        except json.JSONDecodeError as e:
+        except ValueError as e:
             log(f"Invalid JSON: {e}")
-            print(json.dumps({
+            plugin.parse_failed(line, "invalid_json")
+            send_message({
                 "jsonrpc": "2.0",
-                "id": None,
-                "error": {"code": -32700, "message": "Parse error"}
-            }), flush=True)
+                "id": salvage_request_id(line),
+                "error": PluginError("parse_error").to_error(),
+            })
+            continue
+        send_message(plugin.handle_request(request))
+
+    # stdin EOF means the NVR went away; tear everything down
+    log("stdin closed, shutting down...")
+    plugin.shutdown()
+    _stdout.drain(STDOUT_DRAIN_TIMEOUT)
 
 
 def main():
@@ -565,13 +9060,22 @@ def main():
                        help="Command: jsonrpc (default) or stream")
     parser.add_argument("camera_mac", nargs="?",
                        help="Camera MAC address (for stream command)")
+    parser.add_argument("--dump-schema", action="store_true",
+                       help="Print the OpenRPC API schema and exit")
 
     args = parser.parse_args()
 
+    if args.dump_schema:
+        print(json.dumps(build_api_schema(), indent=2))
+        return
+
     if args.command == "stream":
         if not args.camera_mac:
             log("Camera MAC address required for stream command")
             sys.exit(1)
+        config = load_config()
+        if config and stream_supervised(config):
+            sys.exit(supervise_stream(args.camera_mac, config))
         stream_camera(args.camera_mac)
     else:
         run_jsonrpc()